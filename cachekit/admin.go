@@ -0,0 +1,72 @@
+package cachekit
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+type adminStoreStats struct {
+	Name string `json:"name"`
+	CacheStats
+}
+
+// AdminHandler returns a handler for managing the given stores, by name. GET lists the
+// stores with the estimated size of each prefix as JSON. POST with action=evict&store=<name>
+// runs an eviction pass, and action=flush&store=<name>&prefix=<prefix> drops a prefix.
+//
+// The handler does no authentication, so mount it behind one.
+func AdminHandler(stores map[string]Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, done := logkit.Operation(r.Context(), "cachekit.admin", logkit.String("method", r.Method), logkit.String("action", r.FormValue("action")))
+		defer done()
+
+		switch r.Method {
+		case http.MethodGet:
+			list := make([]adminStoreStats, 0, len(stores))
+			for name, store := range stores {
+				list = append(list, adminStoreStats{Name: name, CacheStats: store.CacheStats()})
+			}
+			sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(list); err != nil {
+				logkit.Warn(ctx, "Error writing cache stats", logkit.Err(err))
+			}
+		case http.MethodPost:
+			store, found := stores[r.FormValue("store")]
+			if !found {
+				http.Error(w, "unknown store", http.StatusNotFound)
+				return
+			}
+
+			switch r.FormValue("action") {
+			case "evict":
+				evicting, ok := store.(EvictingStore)
+				if !ok {
+					http.Error(w, "store does not support eviction", http.StatusBadRequest)
+					return
+				}
+				logkit.Info(ctx, "Eviction triggered", logkit.String("store", r.FormValue("store")))
+				evicting.TriggerEviction(ctx)
+			case "flush":
+				prefix := r.FormValue("prefix")
+				if prefix == "" {
+					http.Error(w, "missing prefix", http.StatusBadRequest)
+					return
+				}
+				logkit.Info(ctx, "Prefix flushed", logkit.String("store", r.FormValue("store")), logkit.String("prefix", prefix))
+				store.FlushPrefix(ctx, prefix)
+			default:
+				http.Error(w, "unknown action", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -11,6 +11,11 @@ var nilValue = []byte{0, 255, 1, 5, 29, 4}
 
 type Cache struct {
 	cacheStore
+
+	// flights combines concurrent loader calls for the same prefix+key. It is shared by
+	// every Cache handed out by the same store, so prefix identifies the namespace.
+	flights *flightGroup
+	prefix  []byte
 }
 
 type cacheStore interface {
@@ -23,33 +28,38 @@ func (c Cache) Get(ctx context.Context, key []byte) []byte {
 	return c.get(ctx, key)
 }
 
+// GetFunc returns the cached value for key, or calls f to load it on a miss. Concurrent
+// misses for the same key share a single call to f. If ctx is cancelled while waiting
+// for another caller's load, nil is returned.
 func (c Cache) GetFunc(ctx context.Context, key []byte, ttl time.Duration, f func(key []byte) []byte) []byte {
-	val := c.get(ctx, key)
-	if val == nil {
-		val = f(key)
-		if val == nil {
-			val = nilValue
-		}
-		c.cacheStore.set(ctx, key, val, ttl)
-	}
-	if isNil(val) {
-		return nil
-	}
+	val, _ := c.GetFuncErr(ctx, key, ttl, func(key []byte) ([]byte, error) {
+		return f(key), nil
+	})
 	return val
 }
 
+// GetFuncErr returns the cached value for key, or calls f to load it on a miss. Concurrent
+// misses for the same key share a single call to f, and all of them get its result or error.
+// If ctx is cancelled while waiting, ctx.Err() is returned, and the result is still saved
+// for the others.
 func (c Cache) GetFuncErr(ctx context.Context, key []byte, ttl time.Duration, f func(key []byte) ([]byte, error)) ([]byte, error) {
 	val := c.get(ctx, key)
 	if val == nil {
 		var err error
-		val, err = f(key)
+		val, err = c.flights.do(ctx, c.prefix, key, func(ctx context.Context) ([]byte, error) {
+			val, err := f(key)
+			if err != nil {
+				return nil, err
+			}
+			if val == nil {
+				val = nilValue
+			}
+			c.cacheStore.set(ctx, key, val, ttl)
+			return val, nil
+		})
 		if err != nil {
 			return nil, err
 		}
-		if val == nil {
-			val = nilValue
-		}
-		c.cacheStore.set(ctx, key, val, ttl)
 	}
 	if isNil(val) {
 		return nil, nil
@@ -85,7 +95,12 @@ func (c Cache) GetGobFuncErr(ctx context.Context, key []byte, ttl time.Duration,
 	return nil
 }
 
-func (c Cache) Set(ctx context.Context, key, value []byte, ttl time.Duration) {
+// Set caches value for key. Entries set with tags are dropped by InvalidateTag for any of them.
+func (c Cache) Set(ctx context.Context, key, value []byte, ttl time.Duration, tags ...string) {
+	if store, ok := c.cacheStore.(invalidatingStore); ok && len(tags) > 0 {
+		store.setTagged(ctx, key, value, ttl, tags)
+		return
+	}
 	c.set(ctx, key, value, ttl)
 }
 
@@ -93,6 +108,20 @@ func (c Cache) Remove(ctx context.Context, key []byte) {
 	c.remove(ctx, key)
 }
 
+// InvalidatePrefix drops every entry in this cache's prefix.
+func (c Cache) InvalidatePrefix(ctx context.Context) {
+	if store, ok := c.cacheStore.(invalidatingStore); ok {
+		store.invalidatePrefix(ctx)
+	}
+}
+
+// InvalidateTag drops every entry set with tag, in all prefixes of the underlying store.
+func (c Cache) InvalidateTag(ctx context.Context, tag string) {
+	if store, ok := c.cacheStore.(invalidatingStore); ok {
+		store.invalidateTag(ctx, tag)
+	}
+}
+
 func isNil(val []byte) bool {
 	if val == nil {
 		return true
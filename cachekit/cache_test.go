@@ -2,7 +2,13 @@ package cachekit
 
 import (
 	"context"
+	"errors"
+	"io"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -61,3 +67,408 @@ func cachetest(c1 *Cache, c2 *Cache, t *testing.T) bool {
 
 	return true
 }
+
+func flighttest(c *Cache, t *testing.T) bool {
+	ctx := context.Background()
+
+	// concurrent misses share a single loader call
+	calls := int64(0)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([][]byte, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = c.GetFunc(ctx, []byte("flight"), 10*time.Hour, func(key []byte) []byte {
+				atomic.AddInt64(&calls, 1)
+				<-release
+				return []byte("loaded")
+			})
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// a waiter with its own deadline gives up without affecting the load
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := c.GetFuncErr(waitCtx, []byte("flight"), 10*time.Hour, func(key []byte) ([]byte, error) {
+		atomic.AddInt64(&calls, 1)
+		return []byte("other"), nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, but got %v", err)
+		return false
+	}
+
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Expected the loader to be called once, but it was called %v times", calls)
+		return false
+	}
+	for _, v := range results {
+		if !reflect.DeepEqual(v, []byte("loaded")) {
+			t.Errorf("Expected 'loaded', but got %v", v)
+			return false
+		}
+	}
+
+	return true
+}
+
+func staletest(c *Cache, t *testing.T) bool {
+	ctx := context.Background()
+	key := []byte("stale")
+	load := func(value string, err error) func(key []byte) ([]byte, error) {
+		return func(key []byte) ([]byte, error) {
+			if err != nil {
+				return nil, err
+			}
+			return []byte(value), nil
+		}
+	}
+	get := func(value string, err error) []byte {
+		v, e := c.GetStaleFuncErr(ctx, key, 100*time.Millisecond, time.Hour, load(value, err))
+		if e != nil {
+			t.Errorf("Unexpected error: %v", e)
+		}
+		return v
+	}
+
+	// miss: wait for the loader
+	if v := get("one", nil); !reflect.DeepEqual(v, []byte("one")) {
+		t.Errorf("Expected 'one', but got %v", v)
+		return false
+	}
+
+	// fresh: the loader is not used
+	if v := get("two", nil); !reflect.DeepEqual(v, []byte("one")) {
+		t.Errorf("Expected 'one', but got %v", v)
+		return false
+	}
+
+	// stale: return the old value, refresh in the background
+	time.Sleep(150 * time.Millisecond)
+	if v := get("two", nil); !reflect.DeepEqual(v, []byte("one")) {
+		t.Errorf("Expected stale 'one', but got %v", v)
+		return false
+	}
+	if !eventually(func() bool { return reflect.DeepEqual(get("two", nil), []byte("two")) }) {
+		t.Errorf("Expected background refresh to 'two'")
+		return false
+	}
+
+	// stale reads while a refresh is in flight don't start refreshes of their own
+	time.Sleep(150 * time.Millisecond)
+	release := make(chan struct{})
+	refreshes := int64(0)
+	blocked := func(key []byte) ([]byte, error) {
+		atomic.AddInt64(&refreshes, 1)
+		<-release
+		return []byte("three"), nil
+	}
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i != 100; i++ {
+		v, err := c.GetStaleFuncErr(ctx, key, 100*time.Millisecond, time.Hour, blocked)
+		if err != nil || !reflect.DeepEqual(v, []byte("two")) {
+			t.Errorf("Expected stale 'two', but got %v %v", v, err)
+			close(release)
+			return false
+		}
+	}
+	if n := runtime.NumGoroutine() - goroutines; n > 10 {
+		t.Errorf("Expected a single refresh goroutine, but got %v new goroutines", n)
+	}
+	close(release)
+	if !eventually(func() bool { return reflect.DeepEqual(get("four", nil), []byte("three")) }) {
+		t.Errorf("Expected background refresh to 'three'")
+		return false
+	}
+	if n := atomic.LoadInt64(&refreshes); n != 1 {
+		t.Errorf("Expected a single refresh, but got %v", n)
+		return false
+	}
+
+	// stale and the loader fails: keep serving the stale value, without retrying the
+	// refresh right away
+	time.Sleep(150 * time.Millisecond)
+	failures := int64(0)
+	for i := 0; i != 3; i++ {
+		v, err := c.GetStaleFuncErr(ctx, key, 100*time.Millisecond, time.Hour, func(key []byte) ([]byte, error) {
+			atomic.AddInt64(&failures, 1)
+			return nil, errors.New("loader failed")
+		})
+		if err != nil || !reflect.DeepEqual(v, []byte("three")) {
+			t.Errorf("Expected stale 'three', but got %v %v", v, err)
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&failures); n != 1 {
+		t.Errorf("Expected a single failed refresh, but got %v", n)
+		return false
+	}
+
+	// hard expiry: errors are returned to the caller
+	c.Remove(ctx, key)
+	if _, err := c.GetStaleFuncErr(ctx, key, time.Hour, time.Hour, load("", errors.New("loader failed"))); err == nil {
+		t.Errorf("Expected an error after hard expiry")
+		return false
+	}
+
+	return true
+}
+
+func eventually(f func() bool) bool {
+	for i := 0; i != 100; i++ {
+		if f() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func invalidatetest(c1 *Cache, c2 *Cache, t *testing.T) bool {
+	ctx := context.Background()
+	world := []byte("world")
+
+	// dropping a prefix leaves other prefixes alone
+	c1.Set(ctx, []byte("a"), world, 0)
+	c1.Set(ctx, []byte("b"), world, 0)
+	c2.Set(ctx, []byte("a"), world, 0)
+	c1.InvalidatePrefix(ctx)
+	if c1.Get(ctx, []byte("a")) != nil || c1.Get(ctx, []byte("b")) != nil {
+		t.Errorf("did not expect a value after InvalidatePrefix")
+		return false
+	}
+	if v := c2.Get(ctx, []byte("a")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return false
+	}
+	c1.Set(ctx, []byte("a"), world, 0)
+	if v := c1.Get(ctx, []byte("a")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return false
+	}
+
+	// tags span prefixes
+	c1.Set(ctx, []byte("tagged1"), world, 0, "user:1")
+	c2.Set(ctx, []byte("tagged2"), world, 0, "other", "user:1")
+	c2.Set(ctx, []byte("tagged3"), world, 0, "other")
+	if v := c2.Get(ctx, []byte("tagged2")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return false
+	}
+	c1.InvalidateTag(ctx, "user:1")
+	if c1.Get(ctx, []byte("tagged1")) != nil || c2.Get(ctx, []byte("tagged2")) != nil {
+		t.Errorf("did not expect a value after InvalidateTag")
+		return false
+	}
+	if v := c2.Get(ctx, []byte("tagged3")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return false
+	}
+
+	// tags can be reused after invalidation
+	c1.Set(ctx, []byte("tagged1"), world, 0, "user:1")
+	if v := c1.Get(ctx, []byte("tagged1")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return false
+	}
+
+	return true
+}
+
+func streamtest(c *Cache, t *testing.T) bool {
+	ctx := context.Background()
+
+	// misses are nil
+	if r := c.OpenReader(ctx, []byte("stream")); r != nil {
+		r.Close()
+		t.Errorf("did not expect a reader")
+		return false
+	}
+
+	// write a value in parts
+	w := c.Create(ctx, []byte("stream"), 0)
+	if w == nil {
+		t.Errorf("expected a writer")
+		return false
+	}
+	for i := 0; i != 10; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Error(err)
+			return false
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+		return false
+	}
+
+	// streamed values are regular values
+	expected := []byte(strings.Repeat("0123456789", 10))
+	if v := c.Get(ctx, []byte("stream")); !reflect.DeepEqual(v, expected) {
+		t.Errorf("Expected %q, but got %q", expected, v)
+		return false
+	}
+
+	// read it back with seeking
+	r := c.OpenReader(ctx, []byte("stream"))
+	if r == nil {
+		t.Errorf("expected a reader")
+		return false
+	}
+	defer r.Close()
+	if size, err := r.Seek(0, io.SeekEnd); err != nil || size != 100 {
+		t.Errorf("Expected size 100, but got %v (%v)", size, err)
+		return false
+	}
+	if _, err := r.Seek(95, io.SeekStart); err != nil {
+		t.Error(err)
+		return false
+	}
+	if v, err := io.ReadAll(r); err != nil || string(v) != "56789" {
+		t.Errorf("Expected '56789', but got %q (%v)", v, err)
+		return false
+	}
+
+	// values set the regular way can be streamed, also with tags
+	c.Set(ctx, []byte("tagged"), []byte("world"), 0, "stream")
+	r2 := c.OpenReader(ctx, []byte("tagged"))
+	if r2 == nil {
+		t.Errorf("expected a reader")
+		return false
+	}
+	defer r2.Close()
+	if v, err := io.ReadAll(r2); err != nil || string(v) != "world" {
+		t.Errorf("Expected 'world', but got %q (%v)", v, err)
+		return false
+	}
+
+	// cached nils are misses
+	c.GetFunc(ctx, []byte("nil"), 0, func(key []byte) []byte { return nil })
+	if r := c.OpenReader(ctx, []byte("nil")); r != nil {
+		r.Close()
+		t.Errorf("did not expect a reader for a cached nil")
+		return false
+	}
+
+	return true
+}
+
+func multitest(c *Cache, t *testing.T) bool {
+	ctx := context.Background()
+
+	// set and get several keys at once
+	c.SetMulti(ctx, []Entry{
+		{Key: []byte("m1"), Value: []byte("one")},
+		{Key: []byte("m3"), Value: []byte("three")},
+	}, 0)
+	values := c.GetMulti(ctx, [][]byte{[]byte("m1"), []byte("m2"), []byte("m3")})
+	if !reflect.DeepEqual(values, [][]byte{[]byte("one"), nil, []byte("three")}) {
+		t.Errorf("Expected [one nil three], but got %q", values)
+		return false
+	}
+
+	// tagged entries are checked in batches too
+	c.Set(ctx, []byte("m4"), []byte("four"), 0, "multi")
+	c.InvalidateTag(ctx, "multi")
+	if values := c.GetMulti(ctx, [][]byte{[]byte("m4"), []byte("m1")}); !reflect.DeepEqual(values, [][]byte{nil, []byte("one")}) {
+		t.Errorf("Expected [nil one], but got %q", values)
+		return false
+	}
+
+	// the loader is only called for missing keys, and nils are cached
+	var loaded [][]byte
+	load := func(keys [][]byte) ([][]byte, error) {
+		loaded = append(loaded, keys...)
+		values := make([][]byte, len(keys))
+		for i, key := range keys {
+			if string(key) != "m6" {
+				values[i] = append([]byte("loaded "), key...)
+			}
+		}
+		return values, nil
+	}
+	keys := [][]byte{[]byte("m1"), []byte("m5"), []byte("m6")}
+	values, err := c.GetMultiFunc(ctx, keys, 0, load)
+	if err != nil || !reflect.DeepEqual(values, [][]byte{[]byte("one"), []byte("loaded m5"), nil}) {
+		t.Errorf("Expected [one 'loaded m5' nil], but got %q (%v)", values, err)
+		return false
+	}
+	if !reflect.DeepEqual(loaded, [][]byte{[]byte("m5"), []byte("m6")}) {
+		t.Errorf("Expected m5 and m6 to be loaded, but got %q", loaded)
+		return false
+	}
+	loaded = nil
+	values, err = c.GetMultiFunc(ctx, keys, 0, load)
+	if err != nil || !reflect.DeepEqual(values, [][]byte{[]byte("one"), []byte("loaded m5"), nil}) || loaded != nil {
+		t.Errorf("Expected cached values, but got %q (%v), loaded %q", values, err, loaded)
+		return false
+	}
+
+	// loader errors are returned
+	if _, err := c.GetMultiFunc(ctx, [][]byte{[]byte("m7")}, 0, func(keys [][]byte) ([][]byte, error) {
+		return nil, errors.New("failed")
+	}); err == nil {
+		t.Errorf("Expected an error")
+		return false
+	}
+
+	return true
+}
+
+type flightTestKey struct{}
+
+func TestFlightGroup(t *testing.T) {
+	g := newFlightGroup()
+
+	// the load keeps the values of the first caller's ctx, but not its cancellation
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), flightTestKey{}, "value"))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loaded := make(chan context.Context, 1)
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err := g.do(ctx, []byte("p"), []byte("detached"), func(ctx context.Context) ([]byte, error) {
+		close(started)
+		<-release
+		loaded <- ctx
+		return []byte("loaded"), nil
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, but got %v", err)
+	}
+	close(release)
+	loadCtx := <-loaded
+	if loadCtx.Err() != nil || loadCtx.Value(flightTestKey{}) != "value" {
+		t.Errorf("Expected a detached ctx with the caller's values, but got %v %v", loadCtx.Err(), loadCtx.Value(flightTestKey{}))
+	}
+
+	// waiters panic with the panic and stack of the load
+	var recovered interface{}
+	func() {
+		defer func() { recovered = recover() }()
+		g.do(context.Background(), []byte("p"), []byte("panics"), func(ctx context.Context) ([]byte, error) {
+			panicInLoad()
+			return nil, nil
+		})
+	}()
+	panicked, ok := recovered.(*flightPanic)
+	if !ok {
+		t.Errorf("Expected a *flightPanic, but got %v", recovered)
+		return
+	}
+	if panicked.value != "boom" || !strings.Contains(panicked.Error(), "panicInLoad") {
+		t.Errorf("Expected the panic with the stack of the load, but got %v", panicked.Error())
+	}
+}
+
+func panicInLoad() {
+	panic("boom")
+}
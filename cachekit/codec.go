@@ -0,0 +1,74 @@
+package cachekit
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+
+	"go.dedis.ch/protobuf"
+)
+
+// Codec turns values into bytes for storing in a Cache and back again.
+// Encode and Decode are always given a pointer to the value.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+var (
+	// GobCodec encodes values with encoding/gob.
+	GobCodec Codec = gobCodec{}
+
+	// JSONCodec encodes values with encoding/json.
+	JSONCodec Codec = jsonCodec{}
+
+	// ProtobufCodec encodes struct values (or pointers to structs) with go.dedis.ch/protobuf.
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Encode(v interface{}) ([]byte, error) {
+	// protobuf wants a pointer to the struct itself, so unwrap pointers to pointers
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr && val.Elem().Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	return protobuf.Encode(val.Interface())
+}
+
+func (protobufCodec) Decode(data []byte, v interface{}) error {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr && val.Elem().Kind() == reflect.Ptr {
+		if val.Elem().IsNil() {
+			val.Elem().Set(reflect.New(val.Elem().Type().Elem()))
+		}
+		val = val.Elem()
+	}
+	return protobuf.Decode(data, val.Interface())
+}
@@ -0,0 +1,92 @@
+package cachekit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression compresses values in DiskCache and DiskCache2. The ID is stored with every
+// compressed entry, so entries can still be read after the compression of a cache changes,
+// as long as the compression is registered with RegisterCompression.
+type Compression interface {
+	// ID identifies the compression in entry headers. 0 is reserved for uncompressed entries.
+	ID() byte
+	NewWriter(w io.Writer) io.WriteCloser
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCompression compresses with compress/gzip at the given level, e.g. gzip.DefaultCompression.
+type GzipCompression struct {
+	Level int
+}
+
+func (GzipCompression) ID() byte {
+	return 1
+}
+
+func (c GzipCompression) NewWriter(w io.Writer) io.WriteCloser {
+	writer, err := gzip.NewWriterLevel(w, c.Level)
+	if err != nil {
+		// invalid level
+		return gzip.NewWriter(w)
+	}
+	return writer
+}
+
+func (GzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var compressions = struct {
+	sync.RWMutex
+	byID map[byte]Compression
+}{byID: map[byte]Compression{1: GzipCompression{Level: gzip.DefaultCompression}}}
+
+// RegisterCompression makes entries written with c readable by all disk caches. Gzip is
+// registered by default.
+func RegisterCompression(c Compression) {
+	compressions.Lock()
+	defer compressions.Unlock()
+	compressions.byID[c.ID()] = c
+}
+
+func getCompression(id byte) (Compression, error) {
+	compressions.RLock()
+	defer compressions.RUnlock()
+	if c, found := compressions.byID[id]; found {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown cache compression %v", id)
+}
+
+// compress returns the compressed value, or nil if compression doesn't make it smaller.
+func compress(c Compression, value []byte) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(value)/2))
+	w := c.NewWriter(buf)
+	if _, err := w.Write(value); err != nil {
+		return nil
+	}
+	if err := w.Close(); err != nil {
+		return nil
+	}
+	if buf.Len() >= len(value) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func decompress(id byte, data []byte) ([]byte, error) {
+	c, err := getCompression(id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
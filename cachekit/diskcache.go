@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -15,11 +17,30 @@ import (
 var accessPrefix = []byte{0, 255, 0, 255}
 var idBucket = []byte{1}
 var cacheBucket = []byte{0}
+var generationBucket = []byte{2}
+
+// compressed entries set the top bit of their expiry, and their value starts with the
+// compression id
+const diskCacheCompressedFlag = -1 << 63
 
 type DiskCache struct {
-	db     *bolt.DB
-	closed bool
-	lock   sync.RWMutex
+	db          *bolt.DB
+	closed      bool
+	lock        sync.RWMutex
+	flights     *flightGroup
+	generations *generations
+	stats       *cacheStats
+	maxSize     int64
+	compression Compression
+
+	// bytes of values set, as stored and before compression
+	writtenBytes        int64
+	logicalWrittenBytes int64
+
+	// updated by Evict
+	estimatedSize  int64
+	estimatedCount int64
+	evictions      int64
 }
 
 func NewDiskCache(ctx context.Context, filename string, maxSize int64) (*DiskCache, error) {
@@ -35,13 +56,18 @@ func NewDiskCache(ctx context.Context, filename string, maxSize int64) (*DiskCac
 			return err
 		}
 		_, err = tx.CreateBucketIfNotExists(idBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(generationBucket)
 		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	cache := &DiskCache{db: db}
+	cache := &DiskCache{db: db, flights: newFlightGroup(), stats: newCacheStats(), maxSize: maxSize}
+	cache.generations = newGenerations(ctx, cache)
 	go evictionLoop(ctx, cache, maxSize)
 	return cache, nil
 }
@@ -100,7 +126,43 @@ func (d *DiskCache) GetCache(ctx context.Context, prefix string) *Cache {
 		return NewNoOpCache()
 	}
 
-	return &Cache{cacheStore: diskCacheStore{prefix: prefixBytes, db: d.db}}
+	return &Cache{
+		cacheStore: newStatsStore(newGenerationStore(diskCacheStore{prefix: prefixBytes, db: d.db, cache: d}, d.generations, prefix), d.stats, prefix),
+		flights:    d.flights,
+		prefix:     prefixBytes,
+	}
+}
+
+// CacheStats returns the stats of the cache. The size and count are from the last eviction pass.
+func (d *DiskCache) CacheStats() CacheStats {
+	size := atomic.LoadInt64(&d.estimatedSize)
+	stats := d.stats.cacheStats(size, atomic.LoadInt64(&d.estimatedCount), atomic.LoadInt64(&d.evictions))
+	stats.EstimatedLogicalSize = estimateLogicalSize(size, atomic.LoadInt64(&d.writtenBytes), atomic.LoadInt64(&d.logicalWrittenBytes))
+	return stats
+}
+
+// SetCompression makes the cache compress values written from now on, or stop compressing
+// them if c is nil. Entries already in the cache stay readable either way. Call it before
+// using the cache.
+func (d *DiskCache) SetCompression(c Compression) {
+	if c != nil {
+		RegisterCompression(c)
+	}
+	d.compression = c
+}
+
+// FlushPrefix drops every entry in prefix.
+func (d *DiskCache) FlushPrefix(ctx context.Context, prefix string) {
+	d.GetCache(ctx, prefix).InvalidatePrefix(ctx)
+}
+
+// TriggerEviction runs an eviction pass now.
+func (d *DiskCache) TriggerEviction(ctx context.Context) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.closed {
+		d.Evict(ctx, d.maxSize)
+	}
 }
 
 func (d *DiskCache) Evict(ctx context.Context, maxSize int64) {
@@ -179,76 +241,216 @@ func (d *DiskCache) Evict(ctx context.Context, maxSize int64) {
 		}
 	}
 
+	atomic.StoreInt64(&d.estimatedSize, totalSize)
+	atomic.StoreInt64(&d.estimatedCount, int64(len(seen)-deletedEntries))
+	atomic.AddInt64(&d.evictions, int64(deletedEntries))
+
 	logkit.Debug(ctx, "diskcache.evict.complete",
 		logkit.Int64("alivebytes", totalSize),
 		logkit.Int64("deleted", int64(deletedEntries)),
 		logkit.Int64("deletedleftoveraccespointers", int64(deletedLeftovers)))
 }
 
+func (d *DiskCache) loadGenerations(ctx context.Context) map[string]uint64 {
+	generations := make(map[string]uint64)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(generationBucket).ForEach(func(name, v []byte) error {
+			if len(v) == 8 {
+				generations[string(name)] = binary.LittleEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		logkit.Error(ctx, "Error reading generations from DiskCache", logkit.Err(err))
+	}
+	return generations
+}
+
+func (d *DiskCache) saveGeneration(ctx context.Context, name string, generation uint64) {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		v := make([]byte, 8)
+		binary.LittleEndian.PutUint64(v, generation)
+		return tx.Bucket(generationBucket).Put([]byte(name), v)
+	})
+	if err != nil {
+		logkit.Error(ctx, "Error writing generation to DiskCache", logkit.String("name", name), logkit.Err(err))
+	}
+}
+
+func (d *DiskCache) removeGenerations(ctx context.Context, names []string) {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(generationBucket)
+		for _, name := range names {
+			if err := bucket.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logkit.Error(ctx, "Error removing generations from DiskCache", logkit.Err(err))
+	}
+}
+
 type diskCacheStore struct {
 	prefix []byte
 	db     *bolt.DB
+	cache  *DiskCache
 }
 
 func (d diskCacheStore) get(ctx context.Context, key []byte) []byte {
 	log, done := logkit.Operation(ctx, "diskcache.get", logkit.Bytes("key", key))
 	defer done()
 
-	// get prefixedKey
-	keyBuf := new(bytes.Buffer)
-	keyBuf.Write(d.prefix)
-	keyBuf.Write(key)
-	key = keyBuf.Bytes()
+	key = d.prefixedKey(key)
 
 	// get result
 	var result []byte
-	result = nil
 	err := d.db.Update(func(tx *bolt.Tx) error {
-		// get the bucket
-		b := tx.Bucket(cacheBucket)
-
-		// read the value
-		r := b.Get(key)
-
-		// check times
-		if r != nil && len(r) >= 16 {
-			now := time.Now()
-
-			// read time fields
-			var lastAccess int64
-			var expires int64
-			buf := bytes.NewReader(r)
-			binary.Read(buf, binary.LittleEndian, &lastAccess)
-			binary.Read(buf, binary.LittleEndian, &expires)
-
-			// if the key has expired, delete it
-			if expires < now.UnixNano() {
-				b.Delete(key)
-				result = nil
-				return nil
-			}
+		result, _ = d.read(tx, tx.Bucket(cacheBucket), key)
+		return nil
+	})
+	if err != nil {
+		log.Error("Error reading from DiskCache", logkit.Err(err))
+		return nil
+	}
 
-			// slice out the times from the value
-			r = r[16:]
+	return result
+}
 
-			// copy value, so it's valid outside transaction
-			result = make([]byte, len(r))
-			copy(result, r)
+// getMulti reads all keys in a single transaction.
+func (d diskCacheStore) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	log, done := logkit.Operation(ctx, "diskcache.getmulti", logkit.Int("keys", len(keys)))
+	defer done()
 
-			// if the key has not been accessed 10 minutes, update access time.
-			if lastAccess < now.Add(-10*time.Minute).UnixNano() {
-				d.write(tx, b, key, r, time.Now().UnixNano(), expires, lastAccess)
-			}
+	values := make([][]byte, len(keys))
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(cacheBucket)
+		for i, key := range keys {
+			values[i], _ = d.read(tx, b, d.prefixedKey(key))
 		}
-
 		return nil
 	})
 	if err != nil {
 		log.Error("Error reading from DiskCache", logkit.Err(err))
+		return make([][]byte, len(keys))
+	}
+
+	return values
+}
+
+// getTTL returns the value for key with its remaining time to live.
+func (d diskCacheStore) getTTL(ctx context.Context, key []byte) ([]byte, []string, time.Duration) {
+	log, done := logkit.Operation(ctx, "diskcache.getttl", logkit.Bytes("key", key))
+	defer done()
+
+	key = d.prefixedKey(key)
+
+	var result []byte
+	var expires int64
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		result, expires = d.read(tx, tx.Bucket(cacheBucket), key)
 		return nil
+	})
+	if err != nil {
+		log.Error("Error reading from DiskCache", logkit.Err(err))
+		return nil, nil, 0
 	}
 
-	return result
+	return result, nil, diskCacheTTL(expires, time.Now())
+}
+
+// diskCacheTTL returns the time to live left of an entry. Entries set without a ttl
+// are stored with a 10 year ttl, and get 0 again.
+func diskCacheTTL(expires int64, now time.Time) time.Duration {
+	ttl := time.Duration(expires - now.UnixNano())
+	if ttl > time.Hour*24*365*5 {
+		return 0
+	}
+	if ttl <= 0 {
+		// about to expire
+		return time.Nanosecond
+	}
+	return ttl
+}
+
+// read returns a copy of the value for the prefixed key and when it expires, deleting
+// it if it has expired.
+func (d diskCacheStore) read(tx *bolt.Tx, b *bolt.Bucket, key []byte) ([]byte, int64) {
+	// read the value
+	r := b.Get(key)
+
+	// check times
+	if r == nil || len(r) < 16 {
+		return nil, 0
+	}
+	now := time.Now()
+
+	// read time fields
+	var lastAccess int64
+	var expires int64
+	buf := bytes.NewReader(r)
+	binary.Read(buf, binary.LittleEndian, &lastAccess)
+	binary.Read(buf, binary.LittleEndian, &expires)
+
+	// if the key has expired, delete it
+	if diskCacheExpires(expires) < now.UnixNano() {
+		b.Delete(key)
+		return nil, 0
+	}
+
+	// slice out the times from the value
+	r = r[16:]
+
+	// decompress or copy value, so it's valid outside transaction
+	result, err := decodeDiskCacheValue(expires, r)
+	if err != nil {
+		b.Delete(key)
+		return nil, 0
+	}
+
+	// if the key has not been accessed 10 minutes, update access time.
+	if lastAccess < now.Add(-10*time.Minute).UnixNano() {
+		d.write(tx, b, key, r, time.Now().UnixNano(), expires, lastAccess)
+	}
+
+	return result, diskCacheExpires(expires)
+}
+
+// encode returns the value as it is stored, compressed if the cache compresses and it
+// makes the value smaller, and expires with the compression flag set if so.
+func (d diskCacheStore) encode(value []byte, expires int64) ([]byte, int64) {
+	stored := value
+	if c := d.cache.compression; c != nil {
+		if compressed := compress(c, value); compressed != nil && len(compressed)+1 < len(value) {
+			stored = append([]byte{c.ID()}, compressed...)
+			expires |= diskCacheCompressedFlag
+		}
+	}
+
+	atomic.AddInt64(&d.cache.writtenBytes, int64(len(stored)))
+	atomic.AddInt64(&d.cache.logicalWrittenBytes, int64(len(value)))
+	return stored, expires
+}
+
+// diskCacheExpires returns when an entry expires, without the compression flag.
+func diskCacheExpires(expires int64) int64 {
+	return expires &^ diskCacheCompressedFlag
+}
+
+// decodeDiskCacheValue returns a copy of the value stored after the expiry of an entry,
+// decompressing it if the expiry has the compression flag.
+func decodeDiskCacheValue(expires int64, stored []byte) ([]byte, error) {
+	if expires&diskCacheCompressedFlag == 0 {
+		value := make([]byte, len(stored))
+		copy(value, stored)
+		return value, nil
+	}
+	if len(stored) == 0 {
+		return nil, errors.New("missing compression id in DiskCache entry")
+	}
+	return decompress(stored[0], stored[1:])
 }
 
 func (d diskCacheStore) set(ctx context.Context, key, value []byte, ttl time.Duration) {
@@ -264,11 +466,7 @@ func (d diskCacheStore) set(ctx context.Context, key, value []byte, ttl time.Dur
 	now := time.Now()
 	expires := now.Add(ttl).UnixNano()
 
-	// get prefixedKey
-	keyBuf := new(bytes.Buffer)
-	keyBuf.Write(d.prefix)
-	keyBuf.Write(key)
-	key = keyBuf.Bytes()
+	key = d.prefixedKey(key)
 
 	// don't write nil values
 	if value == nil {
@@ -282,8 +480,40 @@ func (d diskCacheStore) set(ctx context.Context, key, value []byte, ttl time.Dur
 		b := tx.Bucket(cacheBucket)
 
 		// write the value
-		d.write(tx, b, key, value, now.UnixNano(), expires, 0)
+		stored, expires := d.encode(value, expires)
+		d.write(tx, b, key, stored, now.UnixNano(), expires, 0)
+
+		return nil
+	})
+	if err != nil {
+		log.Error("Error writing to DiskCache", logkit.Err(err))
+	}
+}
+
+// setMulti writes all entries in a single transaction.
+func (d diskCacheStore) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	log, done := logkit.Operation(ctx, "diskcache.setmulti", logkit.Int("entries", len(entries)), logkit.Duration("ttl", ttl))
+	defer done()
+
+	// 0 = far expires
+	if ttl == 0 {
+		ttl = time.Hour * 24 * 365 * 10 // 10 years
+	}
+
+	now := time.Now()
+	expires := now.Add(ttl).UnixNano()
 
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(cacheBucket)
+		for _, entry := range entries {
+			// don't write nil values
+			if entry.Value == nil {
+				log.Warn("Tried to write nil value to cache, this is often a mistake", logkit.Bytes("key", entry.Key))
+				continue
+			}
+			stored, expires := d.encode(entry.Value, expires)
+			d.write(tx, b, d.prefixedKey(entry.Key), stored, now.UnixNano(), expires, 0)
+		}
 		return nil
 	})
 	if err != nil {
@@ -291,6 +521,13 @@ func (d diskCacheStore) set(ctx context.Context, key, value []byte, ttl time.Dur
 	}
 }
 
+func (d diskCacheStore) prefixedKey(key []byte) []byte {
+	keyBuf := new(bytes.Buffer)
+	keyBuf.Write(d.prefix)
+	keyBuf.Write(key)
+	return keyBuf.Bytes()
+}
+
 func (d *diskCacheStore) write(tx *bolt.Tx, b *bolt.Bucket, key, value []byte, now int64, expires int64, lastAccess int64) {
 	// write the value
 	buf := new(bytes.Buffer)
@@ -307,7 +544,7 @@ func (d *diskCacheStore) write(tx *bolt.Tx, b *bolt.Bucket, key, value []byte, n
 	buf.Write(key)
 	valBuf := new(bytes.Buffer)
 	binary.Write(valBuf, binary.LittleEndian, int64(len(key)+len(value)))
-	binary.Write(valBuf, binary.LittleEndian, expires)
+	binary.Write(valBuf, binary.LittleEndian, diskCacheExpires(expires))
 	b.Put(buf.Bytes(), valBuf.Bytes())
 
 	// remove old access pointer
@@ -325,11 +562,7 @@ func (d diskCacheStore) remove(ctx context.Context, key []byte) {
 	log, done := logkit.Operation(ctx, "diskcache.remove", logkit.Bytes("key", key))
 	defer done()
 
-	// get prefixedKey
-	keyBuf := new(bytes.Buffer)
-	keyBuf.Write(d.prefix)
-	keyBuf.Write(key)
-	key = keyBuf.Bytes()
+	key = d.prefixedKey(key)
 
 	// delete key
 	err := d.db.Update(func(tx *bolt.Tx) error {
@@ -6,12 +6,15 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,15 +29,26 @@ type DiskCache2Stats struct {
 	Hits      int64
 	Evictions int64
 
+	// bytes on disk, after compression
 	WrittenBytes int64
 	ReadBytes    int64
 	DeletedBytes int64
+
+	// bytes of values, before compression
+	LogicalWrittenBytes int64
+	LogicalReadBytes    int64
 }
 
 type DiskCache2 struct {
 	basePath string
 	maxSize  int64
 	stats    DiskCache2Stats
+	flights  *flightGroup
+
+	prefixStats *cacheStats
+	compression Compression
+
+	generations *generations
 
 	chEvict chan dc2EvictCommand
 }
@@ -68,7 +82,19 @@ const (
 	dc2DirMode    = os.ModePerm
 
 	dc2HeaderSize = 8
-	dc2HashSize   = sha1.Size
+
+	// compressed entries set the top bit of the expiry, which is followed by the
+	// compression id and the uncompressed size
+	dc2CompressedFlag       = -1 << 63
+	dc2CompressedHeaderSize = dc2HeaderSize + 1 + 8
+
+	dc2HashSize = sha1.Size
+
+	// pending files older than this are considered leftovers from a crashed Set()
+	dc2PendingMaxAge = 10 * time.Minute
+
+	// how many files getMulti and setMulti read or write at the same time
+	dc2MultiConcurrency = 16
 
 	// how long should we wait after each item
 	dc2EvictFastThrottle = 0 * time.Millisecond
@@ -84,9 +110,13 @@ func NewDiskCache2(ctx context.Context, basePath string, maxSize int64) (*DiskCa
 	cache := &DiskCache2{
 		basePath: basePath,
 		maxSize:  maxSize,
+		flights:  newFlightGroup(),
+
+		prefixStats: newCacheStats(),
 
 		chEvict: make(chan dc2EvictCommand, 1),
 	}
+	cache.generations = newGenerations(ctx, cache)
 
 	if err := os.MkdirAll(cache.dataPath(), dc2DirMode); err != nil {
 		_ = logkit.Error(ctx, "Error creating cache path", logkit.String("path", cache.dataPath()), logkit.Err(err))
@@ -123,8 +153,8 @@ func (cache *DiskCache2) walkCache(ctx context.Context, fn func(path string, has
 	defer func() {
 		_ = logkit.Debug(ctx, "Cache walk complete",
 			logkit.Duration("time", time.Since(start)),
-			logkit.Int64("size", cache.stats.EstimatedSize),
-			logkit.Int64("count", cache.stats.EstimatedCount))
+			logkit.Int64("size", atomic.LoadInt64(&cache.stats.EstimatedSize)),
+			logkit.Int64("count", atomic.LoadInt64(&cache.stats.EstimatedCount)))
 	}()
 
 	atomic.StoreInt64(&cache.stats.EstimatedSize, 0)
@@ -136,12 +166,17 @@ func (cache *DiskCache2) walkCache(ctx context.Context, fn func(path string, has
 		}
 
 		if info.IsDir() {
+			if path == cache.generationsPath() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
 		if filepath.Ext(path) == dc2ExtPending {
-			// leftover invalid entry
-			_ = os.Remove(path)
+			// leftover invalid entry, unless it's a Set() still in progress
+			if time.Since(info.ModTime()) > dc2PendingMaxAge {
+				_ = os.Remove(path)
+			}
 			return nil
 		}
 
@@ -209,7 +244,7 @@ func (cache *DiskCache2) evict(ctx context.Context, threshold float64, throttle
 		heap.Push(state, item)
 	})
 
-	for cache.stats.EstimatedSize >= thresholdSize {
+	for atomic.LoadInt64(&cache.stats.EstimatedSize) >= thresholdSize && state.Len() > 0 {
 		item := heap.Pop(state).(dc2CacheItem)
 
 		if cache.Remove(ctx, item.hash) {
@@ -223,6 +258,62 @@ func (cache *DiskCache2) dataPath() string {
 	return cache.basePath // .Join(cache.basePath, "data")
 }
 
+func (cache *DiskCache2) generationsPath() string {
+	return filepath.Join(cache.basePath, "generations")
+}
+
+func (cache *DiskCache2) generationPath(name string) string {
+	return filepath.Join(cache.generationsPath(), fmt.Sprintf("%x", sha1.Sum([]byte(name))))
+}
+
+// loadGenerations reads the generation files, which hold the generation followed by the name.
+func (cache *DiskCache2) loadGenerations(ctx context.Context) map[string]uint64 {
+	generations := make(map[string]uint64)
+	files, err := os.ReadDir(cache.generationsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			_ = logkit.Error(ctx, "Failed to list generation files", logkit.String("path", cache.generationsPath()), logkit.Err(err))
+		}
+		return generations
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), dc2ExtPending) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(cache.generationsPath(), file.Name()))
+		if err != nil || len(data) <= 8 {
+			continue
+		}
+		generations[string(data[8:])] = binary.LittleEndian.Uint64(data)
+	}
+	return generations
+}
+
+func (cache *DiskCache2) saveGeneration(ctx context.Context, name string, generation uint64) {
+	path := cache.generationPath(name)
+	data := make([]byte, 8, 8+len(name))
+	binary.LittleEndian.PutUint64(data, generation)
+	data = append(data, name...)
+
+	// write and rename, so a crash never leaves a truncated generation behind
+	_ = os.MkdirAll(cache.generationsPath(), dc2DirMode)
+	if err := os.WriteFile(path+dc2ExtPending, data, dc2FileMode); err != nil {
+		_ = logkit.Error(ctx, "Failed to write generation file", logkit.String("path", path), logkit.Err(err))
+		return
+	}
+	if err := os.Rename(path+dc2ExtPending, path); err != nil {
+		_ = logkit.Error(ctx, "Failed to rename generation file", logkit.String("path", path), logkit.Err(err))
+	}
+}
+
+func (cache *DiskCache2) removeGenerations(ctx context.Context, names []string) {
+	for _, name := range names {
+		if err := os.Remove(cache.generationPath(name)); err != nil && !os.IsNotExist(err) {
+			_ = logkit.Error(ctx, "Failed to remove generation file", logkit.String("path", cache.generationPath(name)), logkit.Err(err))
+		}
+	}
+}
+
 func (cache *DiskCache2) itemKeyHash(prefix []byte, key []byte) dc2Hash {
 	hash := sha1.New()
 	_, _ = hash.Write(prefix)
@@ -247,72 +338,241 @@ func (cache *DiskCache2) itemPath(hash dc2Hash) string {
 }
 
 func (cache *DiskCache2) Stats() DiskCache2Stats {
-	return cache.stats
+	return DiskCache2Stats{
+		EstimatedSize:  atomic.LoadInt64(&cache.stats.EstimatedSize),
+		EstimatedCount: atomic.LoadInt64(&cache.stats.EstimatedCount),
+		Misses:         atomic.LoadInt64(&cache.stats.Misses),
+		Hits:           atomic.LoadInt64(&cache.stats.Hits),
+		Evictions:      atomic.LoadInt64(&cache.stats.Evictions),
+		WrittenBytes:   atomic.LoadInt64(&cache.stats.WrittenBytes),
+		ReadBytes:      atomic.LoadInt64(&cache.stats.ReadBytes),
+		DeletedBytes:   atomic.LoadInt64(&cache.stats.DeletedBytes),
+
+		LogicalWrittenBytes: atomic.LoadInt64(&cache.stats.LogicalWrittenBytes),
+		LogicalReadBytes:    atomic.LoadInt64(&cache.stats.LogicalReadBytes),
+	}
+}
+
+// SetCompression makes the cache compress values written from now on, or stop compressing
+// them if c is nil. Entries already in the cache stay readable either way. Call it before
+// using the cache.
+func (cache *DiskCache2) SetCompression(c Compression) {
+	if c != nil {
+		RegisterCompression(c)
+	}
+	cache.compression = c
+}
+
+// CacheStats returns the stats of the cache, with the hits and misses of each prefix.
+func (cache *DiskCache2) CacheStats() CacheStats {
+	stats := cache.Stats()
+	cacheStats := cache.prefixStats.cacheStats(stats.EstimatedSize, stats.EstimatedCount, stats.Evictions)
+	cacheStats.EstimatedLogicalSize = estimateLogicalSize(stats.EstimatedSize, stats.WrittenBytes, stats.LogicalWrittenBytes)
+	return cacheStats
+}
+
+// FlushPrefix drops every entry in prefix.
+func (cache *DiskCache2) FlushPrefix(ctx context.Context, prefix string) {
+	cache.GetCache(ctx, prefix).InvalidatePrefix(ctx)
+}
+
+// TriggerEviction starts an eviction pass in the background, if one isn't queued already.
+func (cache *DiskCache2) TriggerEviction(_ context.Context) {
+	cache.triggerEviction(dc2EvictTriggerFast)
 }
 
 func (cache *DiskCache2) GetCache(_ context.Context, prefix string) *Cache {
 	return &Cache{
-		cacheStore: dc2Store{
+		cacheStore: newStatsStore(newGenerationStore(dc2Store{
 			prefix: []byte(prefix),
 			cache:  cache,
-		},
+		}, cache.generations, prefix), cache.prefixStats, prefix),
+		flights: cache.flights,
+		prefix:  []byte(prefix),
 	}
 }
 
 func (cache *DiskCache2) Get(ctx context.Context, keyHash dc2Hash) []byte {
+	data, _ := cache.getTTL(ctx, keyHash)
+	return data
+}
+
+// getTTL returns the value stored for keyHash with its remaining time to live, 0 if it
+// never expires.
+func (cache *DiskCache2) getTTL(ctx context.Context, keyHash dc2Hash) ([]byte, time.Duration) {
+	reader, expiresAt := cache.openReader(ctx, keyHash)
+	if reader == nil {
+		return nil, 0
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		_ = logkit.Warn(ctx, "Cache file exists but failed to read the data", logkit.String("path", cache.itemPath(keyHash)), logkit.Err(err))
+		return nil, 0
+	}
+
+	if expiresAt == 0 {
+		return data, 0
+	}
+	ttl := time.Until(time.Unix(expiresAt, 0))
+	if ttl <= 0 {
+		return nil, 0
+	}
+	return data, ttl
+}
+
+// OpenReader returns a reader for the value stored for keyHash, or nil if there is none.
+// The reader only covers the value, so seeking to 0 is the start of the value. Compressed
+// values are decompressed while reading; seeking backwards in them restarts decompression.
+func (cache *DiskCache2) OpenReader(ctx context.Context, keyHash dc2Hash) io.ReadSeekCloser {
+	reader, _ := cache.openReader(ctx, keyHash)
+	return reader
+}
+
+// openReader is OpenReader, also returning when the value expires in unix seconds, 0 if never.
+func (cache *DiskCache2) openReader(ctx context.Context, keyHash dc2Hash) (io.ReadSeekCloser, int64) {
 	path := cache.itemPath(keyHash)
+	var expiresAt int64
 
 	// TODO: do we need to worry about data integrity? maybe using a filesystem like ZFS would be enough
 
-	data := func() []byte {
+	reader := func() io.ReadSeekCloser {
 		fp, err := os.Open(path)
-		defer fp.Close()
-
 		if err != nil {
 			return nil
 		}
 
-		var expiresAt int64
+		var header [dc2CompressedHeaderSize]byte
 
-		if err := binary.Read(fp, binary.LittleEndian, &expiresAt); err != nil {
+		if _, err := io.ReadFull(fp, header[:dc2HeaderSize]); err != nil {
 			_ = logkit.Warn(ctx, "Cache file exists but failed to read the header", logkit.String("path", path), logkit.Err(err))
+			fp.Close()
 			return nil
 		}
 
+		expiresAt = int64(binary.LittleEndian.Uint64(header[:dc2HeaderSize]))
+		compressed := expiresAt&dc2CompressedFlag != 0
+		expiresAt &^= dc2CompressedFlag
+
 		if expiresAt != 0 && time.Now().After(time.Unix(expiresAt, 0)) {
 			// stale entry
+			fp.Close()
 			return nil
 		}
 
-		data, err := io.ReadAll(fp)
+		info, err := fp.Stat()
+		if err != nil {
+			_ = logkit.Warn(ctx, "Cache file exists but failed to stat it", logkit.String("path", path), logkit.Err(err))
+			fp.Close()
+			return nil
+		}
+
+		if !compressed {
+			atomic.AddInt64(&cache.stats.ReadBytes, dc2HeaderSize)
+			return &dc2Reader{
+				SectionReader: io.NewSectionReader(fp, dc2HeaderSize, info.Size()-dc2HeaderSize),
+				file:          fp,
+				cache:         cache,
+			}
+		}
 
+		if _, err := io.ReadFull(fp, header[dc2HeaderSize:]); err != nil {
+			_ = logkit.Warn(ctx, "Cache file exists but failed to read the compression header", logkit.String("path", path), logkit.Err(err))
+			fp.Close()
+			return nil
+		}
+
+		compression, err := getCompression(header[dc2HeaderSize])
 		if err != nil {
-			_ = logkit.Warn(ctx, "Cache file exists but failed to read the data", logkit.String("path", path), logkit.Err(err))
+			_ = logkit.Warn(ctx, "Cache file is compressed with an unknown compression", logkit.String("path", path), logkit.Err(err))
+			fp.Close()
 			return nil
 		}
 
-		return data
+		atomic.AddInt64(&cache.stats.ReadBytes, dc2CompressedHeaderSize)
+		return &dc2CompressedReader{
+			data:        io.NewSectionReader(fp, dc2CompressedHeaderSize, info.Size()-dc2CompressedHeaderSize),
+			file:        fp,
+			cache:       cache,
+			compression: compression,
+			size:        int64(binary.LittleEndian.Uint64(header[dc2HeaderSize+1:])),
+		}
 	}()
 
-	if data == nil {
+	if reader == nil {
 		// _ = logkit.Debug(ctx, "Cache miss", logkit.String("path", path))
 
 		atomic.AddInt64(&cache.stats.Misses, 1)
 
 		// TODO: async removal?
 		cache.Remove(ctx, keyHash)
+		return nil, 0
+	}
+
+	// _ = logkit.Debug(ctx, "Cache hit", logkit.String("path", path))
+
+	atomic.AddInt64(&cache.stats.Hits, 1)
+
+	return reader, expiresAt
+}
+
+func (cache *DiskCache2) Set(ctx context.Context, keyHash dc2Hash, value []byte, ttl time.Duration) {
+	var writer *dc2Writer
+	var err error
+
+	// values that don't get smaller are stored uncompressed
+	if compressed := cache.compress(value); compressed != nil {
+		writer = cache.create(ctx, keyHash, ttl, cache.compression.ID(), int64(len(value)))
+		if writer == nil {
+			return
+		}
+		writer.logicalSize = int64(len(value))
+		_, err = writer.writeRaw(compressed)
 	} else {
-		// _ = logkit.Debug(ctx, "Cache hit", logkit.String("path", path))
+		writer = cache.create(ctx, keyHash, ttl, 0, 0)
+		if writer == nil {
+			return
+		}
+		_, err = writer.Write(value)
+	}
 
-		size := int64(len(data)) + dc2HeaderSize
-		atomic.AddInt64(&cache.stats.ReadBytes, size)
-		atomic.AddInt64(&cache.stats.Hits, 1)
+	if err != nil {
+		// Close() will discard the pending file
+		_ = logkit.Error(ctx, "Failed to write the data into a cache file", logkit.String("path", cache.itemPath(keyHash)), logkit.Err(err))
 	}
+	_ = writer.Close()
+}
 
-	return data
+func (cache *DiskCache2) compress(value []byte) []byte {
+	if cache.compression == nil {
+		return nil
+	}
+	return compress(cache.compression, value)
 }
 
-func (cache *DiskCache2) Set(ctx context.Context, keyHash dc2Hash, value []byte, ttl time.Duration) {
+// Create returns a writer for a new value for keyHash, or nil if the cache file could not
+// be created. The value is written to a pending file and replaces the old value when the
+// writer is closed. If any write fails, Close discards the value and returns the error.
+func (cache *DiskCache2) Create(ctx context.Context, keyHash dc2Hash, ttl time.Duration) io.WriteCloser {
+	var writer *dc2Writer
+
+	if cache.compression != nil {
+		if writer = cache.create(ctx, keyHash, ttl, cache.compression.ID(), 0); writer != nil {
+			// the size is written to the header on Close
+			writer.compressor = cache.compression.NewWriter(dc2RawWriter{writer})
+		}
+	} else {
+		writer = cache.create(ctx, keyHash, ttl, 0, 0)
+	}
+
+	if writer == nil {
+		return nil
+	}
+	return writer
+}
+
+func (cache *DiskCache2) create(ctx context.Context, keyHash dc2Hash, ttl time.Duration, compressionID byte, logicalSize int64) *dc2Writer {
 	path := cache.itemPath(keyHash)
 
 	pendingTag := make([]byte, 4)
@@ -320,69 +580,44 @@ func (cache *DiskCache2) Set(ctx context.Context, keyHash dc2Hash, value []byte,
 
 	pendingPath := fmt.Sprintf("%v-%x%v", path, pendingTag, dc2ExtPending)
 
-	size := int64(len(value)) + dc2HeaderSize
-	var oldSize int64
-	var oldCount int64
-
-	if stat, err := os.Stat(path); err == nil {
-		oldSize = stat.Size()
-		oldCount = 1
-	}
-
 	_ = os.MkdirAll(filepath.Dir(path), dc2FileMode)
 	pending, err := os.OpenFile(pendingPath, os.O_RDWR|os.O_CREATE, dc2FileMode)
 
 	if err != nil {
 		_ = logkit.Error(ctx, "Failed to create a cache file", logkit.String("path", pendingPath), logkit.Err(err))
-		return
+		return nil
 	}
 
-	// defer is function-wide, and we want to close pending file before renaming
-	result := func() bool {
-		defer pending.Close()
-		var expiresAt int64
+	var expiresAt int64
 
-		if ttl != 0 {
-			expiresAt = time.Now().Add(ttl).Unix()
-		}
-
-		if err := binary.Write(pending, binary.LittleEndian, expiresAt); err != nil {
-			_ = logkit.Error(ctx, "Failed to write the header into a cache file", logkit.String("path", pendingPath), logkit.Err(err))
-			return false
-		}
-
-		if _, err := pending.Write(value); err != nil {
-			_ = logkit.Error(ctx, "Failed to write the data into a cache file", logkit.String("path", pendingPath), logkit.Err(err))
-			return false
-		}
-
-		atomic.AddInt64(&cache.stats.WrittenBytes, size)
-
-		// errors here can't be handled very well
-		_ = pending.Sync()
-		return true
-	}()
-
-	if !result {
-		// corrupted file
-		_ = os.Remove(pendingPath)
-		return
+	if ttl != 0 {
+		expiresAt = time.Now().Add(ttl).Unix()
 	}
 
-	// rename will remove the old file
-	if err := os.Rename(pendingPath, path); err != nil {
-		_ = logkit.Error(ctx, "Failed to rename pending cache file", logkit.String("path", pendingPath), logkit.Err(err))
-		cache.Remove(ctx, keyHash)
-		return
+	var header []byte
+	if compressionID != 0 {
+		header = make([]byte, dc2CompressedHeaderSize)
+		binary.LittleEndian.PutUint64(header, uint64(expiresAt|dc2CompressedFlag))
+		header[dc2HeaderSize] = compressionID
+		binary.LittleEndian.PutUint64(header[dc2HeaderSize+1:], uint64(logicalSize))
+	} else {
+		header = make([]byte, dc2HeaderSize)
+		binary.LittleEndian.PutUint64(header, uint64(expiresAt))
 	}
 
-	// _ = logkit.Debug(ctx, "Created a cache item", logkit.String("path", path), logkit.Int64("size", size))
-
-	atomic.AddInt64(&cache.stats.EstimatedCount, 1-oldCount)
+	writer := &dc2Writer{
+		ctx:         ctx,
+		cache:       cache,
+		keyHash:     keyHash,
+		pending:     pending,
+		pendingPath: pendingPath,
+	}
 
-	if atomic.AddInt64(&cache.stats.EstimatedSize, size-oldSize) >= cache.maxSize {
-		cache.triggerEviction(dc2EvictTriggerSlow)
+	if _, err := writer.writeRaw(header); err != nil {
+		_ = logkit.Error(ctx, "Failed to write the header into a cache file", logkit.String("path", pendingPath), logkit.Err(err))
 	}
+
+	return writer
 }
 
 func (cache *DiskCache2) Remove(ctx context.Context, keyHash dc2Hash) bool {
@@ -412,11 +647,238 @@ func (cache *DiskCache2) Remove(ctx context.Context, keyHash dc2Hash) bool {
 	return false
 }
 
+type dc2Reader struct {
+	*io.SectionReader
+	file  *os.File
+	cache *DiskCache2
+}
+
+func (r *dc2Reader) Read(p []byte) (int, error) {
+	n, err := r.SectionReader.Read(p)
+	atomic.AddInt64(&r.cache.stats.ReadBytes, int64(n))
+	atomic.AddInt64(&r.cache.stats.LogicalReadBytes, int64(n))
+	return n, err
+}
+
+func (r *dc2Reader) Close() error {
+	return r.file.Close()
+}
+
+// dc2CompressedReader decompresses a value while reading it. Seeking only moves the
+// position; the next Read skips ahead, or starts over if the position moved backwards.
+type dc2CompressedReader struct {
+	data        *io.SectionReader
+	file        *os.File
+	cache       *DiskCache2
+	compression Compression
+	size        int64
+
+	pos       int64
+	reader    io.ReadCloser
+	readerPos int64
+}
+
+func (r *dc2CompressedReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.reader == nil || r.readerPos > r.pos {
+		if r.reader != nil {
+			r.reader.Close()
+			r.reader = nil
+		}
+		if _, err := r.data.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		reader, err := r.compression.NewReader(dc2CountingReader{r.data, r.cache})
+		if err != nil {
+			return 0, err
+		}
+		r.reader, r.readerPos = reader, 0
+	}
+
+	if r.readerPos < r.pos {
+		n, err := io.CopyN(io.Discard, r.reader, r.pos-r.readerPos)
+		r.readerPos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.reader.Read(p)
+	r.pos += int64(n)
+	r.readerPos += int64(n)
+	atomic.AddInt64(&r.cache.stats.LogicalReadBytes, int64(n))
+	return n, err
+}
+
+func (r *dc2CompressedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("cachekit: seek before the start of the value")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *dc2CompressedReader) Close() error {
+	if r.reader != nil {
+		r.reader.Close()
+	}
+	return r.file.Close()
+}
+
+type dc2CountingReader struct {
+	r     io.Reader
+	cache *DiskCache2
+}
+
+func (r dc2CountingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.cache.stats.ReadBytes, int64(n))
+	return n, err
+}
+
+type dc2Writer struct {
+	ctx         context.Context
+	cache       *DiskCache2
+	keyHash     dc2Hash
+	pending     *os.File
+	pendingPath string
+	size        int64
+	logicalSize int64
+	compressor  io.WriteCloser
+	err         error
+	closed      bool
+}
+
+func (w *dc2Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.compressor != nil {
+		n, err := w.compressor.Write(p)
+		w.logicalSize += int64(n)
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		return n, err
+	}
+
+	n, err := w.writeRaw(p)
+	w.logicalSize += int64(n)
+	return n, err
+}
+
+// writeRaw writes to the file as is.
+func (w *dc2Writer) writeRaw(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.pending.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *dc2Writer) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+
+	cache := w.cache
+	ctx := w.ctx
+	path := cache.itemPath(w.keyHash)
+
+	if w.compressor != nil && w.err == nil {
+		if err := w.compressor.Close(); err != nil && w.err == nil {
+			w.err = err
+		}
+
+		// the size wasn't known when the header was written
+		if w.err == nil {
+			size := make([]byte, 8)
+			binary.LittleEndian.PutUint64(size, uint64(w.logicalSize))
+			if _, err := w.pending.WriteAt(size, dc2HeaderSize+1); err != nil {
+				w.err = err
+			}
+		}
+	}
+
+	if w.err == nil {
+		// errors here can't be handled very well
+		_ = w.pending.Sync()
+	}
+	_ = w.pending.Close()
+
+	if w.err != nil {
+		// corrupted file
+		_ = os.Remove(w.pendingPath)
+		return w.err
+	}
+
+	atomic.AddInt64(&cache.stats.WrittenBytes, w.size)
+	atomic.AddInt64(&cache.stats.LogicalWrittenBytes, w.logicalSize)
+
+	var oldSize int64
+	var oldCount int64
+
+	if stat, err := os.Stat(path); err == nil {
+		oldSize = stat.Size()
+		oldCount = 1
+	}
+
+	// rename will remove the old file
+	if err := os.Rename(w.pendingPath, path); err != nil {
+		_ = logkit.Error(ctx, "Failed to rename pending cache file", logkit.String("path", w.pendingPath), logkit.Err(err))
+		cache.Remove(ctx, w.keyHash)
+		w.err = err
+		return err
+	}
+
+	// _ = logkit.Debug(ctx, "Created a cache item", logkit.String("path", path), logkit.Int64("size", w.size))
+
+	atomic.AddInt64(&cache.stats.EstimatedCount, 1-oldCount)
+
+	if atomic.AddInt64(&cache.stats.EstimatedSize, w.size-oldSize) >= cache.maxSize {
+		cache.triggerEviction(dc2EvictTriggerSlow)
+	}
+
+	return nil
+}
+
+// dc2RawWriter is where the compressor of a dc2Writer writes.
+type dc2RawWriter struct {
+	w *dc2Writer
+}
+
+func (w dc2RawWriter) Write(p []byte) (int, error) {
+	return w.w.writeRaw(p)
+}
+
 func (store dc2Store) get(ctx context.Context, key []byte) []byte {
 	keyHash := store.cache.itemKeyHash(store.prefix, key)
 	return store.cache.Get(ctx, keyHash)
 }
 
+// getTTL returns the value for key with its remaining time to live.
+func (store dc2Store) getTTL(ctx context.Context, key []byte) ([]byte, []string, time.Duration) {
+	keyHash := store.cache.itemKeyHash(store.prefix, key)
+	value, ttl := store.cache.getTTL(ctx, keyHash)
+	return value, nil, ttl
+}
+
 func (store dc2Store) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
 	keyHash := store.cache.itemKeyHash(store.prefix, key)
 	store.cache.Set(ctx, keyHash, value, ttl)
@@ -427,6 +889,58 @@ func (store dc2Store) remove(ctx context.Context, key []byte) {
 	store.cache.Remove(ctx, keyHash)
 }
 
+// getMulti reads the files of all keys concurrently.
+func (store dc2Store) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	values := make([][]byte, len(keys))
+	store.concurrently(len(keys), func(i int) {
+		values[i] = store.get(ctx, keys[i])
+	})
+	return values
+}
+
+// setMulti writes the files of all entries concurrently.
+func (store dc2Store) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	store.concurrently(len(entries), func(i int) {
+		store.set(ctx, entries[i].Key, entries[i].Value, ttl)
+	})
+}
+
+func (store dc2Store) concurrently(count int, fn func(i int)) {
+	workers := dc2MultiConcurrency
+	if count < workers {
+		workers = count
+	}
+
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w != workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(atomic.AddInt64(&next, 1)); i < count; i = int(atomic.AddInt64(&next, 1)) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (store dc2Store) openReader(ctx context.Context, key []byte) io.ReadSeekCloser {
+	keyHash := store.cache.itemKeyHash(store.prefix, key)
+	if reader := store.cache.OpenReader(ctx, keyHash); reader != nil {
+		return reader
+	}
+	return nil
+}
+
+func (store dc2Store) create(ctx context.Context, key []byte, ttl time.Duration) io.WriteCloser {
+	keyHash := store.cache.itemKeyHash(store.prefix, key)
+	if writer := store.cache.Create(ctx, keyHash, ttl); writer != nil {
+		return writer
+	}
+	return nil
+}
+
 func (state *dc2EvictionState) Push(value interface{}) {
 	state.items = append(state.items, value.(dc2CacheItem))
 }
@@ -1,8 +1,14 @@
 package cachekit
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -30,4 +36,178 @@ func TestDiskCache2(t *testing.T) {
 	if !cachetest(c.GetCache(ctx, "one"), c.GetCache(ctx, "two"), t) {
 		return
 	}
+
+	// concurrent loads
+	if !flighttest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// soft and hard ttls
+	if !staletest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// streaming values
+	if !streamtest(c.GetCache(ctx, "six"), t) {
+		return
+	}
+
+	// batch gets and sets
+	if !multitest(c.GetCache(ctx, "seven"), t) {
+		return
+	}
+
+	// prefix and tag invalidation
+	if !invalidatetest(c.GetCache(ctx, "three"), c.GetCache(ctx, "four"), t) {
+		return
+	}
+
+	// invalidations survive a restart
+	c.GetCache(ctx, "five").Set(ctx, []byte("hello"), []byte("world"), 0)
+	c.GetCache(ctx, "five").InvalidatePrefix(ctx)
+	c.GetCache(ctx, "eight").Set(ctx, []byte("hello"), []byte("world"), 0, "tag")
+	c.GetCache(ctx, "eight").InvalidateTag(ctx, "tag")
+	reopened, err := NewDiskCache2(ctx, path, 1024*100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reopened.Close()
+	if v := reopened.GetCache(ctx, "five").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value after restart, but got %v", v)
+		return
+	}
+	if v := reopened.GetCache(ctx, "eight").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a tagged value after restart, but got %v", v)
+		return
+	}
+}
+
+func TestDiskCache2TagGenerations(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+	c, err := NewDiskCache2(ctx, path, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+	cache := c.GetCache(ctx, "one")
+
+	// an entry invalidated by a tag whose generation is dropped later
+	cache.Set(ctx, []byte("invalidated"), []byte("old"), 0, "first")
+	cache.InvalidateTag(ctx, "first")
+
+	// tag generations are dropped, oldest first, instead of piling up
+	for i := 0; i != maxTagGenerations; i++ {
+		cache.InvalidateTag(ctx, fmt.Sprintf("tag%v", i))
+	}
+	if _, found := c.generations.snapshot()[tagGenerationName("first")]; found {
+		t.Errorf("expected the oldest tag generation to be dropped")
+	}
+	if files, _ := os.ReadDir(c.generationsPath()); len(files) > maxTagGenerations {
+		t.Errorf("expected at most %v generation files, but got %v", maxTagGenerations, len(files))
+	}
+
+	// dropping it doesn't bring back the invalidated entry, in this process or the next
+	if v := cache.Get(ctx, []byte("invalidated")); v != nil {
+		t.Errorf("did not expect a value, but got %v", v)
+	}
+	cache.Set(ctx, []byte("invalidated"), []byte("new"), 0, "first")
+	cache.Set(ctx, []byte("later"), []byte("later"), 0, fmt.Sprintf("tag%v", maxTagGenerations-1))
+	reopened, err := NewDiskCache2(ctx, path, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer reopened.Close()
+	if v := reopened.GetCache(ctx, "one").Get(ctx, []byte("invalidated")); !reflect.DeepEqual(v, []byte("new")) {
+		t.Errorf("Expected 'new', but got %v", v)
+	}
+	if v := reopened.GetCache(ctx, "one").Get(ctx, []byte("later")); !reflect.DeepEqual(v, []byte("later")) {
+		t.Errorf("Expected 'later', but got %v", v)
+	}
+	reopened.GetCache(ctx, "one").InvalidateTag(ctx, "first")
+	if v := reopened.GetCache(ctx, "one").Get(ctx, []byte("invalidated")); v != nil {
+		t.Errorf("did not expect a value after invalidating again, but got %v", v)
+	}
+}
+
+func TestDiskCache2Compression(t *testing.T) {
+	ctx := context.Background()
+
+	path, err := ioutil.TempDir("", "diskcache2")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.RemoveAll(path)
+
+	c, err := NewDiskCache2(ctx, path, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	// entries written before compression was enabled
+	c.GetCache(ctx, "plain").Set(ctx, []byte("hello"), []byte("world"), 0)
+
+	c.SetCompression(GzipCompression{Level: gzip.BestSpeed})
+
+	if !cachetest(c.GetCache(ctx, "one"), c.GetCache(ctx, "two"), t) {
+		return
+	}
+	if !streamtest(c.GetCache(ctx, "three"), t) {
+		return
+	}
+	if v := c.GetCache(ctx, "plain").Get(ctx, []byte("hello")); string(v) != "world" {
+		t.Errorf("expected an uncompressed entry to be readable, but got %v", v)
+		return
+	}
+
+	// compressible values take up less space
+	before := c.Stats()
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	c.GetCache(ctx, "four").Set(ctx, []byte("big"), value, 0)
+	after := c.Stats()
+	written := after.WrittenBytes - before.WrittenBytes
+	logical := after.LogicalWrittenBytes - before.LogicalWrittenBytes
+	if logical != int64(len(value)) || written >= logical/10 {
+		t.Errorf("expected %v bytes to be compressed, but wrote %v of %v bytes", len(value), written, logical)
+		return
+	}
+	if v := c.GetCache(ctx, "four").Get(ctx, []byte("big")); !bytes.Equal(v, value) {
+		t.Errorf("expected the compressed value back, but got %v bytes", len(v))
+		return
+	}
+	if stats := c.CacheStats(); stats.EstimatedLogicalSize <= stats.EstimatedSize {
+		t.Errorf("expected a logical size larger than %v, but got %v", stats.EstimatedSize, stats.EstimatedLogicalSize)
+		return
+	}
+
+	// streamed values are compressed too, and can be read from an offset
+	w := c.GetCache(ctx, "four").Create(ctx, []byte("streamed"), 0)
+	for i := 0; i < 10; i++ {
+		w.Write(value[i*1300 : (i+1)*1300])
+	}
+	if err := w.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+	r := c.GetCache(ctx, "four").OpenReader(ctx, []byte("streamed"))
+	if r == nil {
+		t.Errorf("expected a reader for a streamed value")
+		return
+	}
+	defer r.Close()
+	if size, _ := r.Seek(0, io.SeekEnd); size != int64(len(value)) {
+		t.Errorf("expected a size of %v, but got %v", len(value), size)
+		return
+	}
+	r.Seek(6500, io.SeekStart)
+	tail, _ := io.ReadAll(r)
+	if !bytes.Equal(tail, value[6500:]) {
+		t.Errorf("expected the value from offset 6500, but got %v bytes", len(tail))
+		return
+	}
 }
@@ -1,10 +1,13 @@
 package cachekit
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDiskCache(t *testing.T) {
@@ -31,4 +34,90 @@ func TestDiskCache(t *testing.T) {
 	if !cachetest(c.GetCache(ctx, "one"), c.GetCache(ctx, "two"), t) {
 		return
 	}
+
+	// concurrent loads
+	if !flighttest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// soft and hard ttls
+	if !staletest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// batch gets and sets
+	if !multitest(c.GetCache(ctx, "five"), t) {
+		return
+	}
+
+	// prefix and tag invalidation
+	if !invalidatetest(c.GetCache(ctx, "three"), c.GetCache(ctx, "four"), t) {
+		return
+	}
+}
+
+func TestDiskCacheCompression(t *testing.T) {
+	ctx := context.Background()
+
+	file, err := ioutil.TempFile("", "diskcache")
+	if err != nil {
+		t.Fail()
+	}
+	defer func() {
+		os.Remove(file.Name())
+	}()
+
+	c, err := NewDiskCache(ctx, file.Name(), 1024*1024)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+
+	// entries written before compression was enabled
+	c.GetCache(ctx, "plain").Set(ctx, []byte("hello"), []byte("world"), 0)
+
+	c.SetCompression(GzipCompression{Level: gzip.BestSpeed})
+
+	if !cachetest(c.GetCache(ctx, "one"), c.GetCache(ctx, "two"), t) {
+		return
+	}
+	if v := c.GetCache(ctx, "plain").Get(ctx, []byte("hello")); string(v) != "world" {
+		t.Errorf("expected an uncompressed entry to be readable, but got %v", v)
+		return
+	}
+
+	// compressible values take up less space
+	value := bytes.Repeat([]byte("compressible "), 1000)
+	c.GetCache(ctx, "three").Set(ctx, []byte("big"), value, time.Hour)
+	if v := c.GetCache(ctx, "three").Get(ctx, []byte("big")); !bytes.Equal(v, value) {
+		t.Errorf("expected the compressed value back, but got %v bytes", len(v))
+		return
+	}
+	c.TriggerEviction(ctx)
+	if stats := c.CacheStats(); stats.EstimatedSize >= int64(len(value)) || stats.EstimatedLogicalSize <= stats.EstimatedSize {
+		t.Errorf("expected compressed entries, but got a size of %v and a logical size of %v", stats.EstimatedSize, stats.EstimatedLogicalSize)
+		return
+	}
+
+	// and migrate with their ttl
+	path, err := ioutil.TempDir("", "diskcache2")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.RemoveAll(path)
+	to, err := NewDiskCache2(ctx, path, 1024*1024)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer to.Close()
+	if _, err := MigrateDiskCache(ctx, c, to); err != nil {
+		t.Error(err)
+		return
+	}
+	if v := to.GetCache(ctx, "three").Get(ctx, []byte("big")); !bytes.Equal(v, value) {
+		t.Errorf("expected the migrated value, but got %v bytes", len(v))
+		return
+	}
 }
@@ -0,0 +1,427 @@
+package cachekit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tagHeader marks entries written with tags. It is followed by the number of tags,
+// then each tag with the tag clock at write time, and then the value itself.
+var tagHeader = []byte{0, 255, 3, 11, 47, 2}
+
+// invalidatingStore is implemented by stores that support InvalidatePrefix and tags.
+type invalidatingStore interface {
+	cacheStore
+	getTagged(ctx context.Context, key []byte) ([]byte, []string)
+	setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string)
+	invalidatePrefix(ctx context.Context)
+	invalidateTag(ctx context.Context, tag string)
+}
+
+// maxTagGenerations is the number of tag generations kept before the oldest half is
+// dropped, see generations.
+const maxTagGenerations = 10000
+
+// floorGenerationName is the generation of tags without a generation of their own.
+const floorGenerationName = "floor"
+
+// generationPersister saves generation counters, so invalidations survive restarts
+// of stores that outlive the process.
+type generationPersister interface {
+	loadGenerations(ctx context.Context) map[string]uint64
+	saveGeneration(ctx context.Context, name string, generation uint64)
+	removeGenerations(ctx context.Context, names []string)
+}
+
+// generations keeps the prefix and tag generation counters of a store. Bumping a
+// prefix generation changes the keys of all entries in the prefix.
+//
+// Tag generations come from one clock: invalidating a tag sets its generation to the
+// next tick, and tagged entries are written with the current tick, so an entry is live
+// while it is at least as new as the generations of its tags. Only invalidated tags
+// have a generation; the others have the floor generation. When there are more than
+// maxTagGenerations, the oldest half is dropped and the floor raised to the newest of
+// them, which also drops the tagged entries written before it.
+type generations struct {
+	sync.RWMutex
+	values map[string]uint64
+	clock  uint64
+	tags   int
+
+	// writeLock orders increments, so persist is called without holding the RWMutex
+	writeLock sync.Mutex
+	persist   generationPersister
+}
+
+func newGenerations(ctx context.Context, persist generationPersister) *generations {
+	g := &generations{
+		values:  make(map[string]uint64),
+		persist: persist,
+	}
+	if persist != nil {
+		g.restore(persist.loadGenerations(ctx))
+	}
+	return g
+}
+
+func (g *generations) get(name string) uint64 {
+	g.RLock()
+	defer g.RUnlock()
+	return g.values[name]
+}
+
+// tag returns the generation of a tag.
+func (g *generations) tag(tag string) uint64 {
+	g.RLock()
+	defer g.RUnlock()
+	if generation, found := g.values[tagGenerationName(tag)]; found {
+		return generation
+	}
+	return g.values[floorGenerationName]
+}
+
+// now returns the tick tagged entries are written with.
+func (g *generations) now() uint64 {
+	g.RLock()
+	defer g.RUnlock()
+	return g.clock
+}
+
+func (g *generations) incrementPrefix(ctx context.Context, prefix string) {
+	g.writeLock.Lock()
+	defer g.writeLock.Unlock()
+
+	name := prefixGenerationName(prefix)
+	g.Lock()
+	generation := g.values[name] + 1
+	g.set(name, generation)
+	g.Unlock()
+
+	if g.persist != nil {
+		g.persist.saveGeneration(ctx, name, generation)
+	}
+}
+
+func (g *generations) incrementTag(ctx context.Context, tag string) {
+	g.writeLock.Lock()
+	defer g.writeLock.Unlock()
+
+	name := tagGenerationName(tag)
+	g.Lock()
+	generation := g.clock + 1
+	g.set(name, generation)
+	var dropped []string
+	if g.tags > maxTagGenerations {
+		dropped = g.dropOldestTags()
+	}
+	floor := g.values[floorGenerationName]
+	g.Unlock()
+
+	if g.persist != nil {
+		g.persist.saveGeneration(ctx, name, generation)
+		if len(dropped) > 0 {
+			g.persist.saveGeneration(ctx, floorGenerationName, floor)
+			g.persist.removeGenerations(ctx, dropped)
+		}
+	}
+}
+
+// set must be called with the lock held.
+func (g *generations) set(name string, generation uint64) {
+	if _, found := g.values[name]; !found && isTagGenerationName(name) {
+		g.tags++
+	}
+	g.values[name] = generation
+	if generation > g.clock {
+		g.clock = generation
+	}
+}
+
+// dropOldestTags drops the oldest half of the tag generations, raising the floor to the
+// newest of them. It must be called with the lock held.
+func (g *generations) dropOldestTags() []string {
+	generations := make([]uint64, 0, g.tags)
+	for name, generation := range g.values {
+		if isTagGenerationName(name) {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	floor := generations[len(generations)/2]
+
+	dropped := make([]string, 0, len(generations)/2)
+	for name, generation := range g.values {
+		if isTagGenerationName(name) && generation <= floor {
+			dropped = append(dropped, name)
+			delete(g.values, name)
+			g.tags--
+		}
+	}
+	if floor > g.values[floorGenerationName] {
+		g.set(floorGenerationName, floor)
+	}
+	return dropped
+}
+
+// snapshot returns a copy of the generations.
+func (g *generations) snapshot() map[string]uint64 {
+	g.RLock()
+	defer g.RUnlock()
+	values := make(map[string]uint64, len(g.values))
+	for name, generation := range g.values {
+		values[name] = generation
+	}
+	return values
+}
+
+// restore merges generations from a snapshot, keeping the highest generation of each name.
+func (g *generations) restore(values map[string]uint64) {
+	g.Lock()
+	defer g.Unlock()
+	for name, generation := range values {
+		if generation > g.values[name] {
+			g.set(name, generation)
+		}
+	}
+}
+
+// tagLive tells if an entry written at the written tick is as new as a tag generation.
+func tagLive(written uint64, generation uint64) bool {
+	return written >= generation
+}
+
+func prefixGenerationName(prefix string) string {
+	return "prefix:" + prefix
+}
+
+func tagGenerationName(tag string) string {
+	return "tag:" + tag
+}
+
+func isTagGenerationName(name string) bool {
+	return strings.HasPrefix(name, "tag:")
+}
+
+// generationStore wraps a store, folding the prefix generation into keys and checking
+// tag generations on reads.
+type generationStore struct {
+	store       cacheStore
+	generations *generations
+	prefix      string
+}
+
+func newGenerationStore(store cacheStore, generations *generations, prefix string) generationStore {
+	return generationStore{store: store, generations: generations, prefix: prefix}
+}
+
+func (s generationStore) key(ctx context.Context, key []byte) []byte {
+	return foldGeneration(s.generations.get(prefixGenerationName(s.prefix)), key)
+}
+
+func foldGeneration(generation uint64, key []byte) []byte {
+	if generation == 0 {
+		return key
+	}
+
+	buf := make([]byte, 2+binary.MaxVarintLen64, 2+binary.MaxVarintLen64+len(key))
+	buf[0], buf[1] = 255, 'g'
+	buf = buf[:2+binary.PutUvarint(buf[2:], generation)]
+	return append(buf, key...)
+}
+
+func (s generationStore) get(ctx context.Context, key []byte) []byte {
+	value, _ := s.getTagged(ctx, key)
+	return value
+}
+
+func (s generationStore) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
+	s.setTagged(ctx, key, value, ttl, nil)
+}
+
+func (s generationStore) remove(ctx context.Context, key []byte) {
+	s.store.remove(ctx, s.key(ctx, key))
+}
+
+func (s generationStore) getTagged(ctx context.Context, key []byte) ([]byte, []string) {
+	key = s.key(ctx, key)
+	return s.checkTags(ctx, key, s.store.get(ctx, key))
+}
+
+// getTTL returns the value, tags and remaining time to live from stores that support it.
+func (s generationStore) getTTL(ctx context.Context, key []byte) ([]byte, []string, time.Duration) {
+	store, ok := s.store.(ttlStore)
+	if !ok {
+		value, tags := s.getTagged(ctx, key)
+		return value, tags, 0
+	}
+
+	key = s.key(ctx, key)
+	entry, _, ttl := store.getTTL(ctx, key)
+	value, tags := s.checkTags(ctx, key, entry)
+	return value, tags, ttl
+}
+
+// checkTags decodes a stored entry, removing it if any of its tags have been invalidated.
+func (s generationStore) checkTags(ctx context.Context, key []byte, entry []byte) ([]byte, []string) {
+	value, tags, tagGenerations, ok := decodeTaggedEntry(entry)
+	if !ok {
+		return nil, nil
+	}
+	for i, tag := range tags {
+		if !tagLive(tagGenerations[i], s.generations.tag(tag)) {
+			s.store.remove(ctx, key)
+			return nil, nil
+		}
+	}
+	return value, tags
+}
+
+func (s generationStore) setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string) {
+	key = s.key(ctx, key)
+	if len(tags) == 0 || value == nil {
+		s.store.set(ctx, key, value, ttl)
+		return
+	}
+
+	// every tag gets the same tick, so entries can still be decoded tag by tag
+	now := s.generations.now()
+	tagGenerations := make([]uint64, len(tags))
+	for i := range tags {
+		tagGenerations[i] = now
+	}
+	s.store.set(ctx, key, encodeTaggedEntry(value, tags, tagGenerations), ttl)
+}
+
+// openReader streams values from stores that support it. Tagged entries are small
+// enough to be read through getTagged, so their tags can be checked.
+func (s generationStore) openReader(ctx context.Context, key []byte) io.ReadSeekCloser {
+	store, ok := s.store.(streamingStore)
+	if !ok {
+		return bufferedOpenReader(ctx, s, key)
+	}
+
+	reader := store.openReader(ctx, s.key(ctx, key))
+	if reader == nil {
+		return nil
+	}
+
+	// one byte more than the headers, to tell nilValue apart from longer values
+	header := make([]byte, len(tagHeader)+1)
+	n, _ := io.ReadFull(reader, header)
+	if isNil(header[:n]) {
+		reader.Close()
+		return nil
+	}
+	if n >= len(tagHeader) && bytes.Equal(header[:len(tagHeader)], tagHeader) {
+		reader.Close()
+		value, _ := s.getTagged(ctx, key)
+		if value == nil {
+			return nil
+		}
+		return nopSeekCloser{bytes.NewReader(value)}
+	}
+
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		reader.Close()
+		return nil
+	}
+	return reader
+}
+
+func (s generationStore) create(ctx context.Context, key []byte, ttl time.Duration) io.WriteCloser {
+	if store, ok := s.store.(streamingStore); ok {
+		return store.create(ctx, s.key(ctx, key), ttl)
+	}
+	return bufferedCreate(ctx, s, key, ttl)
+}
+
+func (s generationStore) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	keys = s.keys(ctx, keys)
+	values := getMultiFrom(ctx, s.store, keys)
+
+	for i, entry := range values {
+		values[i], _ = s.checkTags(ctx, keys[i], entry)
+	}
+	return values
+}
+
+func (s generationStore) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	keys := make([][]byte, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	keys = s.keys(ctx, keys)
+
+	folded := make([]Entry, len(entries))
+	for i, entry := range entries {
+		folded[i] = Entry{Key: keys[i], Value: entry.Value}
+	}
+	setMultiTo(ctx, s.store, folded, ttl)
+}
+
+// keys folds the prefix generation into all keys, looking it up once.
+func (s generationStore) keys(ctx context.Context, keys [][]byte) [][]byte {
+	folded := make([][]byte, len(keys))
+	generation := s.generations.get(prefixGenerationName(s.prefix))
+	for i, key := range keys {
+		folded[i] = foldGeneration(generation, key)
+	}
+	return folded
+}
+
+func (s generationStore) invalidatePrefix(ctx context.Context) {
+	s.generations.incrementPrefix(ctx, s.prefix)
+}
+
+func (s generationStore) invalidateTag(ctx context.Context, tag string) {
+	s.generations.incrementTag(ctx, tag)
+}
+
+func encodeTaggedEntry(value []byte, tags []string, tagGenerations []uint64) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, len(tagHeader)+len(value)+16*len(tags)))
+	varint := make([]byte, binary.MaxVarintLen64)
+	buf.Write(tagHeader)
+	buf.Write(varint[:binary.PutUvarint(varint, uint64(len(tags)))])
+	for i, tag := range tags {
+		buf.Write(varint[:binary.PutUvarint(varint, uint64(len(tag)))])
+		buf.WriteString(tag)
+		buf.Write(varint[:binary.PutUvarint(varint, tagGenerations[i])])
+	}
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// decodeTaggedEntry splits a stored entry into value and tags. Entries without tags
+// are returned as is, and ok is false if the tag header is corrupt.
+func decodeTaggedEntry(entry []byte) (value []byte, tags []string, tagGenerations []uint64, ok bool) {
+	if entry == nil || len(entry) < len(tagHeader) || !bytes.Equal(entry[:len(tagHeader)], tagHeader) {
+		return entry, nil, nil, true
+	}
+
+	buf := bytes.NewBuffer(entry[len(tagHeader):])
+	count, err := binary.ReadUvarint(buf)
+	if err != nil || count > uint64(buf.Len()) {
+		return nil, nil, nil, false
+	}
+	tags = make([]string, 0, count)
+	tagGenerations = make([]uint64, 0, count)
+	for i := uint64(0); i != count; i++ {
+		length, err := binary.ReadUvarint(buf)
+		if err != nil || length > uint64(buf.Len()) {
+			return nil, nil, nil, false
+		}
+		tags = append(tags, string(buf.Next(int(length))))
+		generation, err := binary.ReadUvarint(buf)
+		if err != nil {
+			return nil, nil, nil, false
+		}
+		tagGenerations = append(tagGenerations, generation)
+	}
+	return buf.Bytes(), tags, tagGenerations, true
+}
@@ -0,0 +1,363 @@
+package cachekit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+	"github.com/oliverkofoed/gokit/rpckit"
+)
+
+const (
+	busMessageRemove           = 1
+	busMessageInvalidatePrefix = 2
+	busMessageInvalidateTag    = 3
+	busMessageAck              = 4
+
+	busMinReconnectDelay = 100 * time.Millisecond
+	busMaxReconnectDelay = 10 * time.Second
+
+	// sends to a peer that doesn't read fail after this, and the peer is reconnected
+	busWriteTimeout = 5 * time.Second
+
+	// invalidations waiting for an ack from a peer; the oldest are dropped beyond this
+	busMaxPending = 10000
+)
+
+// InvalidationBus publishes Remove, InvalidatePrefix and InvalidateTag calls to a set
+// of peer nodes over rpckit, so process-local caches on other nodes drop their copies
+// too. Invalidations are resent after reconnects until the peer acks them, so peers
+// may see the same invalidation more than once.
+type InvalidationBus struct {
+	sync.Mutex
+	ctx      context.Context
+	getCache func(ctx context.Context, prefix string) *Cache
+	listener net.Listener
+	peers    map[string]*busPeer
+	inbound  map[*rpckit.Connection]bool
+}
+
+// busPeer keeps the invalidations a peer hasn't acked. They are sent by connectLoop,
+// never while holding the lock, so a stalled peer doesn't block publishing or acks.
+type busPeer struct {
+	sync.Mutex
+	bus     *InvalidationBus
+	address string
+	pending []busMessage
+	nextID  uint64
+	wake    chan struct{}
+	stop    chan struct{}
+}
+
+type busMessage struct {
+	id     uint64
+	kind   uint64
+	prefix string
+	key    []byte
+}
+
+// NewInvalidationBus listens for invalidations from peers on listenAddress and publishes
+// local invalidations to peers. getCache returns the local caches the bus wraps, e.g.
+// DiskCache.GetCache or MemoryTier(memoryCache, 0).GetCache.
+func NewInvalidationBus(ctx context.Context, getCache func(ctx context.Context, prefix string) *Cache, listenAddress string, peers []string) (*InvalidationBus, error) {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &InvalidationBus{
+		ctx:      ctx,
+		getCache: getCache,
+		listener: listener,
+		peers:    make(map[string]*busPeer),
+		inbound:  make(map[*rpckit.Connection]bool),
+	}
+
+	server := rpckit.NewServer(b.onConnection, b.onMessage, b.onDisconnect)
+	go server.Serve(listener)
+
+	b.SetPeers(peers)
+	return b, nil
+}
+
+// Addr returns the address the bus listens on.
+func (b *InvalidationBus) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// SetPeers changes the set of peers invalidations are published to.
+func (b *InvalidationBus) SetPeers(peers []string) {
+	b.Lock()
+	defer b.Unlock()
+
+	keep := make(map[string]bool)
+	for _, address := range peers {
+		keep[address] = true
+		if _, found := b.peers[address]; !found {
+			peer := &busPeer{bus: b, address: address, wake: make(chan struct{}, 1), stop: make(chan struct{})}
+			b.peers[address] = peer
+			go peer.connectLoop()
+		}
+	}
+
+	for address, peer := range b.peers {
+		if !keep[address] {
+			close(peer.stop)
+			delete(b.peers, address)
+		}
+	}
+}
+
+// Close stops listening and disconnects from all peers.
+func (b *InvalidationBus) Close() error {
+	b.SetPeers(nil)
+	err := b.listener.Close()
+
+	b.Lock()
+	inbound := make([]*rpckit.Connection, 0, len(b.inbound))
+	for c := range b.inbound {
+		inbound = append(inbound, c)
+	}
+	b.Unlock()
+	for _, c := range inbound {
+		c.Close()
+	}
+
+	return err
+}
+
+// GetCache returns the local cache for prefix, wrapped so its invalidations are published to all peers.
+func (b *InvalidationBus) GetCache(ctx context.Context, prefix string) *Cache {
+	local := b.getCache(ctx, prefix)
+	return &Cache{
+		cacheStore: busStore{local: local, bus: b, prefix: prefix},
+		flights:    local.flights,
+		prefix:     local.prefix,
+	}
+}
+
+func (b *InvalidationBus) publish(kind uint64, prefix string, key []byte) {
+	b.Lock()
+	peers := make([]*busPeer, 0, len(b.peers))
+	for _, peer := range b.peers {
+		peers = append(peers, peer)
+	}
+	b.Unlock()
+
+	for _, peer := range peers {
+		peer.publish(busMessage{kind: kind, prefix: prefix, key: key})
+	}
+}
+
+func (b *InvalidationBus) onConnection(c *rpckit.Connection) {
+	b.Lock()
+	defer b.Unlock()
+	b.inbound[c] = true
+}
+
+func (b *InvalidationBus) onDisconnect(c *rpckit.Connection, err error) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.inbound, c)
+}
+
+// onMessage applies invalidations received from peers to the local caches.
+func (b *InvalidationBus) onMessage(c *rpckit.Connection, msg *rpckit.Message) {
+	message, err := readBusMessage(msg)
+	if err != nil || message.kind == busMessageAck {
+		logkit.Warn(b.ctx, "Invalid message on invalidation bus", logkit.Stringer("connection", c), logkit.Err(err))
+		c.Close()
+		return
+	}
+
+	ctx, done := logkit.Operation(b.ctx, "invalidationbus.receive", logkit.Int64("kind", int64(message.kind)), logkit.String("prefix", message.prefix), logkit.Bytes("key", message.key))
+	defer done()
+
+	local := b.getCache(ctx, message.prefix)
+	switch message.kind {
+	case busMessageRemove:
+		local.Remove(ctx, message.key)
+	case busMessageInvalidatePrefix:
+		local.InvalidatePrefix(ctx)
+	case busMessageInvalidateTag:
+		local.InvalidateTag(ctx, string(message.key))
+	}
+
+	ack := newBusMessage(busMessage{id: message.id, kind: busMessageAck})
+	c.SetWriteDeadline(time.Now().Add(busWriteTimeout))
+	if err := c.Send(ack); err != nil {
+		logkit.Warn(ctx, "Error acking invalidation", logkit.Err(err))
+		c.Close()
+	}
+}
+
+func (p *busPeer) connectLoop() {
+	delay := busMinReconnectDelay
+	for {
+		disconnected := make(chan struct{})
+		conn, err := rpckit.NewConnection("tcp", p.address, p.onMessage, func(c *rpckit.Connection, err error) {
+			close(disconnected)
+		})
+
+		if err != nil {
+			logkit.Warn(p.bus.ctx, "Error connecting to invalidation bus peer", logkit.String("address", p.address), logkit.Err(err))
+		} else {
+			delay = busMinReconnectDelay
+			if !p.writeLoop(conn, disconnected) {
+				conn.Close()
+				return
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-p.stop:
+			return
+		}
+		if delay *= 2; delay > busMaxReconnectDelay {
+			delay = busMaxReconnectDelay
+		}
+	}
+}
+
+// writeLoop sends pending invalidations on conn until it is disconnected, starting with
+// everything that hasn't been acked yet. It returns false if the peer was removed.
+func (p *busPeer) writeLoop(conn *rpckit.Connection, disconnected chan struct{}) bool {
+	sent := uint64(0)
+	for {
+		p.Lock()
+		i := len(p.pending)
+		for i > 0 && p.pending[i-1].id > sent {
+			i--
+		}
+		unsent := append([]busMessage(nil), p.pending[i:]...)
+		p.Unlock()
+
+		for _, message := range unsent {
+			conn.SetWriteDeadline(time.Now().Add(busWriteTimeout))
+			if err := conn.Send(newBusMessage(message)); err != nil {
+				// reconnect and resend everything that isn't acked
+				logkit.Warn(p.bus.ctx, "Error sending to invalidation bus peer", logkit.String("address", p.address), logkit.Err(err))
+				conn.Close()
+				break
+			}
+			sent = message.id
+		}
+
+		select {
+		case <-p.wake:
+		case <-disconnected:
+			return true
+		case <-p.stop:
+			return false
+		}
+	}
+}
+
+func (p *busPeer) publish(message busMessage) {
+	p.Lock()
+	p.nextID++
+	message.id = p.nextID
+	if len(p.pending) >= busMaxPending {
+		logkit.Warn(p.bus.ctx, "Too many unacked invalidations, dropping the oldest", logkit.String("address", p.address))
+		p.pending = p.pending[1:]
+	}
+	p.pending = append(p.pending, message)
+	p.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// onMessage handles acks from the peer. Acks arrive in order, so everything up to the
+// acked message has been applied.
+func (p *busPeer) onMessage(c *rpckit.Connection, msg *rpckit.Message) {
+	message, err := readBusMessage(msg)
+	if err != nil || message.kind != busMessageAck {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	i := 0
+	for i < len(p.pending) && p.pending[i].id <= message.id {
+		i++
+	}
+	p.pending = p.pending[i:]
+}
+
+func newBusMessage(message busMessage) *rpckit.Message {
+	msg := rpckit.NewMessage(32 + len(message.prefix) + len(message.key))
+	msg.WriteInt(message.kind)
+	msg.WriteInt(message.id)
+	msg.WriteString(message.prefix)
+	msg.WriteBytes(message.key)
+	return msg
+}
+
+func readBusMessage(msg *rpckit.Message) (message busMessage, err error) {
+	if message.kind, err = msg.ReadInt(); err != nil {
+		return message, err
+	}
+	if message.id, err = msg.ReadInt(); err != nil {
+		return message, err
+	}
+	if message.prefix, err = msg.ReadString(); err != nil {
+		return message, err
+	}
+	message.key, err = msg.ReadBytes()
+	return message, err
+}
+
+// busStore publishes invalidations of the local cache to the bus.
+type busStore struct {
+	local  *Cache
+	bus    *InvalidationBus
+	prefix string
+}
+
+func (s busStore) get(ctx context.Context, key []byte) []byte {
+	return s.local.get(ctx, key)
+}
+
+func (s busStore) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
+	s.local.set(ctx, key, value, ttl)
+}
+
+func (s busStore) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	return getMultiFrom(ctx, s.local.cacheStore, keys)
+}
+
+func (s busStore) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	setMultiTo(ctx, s.local.cacheStore, entries, ttl)
+}
+
+func (s busStore) remove(ctx context.Context, key []byte) {
+	s.local.remove(ctx, key)
+	s.bus.publish(busMessageRemove, s.prefix, key)
+}
+
+func (s busStore) getTagged(ctx context.Context, key []byte) ([]byte, []string) {
+	if store, ok := s.local.cacheStore.(invalidatingStore); ok {
+		return store.getTagged(ctx, key)
+	}
+	return s.local.get(ctx, key), nil
+}
+
+func (s busStore) setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string) {
+	s.local.Set(ctx, key, value, ttl, tags...)
+}
+
+func (s busStore) invalidatePrefix(ctx context.Context) {
+	s.local.InvalidatePrefix(ctx)
+	s.bus.publish(busMessageInvalidatePrefix, s.prefix, nil)
+}
+
+func (s busStore) invalidateTag(ctx context.Context, tag string) {
+	s.local.InvalidateTag(ctx, tag)
+	s.bus.publish(busMessageInvalidateTag, s.prefix, []byte(tag))
+}
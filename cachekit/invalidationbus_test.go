@@ -0,0 +1,132 @@
+package cachekit
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInvalidationBus(t *testing.T) {
+	ctx := context.Background()
+
+	// two nodes, each with its own memory cache
+	memoryA := NewMemoryCache(1024 * 100)
+	memoryB := NewMemoryCache(1024 * 100)
+	busA, err := NewInvalidationBus(ctx, MemoryTier(memoryA, 0).GetCache, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer busA.Close()
+	busB, err := NewInvalidationBus(ctx, MemoryTier(memoryB, 0).GetCache, "127.0.0.1:0", []string{busA.Addr()})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	busA.SetPeers([]string{busB.Addr()})
+
+	// regular cache testing
+	if !cachetest(busA.GetCache(ctx, "one"), busA.GetCache(ctx, "two"), t) {
+		return
+	}
+
+	// removes are published
+	world := []byte("world")
+	memoryA.GetCache("three").Set(ctx, []byte("hello"), world, 0)
+	memoryB.GetCache("three").Set(ctx, []byte("hello"), world, 0)
+	busA.GetCache(ctx, "three").Remove(ctx, []byte("hello"))
+	if v := memoryA.GetCache("three").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value")
+		return
+	}
+	if !eventually(func() bool { return memoryB.GetCache("three").Get(ctx, []byte("hello")) == nil }) {
+		t.Errorf("Expected the remove to reach the peer")
+		return
+	}
+
+	// prefix and tag invalidations are published
+	memoryA.GetCache("four").Set(ctx, []byte("a"), world, 0)
+	memoryB.GetCache("four").Set(ctx, []byte("a"), world, 0)
+	memoryB.GetCache("five").Set(ctx, []byte("b"), world, 0, "user:1")
+	busB.GetCache(ctx, "four").InvalidatePrefix(ctx)
+	busB.GetCache(ctx, "five").InvalidateTag(ctx, "user:1")
+	if !eventually(func() bool { return memoryA.GetCache("four").Get(ctx, []byte("a")) == nil }) {
+		t.Errorf("Expected the prefix invalidation to reach the peer")
+		return
+	}
+	if memoryB.GetCache("five").Get(ctx, []byte("b")) != nil {
+		t.Errorf("did not expect a value")
+		return
+	}
+
+	// invalidations published while a peer is down are delivered after it's back
+	addressB := busB.Addr()
+	busB.Close()
+	memoryA.GetCache("six").Set(ctx, []byte("hello"), world, 0)
+	busA.GetCache(ctx, "six").Remove(ctx, []byte("hello"))
+
+	memoryB = NewMemoryCache(1024 * 100)
+	memoryB.GetCache("six").Set(ctx, []byte("hello"), world, 0)
+	if v := memoryB.GetCache("six").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return
+	}
+	busB, err = NewInvalidationBus(ctx, MemoryTier(memoryB, 0).GetCache, addressB, nil)
+	if err != nil {
+		if _, ok := err.(*net.OpError); ok {
+			t.Skip("could not listen on the old address again:", err)
+		}
+		t.Error(err)
+		return
+	}
+	defer busB.Close()
+	if !eventually(func() bool { return memoryB.GetCache("six").Get(ctx, []byte("hello")) == nil }) {
+		t.Errorf("Expected the remove to reach the peer after reconnecting")
+		return
+	}
+}
+
+func TestInvalidationBusStalledPeer(t *testing.T) {
+	ctx := context.Background()
+
+	// a peer that accepts connections but never reads
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer stalled.Close()
+	accepted := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			accepted <- struct{}{}
+		}
+	}()
+
+	bus, err := NewInvalidationBus(ctx, MemoryTier(NewMemoryCache(1024*100), 0).GetCache, "127.0.0.1:0", []string{stalled.Addr().String()})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer bus.Close()
+	<-accepted
+	time.Sleep(10 * time.Millisecond)
+
+	// invalidations are queued, not written by the caller, so filling the peer's socket
+	// buffers doesn't block them
+	key := make([]byte, 64*1024)
+	start := time.Now()
+	for i := 0; i != 200; i++ {
+		bus.GetCache(ctx, "one").Remove(ctx, key)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected invalidations not to wait for a stalled peer, but they took %v", elapsed)
+	}
+}
@@ -14,18 +14,29 @@ import (
 
 const memoryKeyArrLength = 1024
 
+// keys start with the id of their prefix, a little endian uint32
+const memoryPrefixLength = 4
+
 type MemoryCache struct {
 	sync.RWMutex
 	cache         *freecache.Cache
 	prefixes      map[string][]byte
 	prefixCounter uint32
 	bytePool      *sync.Pool
+	flights       *flightGroup
+	generations   *generations
+	stats         *cacheStats
+	byteSize      int
 }
 
 func NewMemoryCache(byteSize int) *MemoryCache {
 	return &MemoryCache{
-		cache:    freecache.NewCache(byteSize),
-		prefixes: make(map[string][]byte),
+		cache:       freecache.NewCache(byteSize),
+		prefixes:    make(map[string][]byte),
+		flights:     newFlightGroup(),
+		generations: newGenerations(context.Background(), nil),
+		stats:       newCacheStats(),
+		byteSize:    byteSize,
 		bytePool: &sync.Pool{
 			New: func() interface{} {
 				return [memoryKeyArrLength]byte{}
@@ -44,9 +55,29 @@ func (d *MemoryCache) GetCache(prefix string) *Cache {
 		buf := new(bytes.Buffer)
 		binary.Write(buf, binary.LittleEndian, &d.prefixCounter)
 		prefixBytes = buf.Bytes()
+		d.prefixes[prefix] = prefixBytes
 	}
 
-	return &Cache{cacheStore: memoryCacheStore{prefix: prefixBytes, c: d.cache, bytePool: d.bytePool}}
+	return &Cache{
+		cacheStore: newStatsStore(newGenerationStore(memoryCacheStore{prefix: prefixBytes, c: d.cache, bytePool: d.bytePool}, d.generations, prefix), d.stats, prefix),
+		flights:    d.flights,
+		prefix:     prefixBytes,
+	}
+}
+
+// CacheStats returns the stats of the cache. freecache keeps entries in a ring buffer
+// that stays full once it has been filled, so the size is the bytes written up to byteSize.
+func (d *MemoryCache) CacheStats() CacheStats {
+	size := d.stats.writtenBytes()
+	if size > int64(d.byteSize) {
+		size = int64(d.byteSize)
+	}
+	return d.stats.cacheStats(size, d.cache.EntryCount(), d.cache.EvacuateCount()+d.cache.ExpiredCount())
+}
+
+// FlushPrefix drops every entry in prefix.
+func (d *MemoryCache) FlushPrefix(ctx context.Context, prefix string) {
+	d.GetCache(prefix).InvalidatePrefix(ctx)
 }
 
 type memoryCacheStore struct {
@@ -68,17 +99,36 @@ func (m memoryCacheStore) get(ctx context.Context, key []byte) []byte {
 	return v
 }
 
+// getTTL returns the value for key with its remaining time to live.
+func (m memoryCacheStore) getTTL(ctx context.Context, key []byte) ([]byte, []string, time.Duration) {
+	ctx, done := logkit.Operation(ctx, "memorycache.getttl", logkit.Bytes("key", key))
+	defer done()
+
+	k := m.bytePool.Get()
+	defer m.bytePool.Put(k)
+	v, expireAt, e := m.c.GetWithExpiration(getMemoryKey(k.([memoryKeyArrLength]byte), m.prefix, key))
+	if e != nil {
+		return nil, nil, 0
+	}
+	if expireAt == 0 {
+		return v, nil, 0
+	}
+	ttl := time.Until(time.Unix(int64(expireAt), 0))
+	if ttl <= 0 {
+		return nil, nil, 0
+	}
+	return v, nil, ttl
+}
+
 func (m memoryCacheStore) set(ctx context.Context, key, value []byte, ttl time.Duration) {
 	ctx, done := logkit.Operation(ctx, "memorycache.set", logkit.Bytes("key", key), logkit.Bytes("value", value), logkit.Duration("ttl", ttl))
 	defer done()
 
-	expireSeconds := 0
-	if ttl > 0 {
-		expireSeconds = int(ttl / time.Second)
-	} else if ttl < 0 {
+	if ttl < 0 {
 		m.remove(ctx, key)
 		return
 	}
+	expireSeconds := memoryExpireSeconds(ttl)
 
 	k := m.bytePool.Get()
 	defer m.bytePool.Put(k)
@@ -94,6 +144,44 @@ func (m memoryCacheStore) remove(ctx context.Context, key []byte) {
 	m.c.Del(getMemoryKey(k.([memoryKeyArrLength]byte), m.prefix, key))
 }
 
+// getMulti reads all keys in a single operation with one key buffer.
+func (m memoryCacheStore) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	ctx, done := logkit.Operation(ctx, "memorycache.getmulti", logkit.Int("keys", len(keys)))
+	defer done()
+
+	k := m.bytePool.Get()
+	defer m.bytePool.Put(k)
+	arr := k.([memoryKeyArrLength]byte)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if v, e := m.c.Get(getMemoryKey(arr, m.prefix, key)); e == nil {
+			values[i] = v
+		}
+	}
+	return values
+}
+
+func (m memoryCacheStore) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	ctx, done := logkit.Operation(ctx, "memorycache.setmulti", logkit.Int("entries", len(entries)), logkit.Duration("ttl", ttl))
+	defer done()
+
+	expireSeconds := memoryExpireSeconds(ttl)
+
+	k := m.bytePool.Get()
+	defer m.bytePool.Put(k)
+	arr := k.([memoryKeyArrLength]byte)
+
+	for _, entry := range entries {
+		key := getMemoryKey(arr, m.prefix, entry.Key)
+		if ttl < 0 {
+			m.c.Del(key)
+		} else {
+			m.c.Set(key, entry.Value, expireSeconds)
+		}
+	}
+}
+
 func getMemoryKey(arr [memoryKeyArrLength]byte, prefix, key []byte) []byte {
 	lp := len(prefix)
 	lk := len(key)
@@ -109,3 +197,12 @@ func getMemoryKey(arr [memoryKeyArrLength]byte, prefix, key []byte) []byte {
 	copy(arr[lp:], key)
 	return arr[:lp+lk]
 }
+
+// memoryExpireSeconds converts a ttl to the whole seconds freecache takes, rounding up so
+// a ttl under a second doesn't turn into 0, which never expires.
+func memoryExpireSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		return 0
+	}
+	return int((ttl + time.Second - 1) / time.Second)
+}
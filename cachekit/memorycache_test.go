@@ -1,6 +1,15 @@
 package cachekit
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestMemoryCache(t *testing.T) {
 	// create a cache with room for 100kb of data
@@ -10,4 +19,110 @@ func TestMemoryCache(t *testing.T) {
 	if !cachetest(c.GetCache("a"), c.GetCache("b"), t) {
 		return
 	}
+
+	// concurrent loads
+	if !flighttest(c.GetCache("a"), t) {
+		return
+	}
+
+	// soft and hard ttls
+	if !staletest(c.GetCache("a"), t) {
+		return
+	}
+
+	// streaming values
+	if !streamtest(c.GetCache("e"), t) {
+		return
+	}
+
+	// batch gets and sets
+	if !multitest(c.GetCache("e"), t) {
+		return
+	}
+
+	// prefix and tag invalidation
+	if !invalidatetest(c.GetCache("c"), c.GetCache("d"), t) {
+		return
+	}
+}
+
+func TestMemoryCacheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	world := []byte("world")
+
+	c := NewMemoryCache(1024 * 100)
+	c.GetCache("a").Set(ctx, []byte("forever"), world, 0)
+	c.GetCache("a").Set(ctx, []byte("short"), world, time.Second)
+	c.GetCache("a").Set(ctx, []byte("long"), world, time.Hour)
+	c.GetCache("b").Set(ctx, []byte("tagged"), world, 0, "tag")
+	c.GetCache("b").InvalidateTag(ctx, "tag")
+	c.GetCache("c").Set(ctx, []byte("flushed"), world, 0)
+	c.GetCache("c").InvalidatePrefix(ctx)
+
+	path, err := ioutil.TempDir("", "memorysnapshot")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(path)
+	file := filepath.Join(path, "snapshot")
+
+	// missing snapshots are ignored
+	loaded := NewMemoryCache(1024 * 100)
+	if err := loaded.LoadSnapshotFile(file); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// save when ctx is done
+	shutdownCtx, shutdown := context.WithCancel(ctx)
+	saved := c.SaveSnapshotOnShutdown(shutdownCtx, file)
+	shutdown()
+	<-saved
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected a snapshot after shutdown")
+		return
+	}
+
+	// the short entry expires during the "downtime"
+	time.Sleep(1100 * time.Millisecond)
+
+	// prefixes in use keep their ids
+	loaded.GetCache("b")
+	loaded.GetCache("new")
+	loaded.GetCache("a").Set(ctx, []byte("long"), []byte("newer"), time.Hour)
+	if err := loaded.LoadSnapshotFile(file); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if v := loaded.GetCache("a").Get(ctx, []byte("forever")); !reflect.DeepEqual(v, world) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return
+	}
+	// keys set before loading keep their values
+	if v := loaded.GetCache("a").Get(ctx, []byte("long")); !reflect.DeepEqual(v, []byte("newer")) {
+		t.Errorf("Expected 'newer', but got %v", v)
+		return
+	}
+	if v := loaded.GetCache("a").Get(ctx, []byte("short")); v != nil {
+		t.Errorf("did not expect the expired entry, but got %v", v)
+		return
+	}
+
+	// invalidations are kept
+	if v := loaded.GetCache("b").Get(ctx, []byte("tagged")); v != nil {
+		t.Errorf("did not expect the invalidated entry, but got %v", v)
+		return
+	}
+	if v := loaded.GetCache("c").Get(ctx, []byte("flushed")); v != nil {
+		t.Errorf("did not expect the flushed entry, but got %v", v)
+		return
+	}
+
+	// invalid snapshots are errors
+	if err := loaded.LoadSnapshot(strings.NewReader("nope")); err == nil {
+		t.Errorf("Expected an error")
+		return
+	}
 }
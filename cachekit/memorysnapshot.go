@@ -0,0 +1,274 @@
+package cachekit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+var memorySnapshotHeader = []byte("cachekit.memorysnapshot.1\n")
+
+const (
+	memorySnapshotEntry = 1
+	memorySnapshotEnd   = 0
+
+	// sanity limit for lengths read from snapshots
+	memorySnapshotMaxLength = 1 << 30
+)
+
+// SaveSnapshot writes all live entries with their expiry, the prefix ids and the
+// generation counters to w. The cache can be used while the snapshot is written, but
+// entries set meanwhile may or may not be included.
+func (d *MemoryCache) SaveSnapshot(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	sw := &snapshotWriter{w: buf}
+
+	sw.write(memorySnapshotHeader)
+
+	// prefixes
+	d.RLock()
+	sw.uvarint(uint64(len(d.prefixes)))
+	for name, id := range d.prefixes {
+		sw.bytes([]byte(name))
+		sw.bytes(id)
+	}
+	d.RUnlock()
+
+	// generations
+	generations := d.generations.snapshot()
+	sw.uvarint(uint64(len(generations)))
+	for name, generation := range generations {
+		sw.bytes([]byte(name))
+		sw.uvarint(generation)
+	}
+
+	// entries
+	it := d.cache.NewIterator()
+	for entry := it.Next(); entry != nil && sw.err == nil; entry = it.Next() {
+		// the entry may have been removed or replaced since the iterator read it
+		value, expireAt, err := d.cache.GetWithExpiration(entry.Key)
+		if err != nil {
+			continue
+		}
+		sw.write([]byte{memorySnapshotEntry})
+		sw.bytes(entry.Key)
+		sw.bytes(value)
+		sw.uvarint(uint64(expireAt))
+	}
+	sw.write([]byte{memorySnapshotEnd})
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return buf.Flush()
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot into the cache. Entries that
+// expired since the snapshot was written are dropped. Prefixes already in use by the
+// cache keep their ids, so a snapshot can be loaded after GetCache has been called.
+//
+// Load the snapshot before the cache takes traffic. Keys already in the cache are kept,
+// but the snapshot can still bring back an entry that was removed or invalidated while it
+// was loading.
+func (d *MemoryCache) LoadSnapshot(r io.Reader) error {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+
+	header := make([]byte, len(memorySnapshotHeader))
+	if _, err := io.ReadFull(sr.r, header); err != nil || !bytes.Equal(header, memorySnapshotHeader) {
+		return errors.New("not a memory cache snapshot")
+	}
+
+	// prefixes, mapping the ids in the snapshot to ids in this cache
+	ids := make(map[string][]byte)
+	for count := sr.uvarint(); count > 0 && sr.err == nil; count-- {
+		name := string(sr.bytes())
+		id := sr.bytes()
+		if sr.err == nil {
+			ids[string(id)] = d.GetCache(name).prefix
+		}
+	}
+
+	// generations
+	generations := make(map[string]uint64)
+	for count := sr.uvarint(); count > 0 && sr.err == nil; count-- {
+		name := string(sr.bytes())
+		generations[name] = sr.uvarint()
+	}
+	if sr.err != nil {
+		return sr.err
+	}
+	d.generations.restore(generations)
+
+	// entries
+	now := time.Now().Unix()
+	for {
+		kind := sr.byte()
+		if sr.err != nil {
+			return sr.err
+		}
+		if kind == memorySnapshotEnd {
+			return nil
+		}
+		if kind != memorySnapshotEntry {
+			return fmt.Errorf("invalid entry kind in memory cache snapshot: %v", kind)
+		}
+
+		key := sr.bytes()
+		value := sr.bytes()
+		expireAt := int64(sr.uvarint())
+		if sr.err != nil {
+			return sr.err
+		}
+
+		expireSeconds := 0
+		if expireAt != 0 {
+			if expireAt <= now {
+				continue
+			}
+			expireSeconds = int(expireAt - now)
+		}
+
+		// keys start with the prefix id
+		if len(key) < memoryPrefixLength {
+			continue
+		}
+		id, found := ids[string(key[:memoryPrefixLength])]
+		if !found {
+			continue
+		}
+		copy(key, id)
+
+		// entries set since the cache started are newer than the snapshot
+		if _, err := d.cache.Get(key); err == nil {
+			continue
+		}
+		if err := d.cache.Set(key, value, expireSeconds); err != nil {
+			// too large for this cache
+			continue
+		}
+	}
+}
+
+// SaveSnapshotFile writes a snapshot to path. The snapshot is written to a temporary
+// file first, so path always holds a complete snapshot.
+func (d *MemoryCache) SaveSnapshotFile(path string) error {
+	tag := make([]byte, 4)
+	_, _ = rand.Read(tag)
+	pendingPath := fmt.Sprintf("%v-%x.pending", path, tag)
+
+	fp, err := os.Create(pendingPath)
+	if err != nil {
+		return err
+	}
+	if err = d.SaveSnapshot(fp); err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(pendingPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(pendingPath)
+	}
+	return err
+}
+
+// LoadSnapshotFile loads the snapshot at path. A missing file is not an error, so this
+// can be called on every start.
+func (d *MemoryCache) LoadSnapshotFile(path string) error {
+	fp, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return d.LoadSnapshot(fp)
+}
+
+// SaveSnapshotOnShutdown writes a snapshot to path when ctx is done, e.g. a context from
+// signal.NotifyContext that the application cancels to shut down. The returned channel is
+// closed once the snapshot is written, so the application can wait for it before exiting.
+func (d *MemoryCache) SaveSnapshotOnShutdown(ctx context.Context, path string) <-chan struct{} {
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		<-ctx.Done()
+
+		ctx, done := logkit.Operation(ctx, "memorycache.savesnapshot", logkit.String("path", path))
+		defer done()
+		if err := d.SaveSnapshotFile(path); err != nil {
+			logkit.Error(ctx, "Error saving memory cache snapshot", logkit.Err(err))
+		}
+	}()
+	return saved
+}
+
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *snapshotWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (w *snapshotWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.write(b)
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *snapshotReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	var b byte
+	b, r.err = r.r.ReadByte()
+	return b
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	var v uint64
+	v, r.err = binary.ReadUvarint(r.r)
+	return v
+}
+
+func (r *snapshotReader) bytes() []byte {
+	length := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if length > memorySnapshotMaxLength {
+		r.err = errors.New("invalid length in memory cache snapshot")
+		return nil
+	}
+	b := make([]byte, length)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
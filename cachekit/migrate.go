@@ -0,0 +1,228 @@
+package cachekit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// ttlStore is implemented by stores that can tell how long an entry has left to live,
+// so it can be copied to another store with the same expiry. A ttl of 0 means the
+// entry never expires.
+type ttlStore interface {
+	getTTL(ctx context.Context, key []byte) ([]byte, []string, time.Duration)
+}
+
+// knowsTTL returns whether store can tell the remaining time to live of its entries. The
+// stats and generation wrappers implement ttlStore for every store, but can only pass on
+// what the store they wrap knows; for the rest a ttl of 0 is unknown, not never expiring.
+func knowsTTL(store cacheStore) bool {
+	switch s := store.(type) {
+	case statsStore:
+		return knowsTTL(s.store)
+	case generationStore:
+		return knowsTTL(s.store)
+	}
+	_, ok := store.(ttlStore)
+	return ok
+}
+
+// MigrateDiskCache copies all live entries from a DiskCache to a DiskCache2, keeping
+// their remaining time to live. Entries dropped by InvalidatePrefix or InvalidateTag in
+// the DiskCache are skipped. It returns the number of entries copied.
+func MigrateDiskCache(ctx context.Context, from *DiskCache, to *DiskCache2) (int, error) {
+	log, done := logkit.Operation(ctx, "diskcache.migrate")
+	defer done()
+
+	copied := 0
+	skipped := 0
+	err := from.db.View(func(tx *bolt.Tx) error {
+		// map prefix ids back to names
+		prefixes := make(map[string]string)
+		err := tx.Bucket(idBucket).ForEach(func(name, id []byte) error {
+			if !bytes.Equal(name, []byte{0}) {
+				prefixes[string(id)] = string(name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// read generations in this transaction, rather than through from.generations
+		generation := func(name string) uint64 {
+			if v := tx.Bucket(generationBucket).Get([]byte(name)); len(v) == 8 {
+				return binary.LittleEndian.Uint64(v)
+			}
+			return 0
+		}
+		tagGeneration := func(tag string) uint64 {
+			if v := tx.Bucket(generationBucket).Get([]byte(tagGenerationName(tag))); len(v) == 8 {
+				return binary.LittleEndian.Uint64(v)
+			}
+			return generation(floorGenerationName)
+		}
+
+		caches := make(map[string]*Cache)
+		now := time.Now()
+		return tx.Bucket(cacheBucket).ForEach(func(k, v []byte) error {
+			if bytes.HasPrefix(k, accessPrefix) || len(v) < 16 || len(k) < 2 {
+				return nil
+			}
+
+			// prefix ids are uint16s
+			prefix, found := prefixes[string(k[:2])]
+			if !found {
+				skipped++
+				return nil
+			}
+			key := k[2:]
+
+			expires := int64(binary.LittleEndian.Uint64(v[8:16]))
+			if diskCacheExpires(expires) < now.UnixNano() {
+				return nil
+			}
+			entry, err := decodeDiskCacheValue(expires, v[16:])
+			if err != nil {
+				skipped++
+				return nil
+			}
+			expires = diskCacheExpires(expires)
+
+			key, ok := unfoldGeneration(generation(prefixGenerationName(prefix)), key)
+			if !ok {
+				// dropped by InvalidatePrefix
+				skipped++
+				return nil
+			}
+
+			value, tags, tagGenerations, ok := decodeTaggedEntry(entry)
+			if !ok {
+				skipped++
+				return nil
+			}
+			for i, tag := range tags {
+				if !tagLive(tagGenerations[i], tagGeneration(tag)) {
+					// dropped by InvalidateTag
+					ok = false
+					break
+				}
+			}
+			if !ok {
+				skipped++
+				return nil
+			}
+
+			// write through the DiskCache2 generations, so keys and tags match its counters
+			cache, found := caches[prefix]
+			if !found {
+				cache = to.GetCache(ctx, prefix)
+				caches[prefix] = cache
+			}
+			cache.Set(ctx, key, value, diskCacheTTL(expires, now), tags...)
+			copied++
+			if copied%10000 == 0 {
+				log.Info("Migrating disk cache", logkit.Int("copied", copied))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error("Error migrating DiskCache", logkit.Err(err))
+		return copied, err
+	}
+
+	log.Info("Migrated disk cache", logkit.Int("copied", copied), logkit.Int("skipped", skipped))
+	return copied, nil
+}
+
+// unfoldGeneration returns the key as it was passed to the cache, and false if the key
+// was stored under another prefix generation.
+func unfoldGeneration(generation uint64, key []byte) ([]byte, bool) {
+	folded := foldGeneration(generation, nil)
+	if !bytes.HasPrefix(key, folded) {
+		return nil, false
+	}
+	return key[len(folded):], true
+}
+
+// MigratingCache reads through to an old DiskCache on misses in a new DiskCache2, and
+// moves hits to the new cache with their remaining time to live. Writes go to the new
+// cache and remove the key from the old one, so an overwritten value can't be read back
+// from the old cache later, and removes and invalidations go to both, so nodes can switch
+// to DiskCache2 without starting cold. Use MigrateDiskCache to copy everything up front instead.
+type MigratingCache struct {
+	new *DiskCache2
+	old *DiskCache
+}
+
+// NewMigratingCache returns a MigratingCache reading from newCache first, then oldCache.
+func NewMigratingCache(newCache *DiskCache2, oldCache *DiskCache) *MigratingCache {
+	return &MigratingCache{new: newCache, old: oldCache}
+}
+
+func (m *MigratingCache) GetCache(ctx context.Context, prefix string) *Cache {
+	newCache := m.new.GetCache(ctx, prefix)
+	return &Cache{
+		cacheStore: migratingStore{new: newCache, old: m.old.GetCache(ctx, prefix)},
+		flights:    newCache.flights,
+		prefix:     newCache.prefix,
+	}
+}
+
+type migratingStore struct {
+	new *Cache
+	old *Cache
+}
+
+func (s migratingStore) get(ctx context.Context, key []byte) []byte {
+	value, _ := s.getTagged(ctx, key)
+	return value
+}
+
+func (s migratingStore) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
+	s.new.set(ctx, key, value, ttl)
+	s.old.remove(ctx, key)
+}
+
+func (s migratingStore) remove(ctx context.Context, key []byte) {
+	s.new.remove(ctx, key)
+	s.old.remove(ctx, key)
+}
+
+func (s migratingStore) getTagged(ctx context.Context, key []byte) ([]byte, []string) {
+	if value, tags := s.new.cacheStore.(invalidatingStore).getTagged(ctx, key); value != nil {
+		return value, tags
+	}
+
+	store, ok := s.old.cacheStore.(ttlStore)
+	if !ok {
+		return nil, nil
+	}
+	value, tags, ttl := store.getTTL(ctx, key)
+	if value != nil {
+		// move it, so the old copy isn't read again when the new one expires
+		s.new.Set(ctx, key, value, ttl, tags...)
+		s.old.remove(ctx, key)
+	}
+	return value, tags
+}
+
+func (s migratingStore) setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string) {
+	s.new.Set(ctx, key, value, ttl, tags...)
+	s.old.remove(ctx, key)
+}
+
+func (s migratingStore) invalidatePrefix(ctx context.Context) {
+	s.new.InvalidatePrefix(ctx)
+	s.old.InvalidatePrefix(ctx)
+}
+
+func (s migratingStore) invalidateTag(ctx context.Context, tag string) {
+	s.new.InvalidateTag(ctx, tag)
+	s.old.InvalidateTag(ctx, tag)
+}
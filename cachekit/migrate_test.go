@@ -0,0 +1,112 @@
+package cachekit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMigrateDiskCache(t *testing.T) {
+	ctx := context.Background()
+	world := []byte("world")
+
+	file, err := ioutil.TempFile("", "diskcache")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.Remove(file.Name())
+	old, err := NewDiskCache(ctx, file.Name(), 1024*100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer old.Close()
+
+	path, err := ioutil.TempDir("", "diskcache2")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.RemoveAll(path)
+	dc2, err := NewDiskCache2(ctx, path, 1024*100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dc2.Close()
+
+	// entries in the old cache
+	old.GetCache(ctx, "a").Set(ctx, []byte("forever"), world, 0)
+	old.GetCache(ctx, "a").Set(ctx, []byte("short"), world, time.Second)
+	old.GetCache(ctx, "a").Set(ctx, []byte("expired"), world, time.Millisecond)
+	old.GetCache(ctx, "a").Set(ctx, []byte("tagged"), world, 0, "kept")
+	old.GetCache(ctx, "a").Set(ctx, []byte("invalidated"), world, 0, "dropped")
+	old.GetCache(ctx, "a").InvalidateTag(ctx, "dropped")
+	old.GetCache(ctx, "b").Set(ctx, []byte("flushed"), world, 0)
+	old.GetCache(ctx, "b").InvalidatePrefix(ctx)
+	old.GetCache(ctx, "b").Set(ctx, []byte("after"), world, 0)
+	time.Sleep(5 * time.Millisecond)
+
+	copied, err := MigrateDiskCache(ctx, old, dc2)
+	if err != nil || copied != 4 {
+		t.Errorf("Expected 4 entries to be copied, but got %v (%v)", copied, err)
+		return
+	}
+
+	expect := func(c *Cache, key string, expected []byte) bool {
+		if v := c.Get(ctx, []byte(key)); !reflect.DeepEqual(v, expected) {
+			t.Errorf("Expected %q for %v, but got %q", expected, key, v)
+			return false
+		}
+		return true
+	}
+	a := dc2.GetCache(ctx, "a")
+	b := dc2.GetCache(ctx, "b")
+	if !expect(a, "forever", world) || !expect(a, "short", world) || !expect(a, "tagged", world) || !expect(b, "after", world) ||
+		!expect(a, "expired", nil) || !expect(a, "invalidated", nil) || !expect(b, "flushed", nil) {
+		return
+	}
+
+	// tags are copied
+	a.InvalidateTag(ctx, "kept")
+	if !expect(a, "tagged", nil) {
+		return
+	}
+
+	// read-through from the old cache
+	migrating := NewMigratingCache(dc2, old)
+	old.GetCache(ctx, "c").Set(ctx, []byte("old"), world, time.Second)
+	c := migrating.GetCache(ctx, "c")
+	if !expect(c, "old", world) || !expect(dc2.GetCache(ctx, "c"), "old", world) || !expect(old.GetCache(ctx, "c"), "old", nil) {
+		return
+	}
+
+	// writes go to the new cache and drop the old copy, removes go to both
+	c.Set(ctx, []byte("new"), world, 0)
+	if !expect(dc2.GetCache(ctx, "c"), "new", world) || !expect(old.GetCache(ctx, "c"), "new", nil) {
+		return
+	}
+	old.GetCache(ctx, "c").Set(ctx, []byte("overwritten"), []byte("stale"), 0)
+	c.Set(ctx, []byte("overwritten"), world, time.Second)
+	if !expect(c, "overwritten", world) || !expect(old.GetCache(ctx, "c"), "overwritten", nil) {
+		return
+	}
+	old.GetCache(ctx, "c").Set(ctx, []byte("removed"), world, 0)
+	c.Remove(ctx, []byte("removed"))
+	if !expect(c, "removed", nil) || !expect(old.GetCache(ctx, "c"), "removed", nil) {
+		return
+	}
+
+	// remaining ttls are kept, both by the migration and by read-through
+	time.Sleep(2100 * time.Millisecond)
+	if !expect(a, "short", nil) || !expect(dc2.GetCache(ctx, "c"), "old", nil) {
+		return
+	}
+
+	// the old value doesn't come back when the new one expires
+	if !expect(c, "overwritten", nil) {
+		return
+	}
+}
@@ -0,0 +1,103 @@
+package cachekit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Entry is a key and value for SetMulti.
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// multiStore is implemented by stores that can read and write several keys at once
+// cheaper than one at a time.
+type multiStore interface {
+	getMulti(ctx context.Context, keys [][]byte) [][]byte
+	setMulti(ctx context.Context, entries []Entry, ttl time.Duration)
+}
+
+// GetMulti returns the cached values for keys, in the same order. Misses are nil.
+func (c Cache) GetMulti(ctx context.Context, keys [][]byte) [][]byte {
+	values := getMultiFrom(ctx, c.cacheStore, keys)
+	for i, value := range values {
+		if isNil(value) {
+			values[i] = nil
+		}
+	}
+	return values
+}
+
+// SetMulti caches all entries with the same ttl.
+func (c Cache) SetMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	setMultiTo(ctx, c.cacheStore, entries, ttl)
+}
+
+// GetMultiFunc returns the cached values for keys, in the same order, and calls f once
+// with all the missing keys to load them. f must return a value for each key it is
+// called with, in the same order; nil values are cached as not found, like in GetFunc.
+// Unlike GetFunc, concurrent loads of the same keys are not combined.
+func (c Cache) GetMultiFunc(ctx context.Context, keys [][]byte, ttl time.Duration, f func(keys [][]byte) ([][]byte, error)) ([][]byte, error) {
+	values := getMultiFrom(ctx, c.cacheStore, keys)
+
+	var missing [][]byte
+	var missingIndexes []int
+	for i, value := range values {
+		if value == nil {
+			missing = append(missing, keys[i])
+			missingIndexes = append(missingIndexes, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		loaded, err := f(missing)
+		if err != nil {
+			return nil, err
+		}
+		if len(loaded) != len(missing) {
+			return nil, errors.New("cachekit: GetMultiFunc loader returned the wrong number of values")
+		}
+
+		entries := make([]Entry, len(missing))
+		for i, value := range loaded {
+			if value == nil {
+				value = nilValue
+			}
+			entries[i] = Entry{Key: missing[i], Value: value}
+			values[missingIndexes[i]] = value
+		}
+		setMultiTo(ctx, c.cacheStore, entries, ttl)
+	}
+
+	for i, value := range values {
+		if isNil(value) {
+			values[i] = nil
+		}
+	}
+	return values, nil
+}
+
+func getMultiFrom(ctx context.Context, store cacheStore, keys [][]byte) [][]byte {
+	if store, ok := store.(multiStore); ok {
+		return store.getMulti(ctx, keys)
+	}
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = store.get(ctx, key)
+	}
+	return values
+}
+
+func setMultiTo(ctx context.Context, store cacheStore, entries []Entry, ttl time.Duration) {
+	if store, ok := store.(multiStore); ok {
+		store.setMulti(ctx, entries, ttl)
+		return
+	}
+
+	for _, entry := range entries {
+		store.set(ctx, entry.Key, entry.Value, ttl)
+	}
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func NewNoOpCache() *Cache {
-	return &Cache{cacheStore: noopCacheStore{}}
+	return &Cache{cacheStore: noopCacheStore{}, flights: newFlightGroup()}
 }
 
 type noopCacheStore struct{}
@@ -0,0 +1,12 @@
+package cachekit
+
+import "testing"
+
+func TestNoOpCache(t *testing.T) {
+	c := NewNoOpCache()
+
+	// concurrent loads
+	if !flighttest(c, t) {
+		return
+	}
+}
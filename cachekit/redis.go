@@ -0,0 +1,577 @@
+package cachekit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+const (
+	redisDialTimeout = 2 * time.Second
+	redisIOTimeout   = 2 * time.Second
+	redisRetryDelay  = time.Second
+	redisScanCount   = "500"
+)
+
+// errRedisUnavailable is returned without dialing for redisRetryDelay after a dial fails,
+// so a server that is down doesn't hold up every request for redisDialTimeout.
+var errRedisUnavailable = errors.New("redis is unavailable")
+
+var errRedisBusy = errors.New("timed out waiting for a redis connection")
+
+// RedisCache is a cache store speaking the redis protocol (RESP), so it can be shared
+// by several processes. Connection errors are logged and treated as cache misses.
+//
+// Entries are stored under "c:<length of prefix>:<prefix>:<key>", so no prefix is the
+// start of another. The keys of each tag are kept in a set under "t:<tag>", which expires
+// with the last of its entries, and keys of entries without a ttl in a set under
+// "tp:<tag>". Expiring the tag sets uses PEXPIRE NX and GT, which need redis 7.
+type RedisCache struct {
+	address string
+	pool    chan *redisConn // idle connections
+	open    chan struct{}   // holds a value for every open connection
+	flights *flightGroup
+	stats   *cacheStats
+
+	downLock  sync.Mutex
+	downUntil time.Time
+}
+
+// NewRedisCache returns a RedisCache for the server at address, with up to poolSize
+// connections open. Requests wait up to 2 seconds for a connection when all are in use.
+func NewRedisCache(ctx context.Context, address string, poolSize int) *RedisCache {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	return &RedisCache{
+		address: address,
+		pool:    make(chan *redisConn, poolSize),
+		open:    make(chan struct{}, poolSize),
+		flights: newFlightGroup(),
+		stats:   newCacheStats(),
+	}
+}
+
+func (r *RedisCache) GetCache(ctx context.Context, prefix string) *Cache {
+	return &Cache{
+		cacheStore: newStatsStore(redisStore{prefix: "c:" + strconv.Itoa(len(prefix)) + ":" + prefix + ":", cache: r}, r.stats, prefix),
+		flights:    r.flights,
+		prefix:     []byte(prefix),
+	}
+}
+
+// CacheStats returns the operations of this process on the cache. The size of the
+// cache is kept by the redis server, and isn't included.
+func (r *RedisCache) CacheStats() CacheStats {
+	return r.stats.cacheStats(0, 0, 0)
+}
+
+// FlushPrefix drops every entry in prefix.
+func (r *RedisCache) FlushPrefix(ctx context.Context, prefix string) {
+	r.GetCache(ctx, prefix).InvalidatePrefix(ctx)
+}
+
+// Close closes all idle connections.
+func (r *RedisCache) Close() {
+	for {
+		select {
+		case conn := <-r.pool:
+			r.closeConn(conn)
+		default:
+			return
+		}
+	}
+}
+
+// do sends all commands in a single pipeline and returns their replies. Replies that
+// are redis errors are returned as redisError values, not as err.
+func (r *RedisCache) do(commands ...[][]byte) ([]interface{}, error) {
+	conn, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := conn.pipeline(commands)
+	if err != nil {
+		r.closeConn(conn)
+		return nil, err
+	}
+
+	r.putConn(conn)
+	return replies, nil
+}
+
+// getConn returns an idle connection, or dials a new one if fewer than poolSize are open.
+func (r *RedisCache) getConn() (*redisConn, error) {
+	select {
+	case conn := <-r.pool:
+		return conn, nil
+	default:
+	}
+
+	timer := time.NewTimer(redisDialTimeout)
+	defer timer.Stop()
+	select {
+	case conn := <-r.pool:
+		return conn, nil
+	case r.open <- struct{}{}:
+	case <-timer.C:
+		return nil, errRedisBusy
+	}
+
+	r.downLock.Lock()
+	down := time.Now().Before(r.downUntil)
+	r.downLock.Unlock()
+	if down {
+		<-r.open
+		return nil, errRedisUnavailable
+	}
+
+	netConn, err := net.DialTimeout("tcp", r.address, redisDialTimeout)
+	if err != nil {
+		<-r.open
+		r.downLock.Lock()
+		r.downUntil = time.Now().Add(redisRetryDelay)
+		r.downLock.Unlock()
+		return nil, err
+	}
+	return &redisConn{
+		Conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}, nil
+}
+
+func (r *RedisCache) putConn(conn *redisConn) {
+	select {
+	case r.pool <- conn:
+	default:
+		r.closeConn(conn)
+	}
+}
+
+func (r *RedisCache) closeConn(conn *redisConn) {
+	conn.Close()
+	<-r.open
+}
+
+// logRedisError logs an error, except errRedisUnavailable, as the failed dial is logged.
+func logRedisError(log *logkit.Context, message string, err error) {
+	if err != errRedisUnavailable {
+		log.Error(message, logkit.Err(err))
+	}
+}
+
+type redisStore struct {
+	prefix string
+	cache  *RedisCache
+}
+
+func (s redisStore) key(key []byte) []byte {
+	return append([]byte(s.prefix), key...)
+}
+
+func (s redisStore) get(ctx context.Context, key []byte) []byte {
+	value, _ := s.getTagged(ctx, key)
+	return value
+}
+
+func (s redisStore) getTagged(ctx context.Context, key []byte) ([]byte, []string) {
+	log, done := logkit.Operation(ctx, "rediscache.get", logkit.Bytes("key", key))
+	defer done()
+
+	replies, err := s.cache.do(redisCommand("GET", s.key(key)))
+	if err == nil {
+		err = redisReplyError(replies[0])
+	}
+	if err != nil {
+		logRedisError(log, "Error reading from RedisCache", err)
+		return nil, nil
+	}
+
+	entry, _ := replies[0].([]byte)
+	value, tags, _, ok := decodeTaggedEntry(entry)
+	if !ok {
+		return nil, nil
+	}
+	return value, tags
+}
+
+// getMulti fetches all keys with a single pipeline of GET commands.
+func (s redisStore) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	log, done := logkit.Operation(ctx, "rediscache.getmulti", logkit.Int("keys", len(keys)))
+	defer done()
+
+	values := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return values
+	}
+
+	commands := make([][][]byte, len(keys))
+	for i, key := range keys {
+		commands[i] = redisCommand("GET", s.key(key))
+	}
+
+	replies, err := s.cache.do(commands...)
+	if err != nil {
+		logRedisError(log, "Error reading from RedisCache", err)
+		return values
+	}
+
+	for i, reply := range replies {
+		entry, _ := reply.([]byte)
+		if value, _, _, ok := decodeTaggedEntry(entry); ok {
+			values[i] = value
+		}
+	}
+	return values
+}
+
+// setMulti writes all entries with a single pipeline of SET commands.
+func (s redisStore) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	log, done := logkit.Operation(ctx, "rediscache.setmulti", logkit.Int("entries", len(entries)), logkit.Duration("ttl", ttl))
+	defer done()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	commands := make([][][]byte, len(entries))
+	for i, entry := range entries {
+		switch {
+		case ttl < 0:
+			commands[i] = redisCommand("DEL", s.key(entry.Key))
+		case ttl > 0:
+			px := int64(ttl / time.Millisecond)
+			if px == 0 {
+				px = 1
+			}
+			commands[i] = redisCommand("SET", s.key(entry.Key), entry.Value, []byte("PX"), []byte(strconv.FormatInt(px, 10)))
+		default:
+			commands[i] = redisCommand("SET", s.key(entry.Key), entry.Value)
+		}
+	}
+
+	replies, err := s.cache.do(commands...)
+	if err == nil {
+		for _, reply := range replies {
+			if err = redisReplyError(reply); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logRedisError(log, "Error writing to RedisCache", err)
+	}
+}
+
+func (s redisStore) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
+	s.setTagged(ctx, key, value, ttl, nil)
+}
+
+func (s redisStore) setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string) {
+	log, done := logkit.Operation(ctx, "rediscache.set", logkit.Bytes("key", key), logkit.Bytes("value", value), logkit.Duration("ttl", ttl))
+	defer done()
+
+	if ttl < 0 {
+		s.remove(ctx, key)
+		return
+	}
+
+	key = s.key(key)
+	px := []byte(strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	if ttl > 0 && ttl < time.Millisecond {
+		px = []byte("1")
+	}
+
+	commands := make([][][]byte, 0, 1+3*len(tags))
+	if len(tags) > 0 {
+		value = encodeTaggedEntry(value, tags, make([]uint64, len(tags)))
+		for _, tag := range tags {
+			if ttl > 0 {
+				// the set lives at least as long as the entry: NX sets the expiry of a
+				// new set, GT extends that of an existing one.
+				tagKey := []byte("t:" + tag)
+				commands = append(commands,
+					redisCommand("SADD", tagKey, key),
+					redisCommand("PEXPIRE", tagKey, px, []byte("NX")),
+					redisCommand("PEXPIRE", tagKey, px, []byte("GT")))
+			} else {
+				commands = append(commands, redisCommand("SADD", []byte("tp:"+tag), key))
+			}
+		}
+	}
+	if ttl > 0 {
+		commands = append(commands, redisCommand("SET", key, value, []byte("PX"), px))
+	} else {
+		commands = append(commands, redisCommand("SET", key, value))
+	}
+
+	replies, err := s.cache.do(commands...)
+	if err == nil {
+		for _, reply := range replies {
+			if err = redisReplyError(reply); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		logRedisError(log, "Error writing to RedisCache", err)
+	}
+}
+
+func (s redisStore) remove(ctx context.Context, key []byte) {
+	log, done := logkit.Operation(ctx, "rediscache.remove", logkit.Bytes("key", key))
+	defer done()
+
+	replies, err := s.cache.do(redisCommand("DEL", s.key(key)))
+	if err == nil {
+		err = redisReplyError(replies[0])
+	}
+	if err != nil {
+		logRedisError(log, "Error deleting from RedisCache", err)
+	}
+}
+
+func (s redisStore) invalidatePrefix(ctx context.Context) {
+	log, done := logkit.Operation(ctx, "rediscache.invalidateprefix", logkit.String("prefix", s.prefix))
+	defer done()
+
+	pattern := []byte(redisEscapePattern(s.prefix) + "*")
+	cursor := []byte("0")
+	for {
+		replies, err := s.cache.do(redisCommand("SCAN", cursor, []byte("MATCH"), pattern, []byte("COUNT"), []byte(redisScanCount)))
+		if err == nil {
+			err = redisReplyError(replies[0])
+		}
+		if err != nil {
+			logRedisError(log, "Error scanning RedisCache", err)
+			return
+		}
+
+		reply, _ := replies[0].([]interface{})
+		if len(reply) != 2 {
+			log.Error("Unexpected SCAN reply from RedisCache")
+			return
+		}
+		cursor, _ = reply[0].([]byte)
+		keys, _ := reply[1].([]interface{})
+
+		if len(keys) > 0 {
+			command := make([][]byte, 0, len(keys)+1)
+			command = append(command, []byte("DEL"))
+			for _, key := range keys {
+				if k, ok := key.([]byte); ok {
+					command = append(command, k)
+				}
+			}
+			if _, err := s.cache.do(command); err != nil {
+				logRedisError(log, "Error deleting from RedisCache", err)
+				return
+			}
+		}
+
+		if string(cursor) == "0" {
+			return
+		}
+	}
+}
+
+func (s redisStore) invalidateTag(ctx context.Context, tag string) {
+	log, done := logkit.Operation(ctx, "rediscache.invalidatetag", logkit.String("tag", tag))
+	defer done()
+
+	tagKey, persistentKey := []byte("t:"+tag), []byte("tp:"+tag)
+	replies, err := s.cache.do(redisCommand("SMEMBERS", tagKey), redisCommand("SMEMBERS", persistentKey), redisCommand("DEL", tagKey, persistentKey))
+	if err == nil {
+		err = redisReplyError(replies[0])
+	}
+	if err == nil {
+		err = redisReplyError(replies[1])
+	}
+	if err != nil {
+		logRedisError(log, "Error reading tag from RedisCache", err)
+		return
+	}
+
+	keys, _ := replies[0].([]interface{})
+	persistent, _ := replies[1].([]interface{})
+	keys = append(keys, persistent...)
+	if len(keys) == 0 {
+		return
+	}
+	command := make([][]byte, 0, len(keys)+1)
+	command = append(command, []byte("DEL"))
+	for _, key := range keys {
+		if k, ok := key.([]byte); ok {
+			command = append(command, k)
+		}
+	}
+	if _, err := s.cache.do(command); err != nil {
+		logRedisError(log, "Error deleting from RedisCache", err)
+	}
+}
+
+// ----------
+
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func redisReplyError(reply interface{}) error {
+	if err, ok := reply.(redisError); ok {
+		return err
+	}
+	return nil
+}
+
+func redisCommand(name string, args ...[]byte) [][]byte {
+	return append([][]byte{[]byte(name)}, args...)
+}
+
+func redisEscapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func (c *redisConn) pipeline(commands [][][]byte) ([]interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(redisIOTimeout)); err != nil {
+		return nil, err
+	}
+
+	for _, command := range commands {
+		if err := writeRedisValue(c.writer, command); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range replies {
+		reply, err := readRedisValue(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// writeRedisValue writes a value in RESP format. Commands are arrays of bulk strings,
+// the other types are only written by the test server.
+func writeRedisValue(w *bufio.Writer, value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		_, err = w.WriteString("$-1\r\n")
+	case string:
+		_, err = fmt.Fprintf(w, "+%v\r\n", v)
+	case redisError:
+		_, err = fmt.Fprintf(w, "-%v\r\n", string(v))
+	case int64:
+		_, err = fmt.Fprintf(w, ":%v\r\n", v)
+	case []byte:
+		if _, err = fmt.Fprintf(w, "$%v\r\n", len(v)); err == nil {
+			if _, err = w.Write(v); err == nil {
+				_, err = w.WriteString("\r\n")
+			}
+		}
+	case [][]byte:
+		if _, err = fmt.Fprintf(w, "*%v\r\n", len(v)); err == nil {
+			for _, item := range v {
+				if err = writeRedisValue(w, item); err != nil {
+					break
+				}
+			}
+		}
+	case []interface{}:
+		if _, err = fmt.Fprintf(w, "*%v\r\n", len(v)); err == nil {
+			for _, item := range v {
+				if err = writeRedisValue(w, item); err != nil {
+					break
+				}
+			}
+		}
+	default:
+		err = fmt.Errorf("can't write %T as a redis value", value)
+	}
+	return err
+}
+
+// readRedisValue reads a single RESP value: simple strings as string, errors as
+// redisError, integers as int64, bulk strings as []byte and arrays as []interface{}.
+func readRedisValue(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("invalid redis protocol line")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, length)
+		for i := range values {
+			if values[i], err = readRedisValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type: %q", kind)
+	}
+}
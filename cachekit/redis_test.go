@@ -0,0 +1,164 @@
+package cachekit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedisCache(t *testing.T) {
+	ctx := context.Background()
+
+	server, err := newRedisTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+
+	c := NewRedisCache(ctx, server.Addr(), 4)
+	defer c.Close()
+
+	// regular cache testing
+	if !cachetest(c.GetCache(ctx, "one"), c.GetCache(ctx, "two"), t) {
+		return
+	}
+
+	// concurrent loads
+	if !flighttest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// soft and hard ttls
+	if !staletest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// batch gets and sets
+	if !multitest(c.GetCache(ctx, "seven"), t) {
+		return
+	}
+
+	// prefix and tag invalidation
+	if !invalidatetest(c.GetCache(ctx, "three"), c.GetCache(ctx, "four"), t) {
+		return
+	}
+
+	// ttls are passed on as PX
+	c.GetCache(ctx, "five").Set(ctx, []byte("hello"), []byte("world"), 50*time.Millisecond)
+	if v := c.GetCache(ctx, "five").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, []byte("world")) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v := c.GetCache(ctx, "five").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value")
+		return
+	}
+
+	// multi-gets are pipelined
+	store := c.GetCache(ctx, "six").cacheStore.(statsStore).store.(redisStore)
+	c.GetCache(ctx, "six").Set(ctx, []byte("a"), []byte("1"), 0)
+	c.GetCache(ctx, "six").Set(ctx, []byte("c"), []byte("3"), 0, "tagged")
+	values := store.getMulti(ctx, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if !reflect.DeepEqual(values, [][]byte{[]byte("1"), nil, []byte("3")}) {
+		t.Errorf("Expected [1 nil 3], but got %v", values)
+		return
+	}
+
+	// a prefix doesn't match the keys of prefixes it starts
+	c.GetCache(ctx, "a:b").Set(ctx, []byte("hello"), []byte("world"), 0)
+	c.GetCache(ctx, "a").InvalidatePrefix(ctx)
+	if v := c.GetCache(ctx, "a:b").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, []byte("world")) {
+		t.Errorf("Expected 'world', but got %v", v)
+		return
+	}
+
+	// tag sets expire with the last of their entries
+	tagged := c.GetCache(ctx, "eight")
+	tagged.Set(ctx, []byte("long"), []byte("1"), 200*time.Millisecond, "expiring")
+	tagged.Set(ctx, []byte("short"), []byte("2"), 50*time.Millisecond, "expiring")
+	replies, err := c.do(redisCommand("PTTL", []byte("t:expiring")))
+	if err != nil || replies[0].(int64) <= 100 {
+		t.Errorf("Expected the tag set to outlive its entries, but got %v %v", replies, err)
+		return
+	}
+	tagged.InvalidateTag(ctx, "expiring")
+	if tagged.Get(ctx, []byte("long")) != nil {
+		t.Errorf("did not expect a value after InvalidateTag")
+		return
+	}
+	tagged.Set(ctx, []byte("gone"), []byte("3"), 20*time.Millisecond, "gone")
+	time.Sleep(50 * time.Millisecond)
+	replies, err = c.do(redisCommand("PTTL", []byte("t:gone")))
+	if err != nil || replies[0].(int64) != -2 {
+		t.Errorf("Expected the tag set to be gone, but got %v %v", replies, err)
+		return
+	}
+}
+
+func TestRedisCacheUnavailable(t *testing.T) {
+	ctx := context.Background()
+
+	// nothing listens here once the server is closed
+	server, err := newRedisTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server.Close()
+
+	// connection errors are misses
+	r := NewRedisCache(ctx, server.Addr(), 4)
+	c := r.GetCache(ctx, "one")
+	c.Set(ctx, []byte("hello"), []byte("world"), 0)
+	if v := c.Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value")
+		return
+	}
+	v := c.GetFunc(ctx, []byte("hello"), 0, func(key []byte) []byte { return []byte("loaded") })
+	if !reflect.DeepEqual(v, []byte("loaded")) {
+		t.Errorf("Expected 'loaded', but got %v", v)
+		return
+	}
+
+	// after a failed dial, requests fail without dialing until the retry delay has passed
+	if _, err := r.do(redisCommand("GET", []byte("hello"))); err != errRedisUnavailable {
+		t.Errorf("Expected errRedisUnavailable, but got %v", err)
+	}
+}
+
+func TestRedisCacheMaxConnections(t *testing.T) {
+	ctx := context.Background()
+	server, err := newRedisTestServer()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer server.Close()
+
+	// with every connection in use, requests wait for one to be returned
+	r := NewRedisCache(ctx, server.Addr(), 1)
+	defer r.Close()
+	conn, err := r.getConn()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got := make(chan *redisConn)
+	go func() {
+		next, _ := r.getConn()
+		got <- next
+	}()
+	select {
+	case <-got:
+		t.Errorf("did not expect a second connection")
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.putConn(conn)
+	if next := <-got; next != conn {
+		t.Errorf("Expected the returned connection")
+	}
+}
@@ -0,0 +1,295 @@
+package cachekit
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTestServer is a small in-process stand-in for a redis server. It supports the
+// commands used by RedisCache.
+type redisTestServer struct {
+	sync.Mutex
+	listener net.Listener
+	values   map[string][]byte
+	expires  map[string]time.Time
+	sets     map[string]map[string]bool
+}
+
+// newRedisTestServer starts a redisTestServer listening on a random local port.
+func newRedisTestServer() (*redisTestServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &redisTestServer{
+		listener: listener,
+		values:   make(map[string][]byte),
+		expires:  make(map[string]time.Time),
+		sets:     make(map[string]map[string]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *redisTestServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting new connections.
+func (s *redisTestServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *redisTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *redisTestServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		value, err := readRedisValue(reader)
+		if err != nil {
+			return
+		}
+
+		items, _ := value.([]interface{})
+		command := make([][]byte, 0, len(items))
+		for _, item := range items {
+			if b, ok := item.([]byte); ok {
+				command = append(command, b)
+			}
+		}
+
+		if err := writeRedisValue(writer, s.execute(command)); err != nil {
+			return
+		}
+
+		// flush once all pipelined commands have been answered
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *redisTestServer) execute(command [][]byte) interface{} {
+	if len(command) == 0 {
+		return redisError("ERR empty command")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	args := command[1:]
+	switch strings.ToUpper(string(command[0])) {
+	case "PING":
+		return "PONG"
+	case "GET":
+		if len(args) != 1 {
+			return redisError("ERR wrong number of arguments for 'get' command")
+		}
+		return s.get(string(args[0]))
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if value := s.get(string(key)); value != nil {
+				values[i] = value
+			}
+		}
+		return values
+	case "SET":
+		if len(args) != 2 && len(args) != 4 {
+			return redisError("ERR syntax error")
+		}
+		key := string(args[0])
+		s.values[key] = append([]byte(nil), args[1]...)
+		delete(s.expires, key)
+		if len(args) == 4 {
+			px, err := strconv.ParseInt(string(args[3]), 10, 64)
+			if err != nil || px <= 0 || strings.ToUpper(string(args[2])) != "PX" {
+				return redisError("ERR invalid expire time in 'set' command")
+			}
+			s.expires[key] = time.Now().Add(time.Duration(px) * time.Millisecond)
+		}
+		return "OK"
+	case "DEL":
+		deleted := int64(0)
+		for _, key := range args {
+			if _, found := s.values[string(key)]; found {
+				deleted++
+			} else if _, found := s.sets[string(key)]; found {
+				deleted++
+			}
+			delete(s.values, string(key))
+			delete(s.expires, string(key))
+			delete(s.sets, string(key))
+		}
+		return deleted
+	case "SADD":
+		if len(args) < 2 {
+			return redisError("ERR wrong number of arguments for 'sadd' command")
+		}
+		set := s.members(string(args[0]))
+		if set == nil {
+			set = make(map[string]bool)
+			s.sets[string(args[0])] = set
+		}
+		added := int64(0)
+		for _, member := range args[1:] {
+			if !set[string(member)] {
+				set[string(member)] = true
+				added++
+			}
+		}
+		return added
+	case "SMEMBERS":
+		if len(args) != 1 {
+			return redisError("ERR wrong number of arguments for 'smembers' command")
+		}
+		members := make([]interface{}, 0)
+		for member := range s.members(string(args[0])) {
+			members = append(members, []byte(member))
+		}
+		return members
+	case "PEXPIRE":
+		// only sets can expire this way, with the NX and GT options of redis 7
+		if len(args) != 2 && len(args) != 3 {
+			return redisError("ERR wrong number of arguments for 'pexpire' command")
+		}
+		key := string(args[0])
+		px, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return redisError("ERR value is not an integer or out of range")
+		}
+		if s.members(key) == nil {
+			return int64(0)
+		}
+		expires := time.Now().Add(time.Duration(px) * time.Millisecond)
+		current, volatile := s.expires[key]
+		if len(args) == 3 {
+			switch strings.ToUpper(string(args[2])) {
+			case "NX":
+				if volatile {
+					return int64(0)
+				}
+			case "GT":
+				if !volatile || !expires.After(current) {
+					return int64(0)
+				}
+			default:
+				return redisError("ERR unsupported option " + string(args[2]))
+			}
+		}
+		s.expires[key] = expires
+		return int64(1)
+	case "PTTL":
+		if len(args) != 1 {
+			return redisError("ERR wrong number of arguments for 'pttl' command")
+		}
+		key := string(args[0])
+		if s.members(key) == nil && s.get(key) == nil {
+			return int64(-2)
+		}
+		if expires, found := s.expires[key]; found {
+			return int64(time.Until(expires) / time.Millisecond)
+		}
+		return int64(-1)
+	case "SCAN":
+		// everything is returned in a single pass
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(string(args[i])) == "MATCH" {
+				pattern = string(args[i+1])
+			}
+		}
+		keys := make([]string, 0)
+		for key := range s.values {
+			if redisMatch(pattern, key) && s.get(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = []byte(key)
+		}
+		return []interface{}{[]byte("0"), values}
+	default:
+		return redisError("ERR unknown command '" + string(command[0]) + "'")
+	}
+}
+
+// get must be called with the lock held.
+func (s *redisTestServer) get(key string) interface{} {
+	value, found := s.values[key]
+	if !found {
+		return nil
+	}
+	if expires, found := s.expires[key]; found && time.Now().After(expires) {
+		delete(s.values, key)
+		delete(s.expires, key)
+		return nil
+	}
+	return value
+}
+
+// members must be called with the lock held.
+func (s *redisTestServer) members(key string) map[string]bool {
+	if _, found := s.sets[key]; !found {
+		return nil
+	}
+	if expires, found := s.expires[key]; found && time.Now().After(expires) {
+		delete(s.sets, key)
+		delete(s.expires, key)
+		return nil
+	}
+	return s.sets[key]
+}
+
+// redisMatch matches key against a glob pattern with *, ? and \ escapes.
+func redisMatch(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(key); i >= 0; i-- {
+				if redisMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		key = key[1:]
+	}
+	return len(key) == 0
+}
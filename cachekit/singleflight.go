@@ -0,0 +1,119 @@
+package cachekit
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// flightGroup combines concurrent loads of the same key into a single call.
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+
+	// refreshFailures holds when background refreshes of stale entries that failed may
+	// be tried again, by flight key.
+	refreshFailures map[string]time.Time
+}
+
+type flightCall struct {
+	done     chan struct{}
+	value    []byte
+	err      error
+	panicked *flightPanic
+}
+
+// flightPanic is what callers panic with when the load they waited for panicked, so the
+// stack of the load isn't lost.
+type flightPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *flightPanic) Error() string {
+	return fmt.Sprintf("cache load panicked: %v\n\n%s", p.value, p.stack)
+}
+
+func (p *flightPanic) Unwrap() error {
+	err, _ := p.value.(error)
+	return err
+}
+
+// detachedContext keeps the values of a context, like the logkit operation, but not its
+// cancellation or deadline.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall), refreshFailures: make(map[string]time.Time)}
+}
+
+// do runs fn once for all concurrent callers asking for the same prefix+key. The
+// load runs in its own goroutine, so every caller (including the one that started
+// it) can give up when its own ctx is cancelled without aborting the load for the others.
+// fn gets the first caller's ctx without its cancellation. A panic in fn is logged, as
+// every caller may have given up, and callers still waiting panic with it.
+func (g *flightGroup) do(ctx context.Context, prefix, key []byte, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if g == nil {
+		return fn(ctx)
+	}
+
+	flightKey := getFlightKey(prefix, key)
+
+	g.Lock()
+	call, found := g.calls[flightKey]
+	if !found {
+		call = g.start(ctx, flightKey, fn)
+	}
+	g.Unlock()
+
+	select {
+	case <-call.done:
+		if call.panicked != nil {
+			panic(call.panicked)
+		}
+		return call.value, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// start runs fn in its own goroutine as the load of flightKey. g must be locked.
+func (g *flightGroup) start(ctx context.Context, flightKey string, fn func(ctx context.Context) ([]byte, error)) *flightCall {
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[flightKey] = call
+	loadCtx := detachedContext{ctx}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				call.panicked = &flightPanic{value: r, stack: debug.Stack()}
+				logkit.Error(loadCtx, "Cache load panicked", logkit.String("panic", fmt.Sprint(r)), logkit.String("stack", string(call.panicked.stack)))
+			}
+			g.Lock()
+			delete(g.calls, flightKey)
+			g.Unlock()
+			close(call.done)
+		}()
+		call.value, call.err = fn(loadCtx)
+	}()
+	return call
+}
+
+func getFlightKey(prefix, key []byte) string {
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(prefix)+len(key))
+	buf = buf[:binary.PutUvarint(buf, uint64(len(prefix)))]
+	buf = append(buf, prefix...)
+	buf = append(buf, key...)
+	return string(buf)
+}
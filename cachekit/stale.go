@@ -0,0 +1,150 @@
+package cachekit
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// staleHeader marks entries written by GetStaleFuncErr. It is followed by the
+// soft expiry (unix nanoseconds, 0 = never stale) and then the value itself.
+var staleHeader = []byte{0, 255, 2, 7, 31, 6}
+
+const staleHeaderSize = 6 + 8
+
+// staleRefreshBackoff is how long a stale entry is served without trying to refresh it
+// again after a background refresh failed.
+const staleRefreshBackoff = 5 * time.Second
+
+// GetStaleFuncErr is like GetFuncErr, but entries have both a soft and a hard ttl.
+// Before softTTL has passed the cached value is returned as is. Between softTTL and
+// hardTTL the stale value is returned right away and f is called in the background to
+// refresh it. If that refresh fails, the stale value is kept and served until hardTTL,
+// and the next refresh is tried after a few seconds. After hardTTL the entry is gone and
+// the caller waits for f like with GetFuncErr.
+//
+// Background refreshes run after the call has returned, so f should not use the caller's
+// context.
+//
+// Entries are stored with a small header holding the soft expiry, so keys used with
+// GetStaleFuncErr should not be read with Get or GetFunc.
+func (c Cache) GetStaleFuncErr(ctx context.Context, key []byte, softTTL, hardTTL time.Duration, f func(key []byte) ([]byte, error)) ([]byte, error) {
+	load := func(ctx context.Context) ([]byte, error) {
+		val, err := f(key)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			val = nilValue
+		}
+		c.cacheStore.set(ctx, key, encodeStaleEntry(val, softTTL), hardTTL)
+		c.flights.refreshed(c.prefix, key)
+		return val, nil
+	}
+
+	val, softExpires, found := decodeStaleEntry(c.get(ctx, key))
+	if !found {
+		var err error
+		val, err = c.flights.do(ctx, c.prefix, key, load)
+		if err != nil {
+			return nil, err
+		}
+	} else if softExpires != 0 && softExpires < time.Now().UnixNano() {
+		// the refresh outlives the caller, so it doesn't use its context
+		c.flights.refresh(context.Background(), c.prefix, key, time.Now(), func(ctx context.Context) ([]byte, error) {
+			ctx, done := logkit.Operation(ctx, "cache.refresh", logkit.Bytes("key", key))
+			defer done()
+			val, err := load(ctx)
+			if err != nil {
+				c.flights.refreshFailed(c.prefix, key, time.Now().Add(staleRefreshBackoff))
+				logkit.Warn(ctx, "Error refreshing stale cache entry, keeping stale value", logkit.Err(err))
+			}
+			return val, err
+		})
+	}
+
+	if isNil(val) {
+		return nil, nil
+	}
+	return val, nil
+}
+
+// refresh starts fn in the background to refresh a stale entry, unless a load of the key
+// is already in flight or a refresh failed recently. Both are checked under the lock, so
+// concurrent stale reads start a single refresh between them.
+func (g *flightGroup) refresh(ctx context.Context, prefix, key []byte, now time.Time, fn func(ctx context.Context) ([]byte, error)) {
+	if g == nil {
+		go fn(ctx)
+		return
+	}
+	flightKey := getFlightKey(prefix, key)
+
+	g.Lock()
+	defer g.Unlock()
+	if _, found := g.calls[flightKey]; found {
+		return
+	}
+	if retry, found := g.refreshFailures[flightKey]; found && !now.After(retry) {
+		return
+	}
+	g.start(ctx, flightKey, fn)
+}
+
+func (g *flightGroup) refreshFailed(prefix, key []byte, retry time.Time) {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+
+	// forget keys that may be refreshed again, so failures of keys that aren't read
+	// anymore don't pile up
+	now := time.Now()
+	for flightKey, at := range g.refreshFailures {
+		if now.After(at) {
+			delete(g.refreshFailures, flightKey)
+		}
+	}
+	g.refreshFailures[getFlightKey(prefix, key)] = retry
+}
+
+func (g *flightGroup) refreshed(prefix, key []byte) {
+	if g == nil {
+		return
+	}
+	g.Lock()
+	defer g.Unlock()
+	if len(g.refreshFailures) > 0 {
+		delete(g.refreshFailures, getFlightKey(prefix, key))
+	}
+}
+
+func encodeStaleEntry(value []byte, softTTL time.Duration) []byte {
+	var softExpires int64
+	if softTTL > 0 {
+		softExpires = time.Now().Add(softTTL).UnixNano()
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, staleHeaderSize+len(value)))
+	buf.Write(staleHeader)
+	binary.Write(buf, binary.LittleEndian, softExpires)
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// decodeStaleEntry splits a stored entry into value and soft expiry. Values that were
+// not written by GetStaleFuncErr are returned as is and never go stale.
+func decodeStaleEntry(entry []byte) (value []byte, softExpires int64, found bool) {
+	if entry == nil {
+		return nil, 0, false
+	}
+	if len(entry) < staleHeaderSize || !bytes.Equal(entry[:len(staleHeader)], staleHeader) {
+		return entry, 0, true
+	}
+
+	softExpires = int64(binary.LittleEndian.Uint64(entry[len(staleHeader):staleHeaderSize]))
+	return entry[staleHeaderSize:], softExpires, true
+}
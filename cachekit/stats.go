@@ -0,0 +1,374 @@
+package cachekit
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets in LatencyHistogram.
+var latencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// Store is implemented by all cache stores, so they can be monitored and managed
+// by AdminHandler and metricskit.
+type Store interface {
+	CacheStats() CacheStats
+	FlushPrefix(ctx context.Context, prefix string)
+}
+
+// EvictingStore is implemented by stores that evict in the background, and can be
+// asked to run an eviction pass right away.
+type EvictingStore interface {
+	Store
+	TriggerEviction(ctx context.Context)
+}
+
+// CacheStats are the statistics of a store, and of each prefix used since it was opened.
+type CacheStats struct {
+	EstimatedSize  int64 `json:"estimatedSize"`
+	EstimatedCount int64 `json:"estimatedCount"`
+	Evictions      int64 `json:"evictions"`
+
+	// EstimatedLogicalSize is the size of the values before compression. It is the same
+	// as EstimatedSize for stores that don't compress.
+	EstimatedLogicalSize int64 `json:"estimatedLogicalSize"`
+
+	Prefixes []PrefixStats `json:"prefixes"`
+}
+
+// PrefixStats are the statistics of a single prefix. Stores don't know which prefix
+// an entry belongs to, so EstimatedSize is the store's size split by bytes written.
+type PrefixStats struct {
+	Prefix        string `json:"prefix"`
+	EstimatedSize int64  `json:"estimatedSize"`
+
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Sets    int64 `json:"sets"`
+	Removes int64 `json:"removes"`
+
+	ReadBytes    int64 `json:"readBytes"`
+	WrittenBytes int64 `json:"writtenBytes"`
+
+	GetLatency LatencyHistogram `json:"-"`
+	SetLatency LatencyHistogram `json:"-"`
+}
+
+// LatencyHistogram counts operations by duration. Counts[i] is the number of operations
+// that took at most Buckets[i].
+type LatencyHistogram struct {
+	Buckets []time.Duration
+	Counts  []int64
+	Count   int64
+	Sum     time.Duration
+}
+
+// cacheStats keeps the per-prefix counters of a store.
+type cacheStats struct {
+	sync.RWMutex
+	prefixes map[string]*prefixCounters
+}
+
+type prefixCounters struct {
+	hits         int64
+	misses       int64
+	sets         int64
+	removes      int64
+	readBytes    int64
+	writtenBytes int64
+	getLatency   latencyCounters
+	setLatency   latencyCounters
+}
+
+type latencyCounters struct {
+	buckets [len(latencyBuckets)]int64
+	count   int64
+	sum     int64
+}
+
+func newCacheStats() *cacheStats {
+	return &cacheStats{prefixes: make(map[string]*prefixCounters)}
+}
+
+func (s *cacheStats) prefix(prefix string) *prefixCounters {
+	s.RLock()
+	counters, found := s.prefixes[prefix]
+	s.RUnlock()
+	if found {
+		return counters
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if counters, found = s.prefixes[prefix]; !found {
+		counters = &prefixCounters{}
+		s.prefixes[prefix] = counters
+	}
+	return counters
+}
+
+// cacheStats returns the store stats with the prefix stats filled in.
+func (s *cacheStats) cacheStats(estimatedSize, estimatedCount, evictions int64) CacheStats {
+	s.RLock()
+	prefixes := make([]PrefixStats, 0, len(s.prefixes))
+	for prefix, counters := range s.prefixes {
+		prefixes = append(prefixes, counters.stats(prefix))
+	}
+	s.RUnlock()
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Prefix < prefixes[j].Prefix })
+
+	var written int64
+	for _, p := range prefixes {
+		written += p.WrittenBytes
+	}
+	if written > 0 {
+		for i := range prefixes {
+			prefixes[i].EstimatedSize = int64(float64(estimatedSize) * float64(prefixes[i].WrittenBytes) / float64(written))
+		}
+	}
+
+	return CacheStats{
+		EstimatedSize:        estimatedSize,
+		EstimatedCount:       estimatedCount,
+		Evictions:            evictions,
+		EstimatedLogicalSize: estimatedSize,
+		Prefixes:             prefixes,
+	}
+}
+
+// estimateLogicalSize scales the size on disk by how much compression has shrunk the
+// values written so far.
+func estimateLogicalSize(size, writtenBytes, logicalWrittenBytes int64) int64 {
+	if writtenBytes <= 0 {
+		return size
+	}
+	return int64(float64(size) * float64(logicalWrittenBytes) / float64(writtenBytes))
+}
+
+func (s *cacheStats) writtenBytes() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	var written int64
+	for _, counters := range s.prefixes {
+		written += atomic.LoadInt64(&counters.writtenBytes)
+	}
+	return written
+}
+
+func (c *prefixCounters) stats(prefix string) PrefixStats {
+	return PrefixStats{
+		Prefix:       prefix,
+		Hits:         atomic.LoadInt64(&c.hits),
+		Misses:       atomic.LoadInt64(&c.misses),
+		Sets:         atomic.LoadInt64(&c.sets),
+		Removes:      atomic.LoadInt64(&c.removes),
+		ReadBytes:    atomic.LoadInt64(&c.readBytes),
+		WrittenBytes: atomic.LoadInt64(&c.writtenBytes),
+		GetLatency:   c.getLatency.histogram(),
+		SetLatency:   c.setLatency.histogram(),
+	}
+}
+
+func (c *prefixCounters) get(start time.Time, values ...[]byte) {
+	c.getLatency.observe(time.Since(start))
+	for _, value := range values {
+		if value == nil {
+			atomic.AddInt64(&c.misses, 1)
+		} else {
+			atomic.AddInt64(&c.hits, 1)
+			atomic.AddInt64(&c.readBytes, int64(len(value)))
+		}
+	}
+}
+
+func (c *prefixCounters) set(start time.Time, sets int, size int) {
+	c.setLatency.observe(time.Since(start))
+	atomic.AddInt64(&c.sets, int64(sets))
+	atomic.AddInt64(&c.writtenBytes, int64(size))
+}
+
+func (l *latencyCounters) observe(d time.Duration) {
+	for i, bucket := range latencyBuckets {
+		if d <= bucket {
+			atomic.AddInt64(&l.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&l.count, 1)
+	atomic.AddInt64(&l.sum, int64(d))
+}
+
+func (l *latencyCounters) histogram() LatencyHistogram {
+	h := LatencyHistogram{
+		Buckets: latencyBuckets[:],
+		Counts:  make([]int64, len(latencyBuckets)),
+		Count:   atomic.LoadInt64(&l.count),
+		Sum:     time.Duration(atomic.LoadInt64(&l.sum)),
+	}
+	var cumulative int64
+	for i := range latencyBuckets {
+		cumulative += atomic.LoadInt64(&l.buckets[i])
+		h.Counts[i] = cumulative
+	}
+	return h
+}
+
+// statsStore counts the operations on a store.
+type statsStore struct {
+	store    invalidatingStore
+	counters *prefixCounters
+}
+
+func newStatsStore(store invalidatingStore, stats *cacheStats, prefix string) statsStore {
+	return statsStore{store: store, counters: stats.prefix(prefix)}
+}
+
+func (s statsStore) get(ctx context.Context, key []byte) []byte {
+	start := time.Now()
+	value := s.store.get(ctx, key)
+	s.counters.get(start, value)
+	return value
+}
+
+func (s statsStore) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
+	start := time.Now()
+	s.store.set(ctx, key, value, ttl)
+	s.counters.set(start, 1, len(value))
+}
+
+func (s statsStore) remove(ctx context.Context, key []byte) {
+	s.store.remove(ctx, key)
+	atomic.AddInt64(&s.counters.removes, 1)
+}
+
+func (s statsStore) getTagged(ctx context.Context, key []byte) ([]byte, []string) {
+	start := time.Now()
+	value, tags := s.store.getTagged(ctx, key)
+	s.counters.get(start, value)
+	return value, tags
+}
+
+func (s statsStore) setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string) {
+	start := time.Now()
+	s.store.setTagged(ctx, key, value, ttl, tags)
+	s.counters.set(start, 1, len(value))
+}
+
+func (s statsStore) getTTL(ctx context.Context, key []byte) ([]byte, []string, time.Duration) {
+	store, ok := s.store.(ttlStore)
+	if !ok {
+		value, tags := s.getTagged(ctx, key)
+		return value, tags, 0
+	}
+
+	start := time.Now()
+	value, tags, ttl := store.getTTL(ctx, key)
+	s.counters.get(start, value)
+	return value, tags, ttl
+}
+
+// getMulti counts each key, and the whole batch as one latency observation.
+func (s statsStore) getMulti(ctx context.Context, keys [][]byte) [][]byte {
+	start := time.Now()
+	values := getMultiFrom(ctx, s.store, keys)
+	s.counters.get(start, values...)
+	return values
+}
+
+func (s statsStore) setMulti(ctx context.Context, entries []Entry, ttl time.Duration) {
+	start := time.Now()
+	setMultiTo(ctx, s.store, entries, ttl)
+	size := 0
+	for _, entry := range entries {
+		size += len(entry.Value)
+	}
+	s.counters.set(start, len(entries), size)
+}
+
+func (s statsStore) invalidatePrefix(ctx context.Context) {
+	s.store.invalidatePrefix(ctx)
+}
+
+func (s statsStore) invalidateTag(ctx context.Context, tag string) {
+	s.store.invalidateTag(ctx, tag)
+}
+
+func (s statsStore) openReader(ctx context.Context, key []byte) io.ReadSeekCloser {
+	store, ok := s.store.(streamingStore)
+	if !ok {
+		return bufferedOpenReader(ctx, s, key)
+	}
+
+	start := time.Now()
+	reader := store.openReader(ctx, key)
+	s.counters.getLatency.observe(time.Since(start))
+	if reader == nil {
+		atomic.AddInt64(&s.counters.misses, 1)
+		return nil
+	}
+	atomic.AddInt64(&s.counters.hits, 1)
+	return statsReader{ReadSeekCloser: reader, counters: s.counters}
+}
+
+func (s statsStore) create(ctx context.Context, key []byte, ttl time.Duration) io.WriteCloser {
+	store, ok := s.store.(streamingStore)
+	if !ok {
+		return bufferedCreate(ctx, s, key, ttl)
+	}
+
+	writer := store.create(ctx, key, ttl)
+	if writer == nil {
+		return nil
+	}
+	return &statsWriter{WriteCloser: writer, counters: s.counters, start: time.Now()}
+}
+
+type statsReader struct {
+	io.ReadSeekCloser
+	counters *prefixCounters
+}
+
+func (r statsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeekCloser.Read(p)
+	atomic.AddInt64(&r.counters.readBytes, int64(n))
+	return n, err
+}
+
+type statsWriter struct {
+	io.WriteCloser
+	counters *prefixCounters
+	start    time.Time
+	size     int
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.size += n
+	return n, err
+}
+
+func (w *statsWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err == nil {
+		w.counters.set(w.start, 1, w.size)
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package cachekit
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCacheStats(t *testing.T) {
+	ctx := context.Background()
+
+	m := NewMemoryCache(1024 * 100)
+	c := m.GetCache("one")
+	c.Get(ctx, []byte("hello"))
+	c.Set(ctx, []byte("hello"), []byte("world"), 0)
+	c.Get(ctx, []byte("hello"))
+	c.Remove(ctx, []byte("hello"))
+	m.GetCache("two").Set(ctx, []byte("hello"), []byte("world!!!"), 0)
+
+	stats := m.CacheStats()
+	if len(stats.Prefixes) != 2 || stats.Prefixes[0].Prefix != "one" || stats.Prefixes[1].Prefix != "two" {
+		t.Errorf("Expected prefixes one and two, but got %+v", stats.Prefixes)
+		return
+	}
+	one := stats.Prefixes[0]
+	if one.Hits != 1 || one.Misses != 1 || one.Sets != 1 || one.Removes != 1 || one.ReadBytes != 5 || one.WrittenBytes != 5 {
+		t.Errorf("Unexpected stats for prefix one: %+v", one)
+		return
+	}
+	if one.GetLatency.Count != 2 || one.SetLatency.Count != 1 || one.GetLatency.Counts[len(one.GetLatency.Counts)-1] != 2 {
+		t.Errorf("Unexpected latencies for prefix one: %+v %+v", one.GetLatency, one.SetLatency)
+		return
+	}
+	if stats.EstimatedSize != 13 || one.EstimatedSize != 5 || stats.Prefixes[1].EstimatedSize != 8 {
+		t.Errorf("Unexpected sizes: %v, %v, %v", stats.EstimatedSize, one.EstimatedSize, stats.Prefixes[1].EstimatedSize)
+		return
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	ctx := context.Background()
+
+	path, err := ioutil.TempDir("", "diskcache2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dc2, err := NewDiskCache2(ctx, path, 1024*100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer dc2.Close()
+
+	memory := NewMemoryCache(1024 * 100)
+	memory.GetCache("one").Set(ctx, []byte("hello"), []byte("world"), 0)
+	dc2.GetCache(ctx, "two").Set(ctx, []byte("hello"), []byte("world"), 0)
+
+	handler := AdminHandler(map[string]Store{"memory": memory, "disk": dc2})
+	do := func(method string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// list stores and prefixes
+	w := do(http.MethodGet, nil)
+	var list []adminStoreStats
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(list) != 2 || list[0].Name != "disk" || list[1].Name != "memory" || list[1].Prefixes[0].Prefix != "one" {
+		t.Errorf("Unexpected store list: %s", w.Body.String())
+		return
+	}
+
+	// flush a prefix
+	if w := do(http.MethodPost, url.Values{"action": {"flush"}, "store": {"memory"}, "prefix": {"one"}}); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, but got %v", w.Code)
+		return
+	}
+	if v := memory.GetCache("one").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value after flushing")
+		return
+	}
+
+	// evict, only for stores that support it
+	if w := do(http.MethodPost, url.Values{"action": {"evict"}, "store": {"disk"}}); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, but got %v", w.Code)
+		return
+	}
+	if w := do(http.MethodPost, url.Values{"action": {"evict"}, "store": {"memory"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, but got %v", w.Code)
+		return
+	}
+	if w := do(http.MethodPost, url.Values{"action": {"evict"}, "store": {"missing"}}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, but got %v", w.Code)
+		return
+	}
+}
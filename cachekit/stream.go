@@ -0,0 +1,74 @@
+package cachekit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+)
+
+// streamingStore is implemented by stores that can read and write values without
+// holding them in memory, e.g. DiskCache2.
+type streamingStore interface {
+	openReader(ctx context.Context, key []byte) io.ReadSeekCloser
+	create(ctx context.Context, key []byte, ttl time.Duration) io.WriteCloser
+}
+
+// OpenReader returns a reader for the value cached for key, or nil on a miss. Stores
+// that support streaming (DiskCache2) read the value directly from disk, so large
+// values don't have to fit in memory. The caller must close the reader.
+func (c Cache) OpenReader(ctx context.Context, key []byte) io.ReadSeekCloser {
+	if store, ok := c.cacheStore.(streamingStore); ok {
+		return store.openReader(ctx, key)
+	}
+	return bufferedOpenReader(ctx, c.cacheStore, key)
+}
+
+// Create returns a writer for a new value for key. The value is cached when the writer
+// is closed, and discarded if any write failed. Stores that support streaming (DiskCache2)
+// write the value directly to disk; other stores buffer it in memory. Create returns nil
+// if the store could not prepare the write.
+func (c Cache) Create(ctx context.Context, key []byte, ttl time.Duration) io.WriteCloser {
+	if store, ok := c.cacheStore.(streamingStore); ok {
+		return store.create(ctx, key, ttl)
+	}
+	return bufferedCreate(ctx, c.cacheStore, key, ttl)
+}
+
+func bufferedOpenReader(ctx context.Context, store cacheStore, key []byte) io.ReadSeekCloser {
+	value := store.get(ctx, key)
+	if isNil(value) {
+		return nil
+	}
+	return nopSeekCloser{bytes.NewReader(value)}
+}
+
+func bufferedCreate(ctx context.Context, store cacheStore, key []byte, ttl time.Duration) io.WriteCloser {
+	return &bufferedCacheWriter{ctx: ctx, store: store, key: key, ttl: ttl}
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// bufferedCacheWriter collects a value in memory and sets it on Close.
+type bufferedCacheWriter struct {
+	bytes.Buffer
+	ctx    context.Context
+	store  cacheStore
+	key    []byte
+	ttl    time.Duration
+	closed bool
+}
+
+func (w *bufferedCacheWriter) Close() error {
+	if !w.closed {
+		w.closed = true
+		w.store.set(w.ctx, w.key, w.Bytes(), w.ttl)
+	}
+	return nil
+}
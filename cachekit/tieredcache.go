@@ -0,0 +1,138 @@
+package cachekit
+
+import (
+	"context"
+	"time"
+)
+
+// Tier is one level of a TieredCache.
+type Tier struct {
+	// GetCache returns the Cache for a prefix in this tier. DiskCache.GetCache and
+	// DiskCache2.GetCache can be used as is, use MemoryTier for a MemoryCache.
+	GetCache func(ctx context.Context, prefix string) *Cache
+
+	// MaxTTL caps the ttl of entries written to this tier, 0 means no cap. Entries
+	// promoted from a slower tier keep the time they have left there, capped by MaxTTL.
+	MaxTTL time.Duration
+}
+
+// MemoryTier returns a Tier backed by a MemoryCache.
+func MemoryTier(cache *MemoryCache, maxTTL time.Duration) Tier {
+	return Tier{
+		GetCache: func(ctx context.Context, prefix string) *Cache { return cache.GetCache(prefix) },
+		MaxTTL:   maxTTL,
+	}
+}
+
+// TieredCache chains a number of caches, fastest first. Reads fall through the tiers
+// and promote hits to the faster tiers, writes and removes go to every tier.
+type TieredCache struct {
+	tiers   []Tier
+	flights *flightGroup
+}
+
+func NewTieredCache(tiers ...Tier) *TieredCache {
+	return &TieredCache{
+		tiers:   tiers,
+		flights: newFlightGroup(),
+	}
+}
+
+func (t *TieredCache) GetCache(ctx context.Context, prefix string) *Cache {
+	store := tieredStore{
+		caches:  make([]*Cache, len(t.tiers)),
+		maxTTLs: make([]time.Duration, len(t.tiers)),
+	}
+	for i, tier := range t.tiers {
+		store.caches[i] = tier.GetCache(ctx, prefix)
+		store.maxTTLs[i] = tier.MaxTTL
+	}
+
+	return &Cache{
+		cacheStore: store,
+		flights:    t.flights,
+		prefix:     []byte(prefix),
+	}
+}
+
+type tieredStore struct {
+	caches  []*Cache
+	maxTTLs []time.Duration
+}
+
+func (s tieredStore) get(ctx context.Context, key []byte) []byte {
+	value, _ := s.getTagged(ctx, key)
+	return value
+}
+
+func (s tieredStore) set(ctx context.Context, key []byte, value []byte, ttl time.Duration) {
+	s.setTagged(ctx, key, value, ttl, nil)
+}
+
+func (s tieredStore) remove(ctx context.Context, key []byte) {
+	for _, cache := range s.caches {
+		cache.remove(ctx, key)
+	}
+}
+
+func (s tieredStore) getTagged(ctx context.Context, key []byte) ([]byte, []string) {
+	for i, cache := range s.caches {
+		var value []byte
+		var tags []string
+		var ttl time.Duration
+		known := i > 0 && knowsTTL(cache.cacheStore)
+		if known {
+			value, tags, ttl = cache.cacheStore.(ttlStore).getTTL(ctx, key)
+		} else if store, ok := cache.cacheStore.(invalidatingStore); ok {
+			value, tags = store.getTagged(ctx, key)
+		} else {
+			value = cache.get(ctx, key)
+		}
+
+		if value != nil {
+			// promote to the faster tiers with the time the entry has left, keeping the tags
+			// so InvalidateTag still finds them. Entries whose ttl is unknown aren't promoted,
+			// as they could outlive the slower copy.
+			if known {
+				for j := 0; j < i; j++ {
+					s.setTier(ctx, j, key, value, capTTL(ttl, s.maxTTLs[j]), tags)
+				}
+			}
+			return value, tags
+		}
+	}
+	return nil, nil
+}
+
+func (s tieredStore) setTagged(ctx context.Context, key []byte, value []byte, ttl time.Duration, tags []string) {
+	for i := range s.caches {
+		s.setTier(ctx, i, key, value, capTTL(ttl, s.maxTTLs[i]), tags)
+	}
+}
+
+func (s tieredStore) setTier(ctx context.Context, tier int, key []byte, value []byte, ttl time.Duration, tags []string) {
+	if store, ok := s.caches[tier].cacheStore.(invalidatingStore); ok {
+		store.setTagged(ctx, key, value, ttl, tags)
+	} else {
+		s.caches[tier].set(ctx, key, value, ttl)
+	}
+}
+
+func (s tieredStore) invalidatePrefix(ctx context.Context) {
+	for _, cache := range s.caches {
+		cache.InvalidatePrefix(ctx)
+	}
+}
+
+func (s tieredStore) invalidateTag(ctx context.Context, tag string) {
+	for _, cache := range s.caches {
+		cache.InvalidateTag(ctx, tag)
+	}
+}
+
+func capTTL(ttl time.Duration, maxTTL time.Duration) time.Duration {
+	if maxTTL > 0 && (ttl == 0 || ttl > maxTTL) {
+		return maxTTL
+	}
+	return ttl
+}
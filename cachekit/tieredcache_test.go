@@ -0,0 +1,127 @@
+package cachekit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+
+	// get a temporary directory
+	path, err := ioutil.TempDir("", "tieredcache")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.RemoveAll(path)
+
+	// memory in front of disk
+	memory := NewMemoryCache(1024 * 100)
+	disk, err := NewDiskCache2(ctx, path, 1024*100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer disk.Close()
+	c := NewTieredCache(MemoryTier(memory, time.Hour), Tier{GetCache: disk.GetCache})
+
+	// regular cache testing
+	if !cachetest(c.GetCache(ctx, "one"), c.GetCache(ctx, "two"), t) {
+		return
+	}
+
+	// concurrent loads
+	if !flighttest(c.GetCache(ctx, "one"), t) {
+		return
+	}
+
+	// batch gets and sets
+	if !multitest(c.GetCache(ctx, "six"), t) {
+		return
+	}
+
+	// prefix and tag invalidation
+	if !invalidatetest(c.GetCache(ctx, "four"), c.GetCache(ctx, "five"), t) {
+		return
+	}
+
+	// hits in the slow tier are promoted to the fast tier
+	disk.GetCache(ctx, "three").Set(ctx, []byte("hello"), []byte("disk"), 0)
+	if v := memory.GetCache("three").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value")
+		return
+	}
+	if v := c.GetCache(ctx, "three").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, []byte("disk")) {
+		t.Errorf("Expected 'disk', but got %v", v)
+		return
+	}
+	if v := memory.GetCache("three").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, []byte("disk")) {
+		t.Errorf("Expected promoted 'disk', but got %v", v)
+		return
+	}
+
+	// removes go to every tier
+	c.GetCache(ctx, "three").Remove(ctx, []byte("hello"))
+	if v := disk.GetCache(ctx, "three").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value")
+		return
+	}
+
+	// ttls are capped per tier
+	if ttl := capTTL(0, time.Hour); ttl != time.Hour {
+		t.Errorf("Expected 1h, but got %v", ttl)
+	}
+	if ttl := capTTL(time.Minute, time.Hour); ttl != time.Minute {
+		t.Errorf("Expected 1m, but got %v", ttl)
+	}
+	if ttl := capTTL(2*time.Hour, 0); ttl != 2*time.Hour {
+		t.Errorf("Expected 2h, but got %v", ttl)
+	}
+}
+
+func TestTieredCachePromotedExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	// get a temporary directory
+	path, err := ioutil.TempDir("", "tieredcache")
+	if err != nil {
+		t.Fail()
+	}
+	defer os.RemoveAll(path)
+
+	// a fast tier without a MaxTTL
+	memory := NewMemoryCache(1024 * 100)
+	disk, err := NewDiskCache2(ctx, path, 1024*100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer disk.Close()
+	c := NewTieredCache(MemoryTier(memory, 0), Tier{GetCache: disk.GetCache})
+
+	// a promoted entry expires with the slower copy
+	disk.GetCache(ctx, "one").Set(ctx, []byte("hello"), []byte("disk"), 2*time.Second)
+	if v := c.GetCache(ctx, "one").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, []byte("disk")) {
+		t.Errorf("Expected 'disk', but got %v", v)
+		return
+	}
+	if v := memory.GetCache("one").Get(ctx, []byte("hello")); !reflect.DeepEqual(v, []byte("disk")) {
+		t.Errorf("Expected promoted 'disk', but got %v", v)
+		return
+	}
+	time.Sleep(3 * time.Second)
+	if v := c.GetCache(ctx, "one").Get(ctx, []byte("hello")); v != nil {
+		t.Errorf("did not expect a value after the slow tier expired, got %v", v)
+	}
+
+	// entries without a ttl are promoted without one
+	disk.GetCache(ctx, "one").Set(ctx, []byte("forever"), []byte("disk"), 0)
+	c.GetCache(ctx, "one").Get(ctx, []byte("forever"))
+	if _, _, ttl := memory.GetCache("one").cacheStore.(ttlStore).getTTL(ctx, []byte("forever")); ttl != 0 {
+		t.Errorf("Expected no ttl, but got %v", ttl)
+	}
+}
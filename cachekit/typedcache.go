@@ -0,0 +1,111 @@
+package cachekit
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Status tells whether a TypedCache lookup found a value, a cached "not found", or nothing.
+type Status int
+
+const (
+	Miss     Status = iota // nothing cached for the key
+	Hit                    // a value is cached for the key
+	NotFound               // a "not found" is cached for the key
+)
+
+const (
+	typedEntryNotFound byte = 0
+	typedEntryValue    byte = 1
+)
+
+// TypedCache stores values of type T in a Cache, encoded with a Codec.
+type TypedCache[T any] struct {
+	cache *Cache
+	codec Codec
+}
+
+// NewTypedCache returns a TypedCache storing its values in cache.
+func NewTypedCache[T any](cache *Cache, codec Codec) *TypedCache[T] {
+	return &TypedCache[T]{cache: cache, codec: codec}
+}
+
+// Get returns the value cached for key, and whether it was a hit, a cached "not found" or a miss.
+func (c *TypedCache[T]) Get(ctx context.Context, key []byte) (value T, status Status, err error) {
+	return c.decode(c.cache.Get(ctx, key))
+}
+
+// Set caches value for key.
+func (c *TypedCache[T]) Set(ctx context.Context, key []byte, value T, ttl time.Duration) error {
+	entry, err := c.encode(value, true)
+	if err != nil {
+		return err
+	}
+	c.cache.Set(ctx, key, entry, ttl)
+	return nil
+}
+
+// SetNotFound caches a "not found" for key.
+func (c *TypedCache[T]) SetNotFound(ctx context.Context, key []byte, ttl time.Duration) {
+	c.cache.Set(ctx, key, []byte{typedEntryNotFound}, ttl)
+}
+
+// Remove removes whatever is cached for key.
+func (c *TypedCache[T]) Remove(ctx context.Context, key []byte) {
+	c.cache.Remove(ctx, key)
+}
+
+// GetOrLoad returns the value cached for key. On a miss, load is called and its result
+// (a value or, if found is false, a "not found") is cached. Concurrent misses for the
+// same key share a single call to load.
+func (c *TypedCache[T]) GetOrLoad(ctx context.Context, key []byte, ttl time.Duration, load func(key []byte) (value T, found bool, err error)) (T, bool, error) {
+	entry, err := c.cache.GetFuncErr(ctx, key, ttl, func(key []byte) ([]byte, error) {
+		value, found, err := load(key)
+		if err != nil {
+			return nil, err
+		}
+		return c.encode(value, found)
+	})
+	if err != nil {
+		var zero T
+		return zero, false, err
+	}
+
+	value, status, err := c.decode(entry)
+	return value, status == Hit, err
+}
+
+func (c *TypedCache[T]) encode(value T, found bool) ([]byte, error) {
+	if !found {
+		return []byte{typedEntryNotFound}, nil
+	}
+
+	data, err := c.codec.Encode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := make([]byte, 1+len(data))
+	entry[0] = typedEntryValue
+	copy(entry[1:], data)
+	return entry, nil
+}
+
+func (c *TypedCache[T]) decode(entry []byte) (value T, status Status, err error) {
+	if len(entry) == 0 {
+		return value, Miss, nil
+	}
+
+	switch entry[0] {
+	case typedEntryNotFound:
+		return value, NotFound, nil
+	case typedEntryValue:
+		if err := c.codec.Decode(entry[1:], &value); err != nil {
+			return value, Miss, err
+		}
+		return value, Hit, nil
+	default:
+		return value, Miss, fmt.Errorf("unknown typed cache entry kind: %v", entry[0])
+	}
+}
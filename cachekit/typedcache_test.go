@@ -0,0 +1,79 @@
+package cachekit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oliverkofoed/gokit/testkit"
+)
+
+type typedTestUser struct {
+	Name string `protobuf:"1"`
+	Age  int64  `protobuf:"2"`
+}
+
+func TestTypedCache(t *testing.T) {
+	ctx := context.Background()
+	c := NewMemoryCache(1024 * 100)
+
+	for name, codec := range map[string]Codec{"gob": GobCodec, "json": JSONCodec, "protobuf": ProtobufCodec} {
+		users := NewTypedCache[typedTestUser](c.GetCache("users-"+name), codec)
+
+		// miss
+		_, status, err := users.Get(ctx, []byte("bob"))
+		testkit.NoError(t, err)
+		testkit.Equal(t, status, Miss)
+
+		// hit
+		testkit.NoError(t, users.Set(ctx, []byte("bob"), typedTestUser{Name: "Bob", Age: 42}, time.Hour))
+		user, status, err := users.Get(ctx, []byte("bob"))
+		testkit.NoError(t, err)
+		testkit.Equal(t, status, Hit)
+		testkit.Equal(t, user, typedTestUser{Name: "Bob", Age: 42})
+
+		// cached not found
+		users.SetNotFound(ctx, []byte("alice"), time.Hour)
+		_, status, err = users.Get(ctx, []byte("alice"))
+		testkit.NoError(t, err)
+		testkit.Equal(t, status, NotFound)
+
+		// load only on miss, and cache "not found" results too
+		calls := 0
+		load := func(key []byte) (typedTestUser, bool, error) {
+			calls++
+			if string(key) == "carl" {
+				return typedTestUser{Name: "Carl"}, true, nil
+			}
+			return typedTestUser{}, false, nil
+		}
+		for i := 0; i != 2; i++ {
+			user, found, err := users.GetOrLoad(ctx, []byte("carl"), time.Hour, load)
+			testkit.NoError(t, err)
+			testkit.Equal(t, found, true)
+			testkit.Equal(t, user.Name, "Carl")
+
+			_, found, err = users.GetOrLoad(ctx, []byte("dave"), time.Hour, load)
+			testkit.NoError(t, err)
+			testkit.Equal(t, found, false)
+		}
+		testkit.Equal(t, calls, 2)
+
+		// loader errors are not cached
+		_, _, err = users.GetOrLoad(ctx, []byte("eve"), time.Hour, func(key []byte) (typedTestUser, bool, error) {
+			return typedTestUser{}, false, errors.New("failed")
+		})
+		testkit.Error(t, err)
+		_, status, _ = users.Get(ctx, []byte("eve"))
+		testkit.Equal(t, status, Miss)
+	}
+
+	// pointer types
+	pointers := NewTypedCache[*typedTestUser](c.GetCache("pointers"), ProtobufCodec)
+	testkit.NoError(t, pointers.Set(ctx, []byte("bob"), &typedTestUser{Name: "Bob"}, time.Hour))
+	user, status, err := pointers.Get(ctx, []byte("bob"))
+	testkit.NoError(t, err)
+	testkit.Equal(t, status, Hit)
+	testkit.Equal(t, user.Name, "Bob")
+}
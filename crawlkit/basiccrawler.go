@@ -6,23 +6,21 @@ import (
 )
 
 func NewBasicCrawler() WebCrawler {
-	return &BasicCrawler{}
+	return &BasicCrawler{client: NewClient("")}
 }
 
 type BasicCrawler struct {
+	client *Client
 }
 
 func (c *BasicCrawler) Crawl(ctx context.Context, url string) (*http.Response, error) {
 	// download
-	response, err := http.Get(url)
-	if err != nil {
-		if response != nil && response.Body != nil {
-			response.Body.Close()
-		}
-		return nil, err
-	}
+	return c.client.Get(ctx, url)
+}
 
-	return response, nil
+// Client returns the client used to download urls, so it can be configured.
+func (c *BasicCrawler) Client() *Client {
+	return c.client
 }
 
 func (c *BasicCrawler) QueueSize() int {
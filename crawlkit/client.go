@@ -0,0 +1,266 @@
+package crawlkit
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/oliverkofoed/gokit/cachekit"
+)
+
+// RevalidatedHeader is set on responses that were served from the Client's cache after
+// the server answered 304 Not Modified.
+const RevalidatedHeader = "X-Crawlkit-Revalidated"
+
+// Client downloads urls for the crawlers. It sends a user agent, times out slow
+// requests, retries server errors with exponential backoff and revalidates responses it
+// has seen before. Set the fields before using the client.
+type Client struct {
+	UserAgent string
+
+	// Transport makes the requests; http.DefaultTransport if nil.
+	Transport http.RoundTripper
+
+	// Timeout limits each attempt, including reading the body.
+	Timeout time.Duration
+
+	// MaxRetries is how many times timeouts, dropped connections, 5xx and 429 responses
+	// are retried.
+	// The first retry waits Backoff, and every retry after that waits twice as long, up
+	// to MaxBackoff. A longer Retry-After from the server is honoured, unless it is
+	// longer than MaxBackoff, in which case the response is returned.
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Cache stores responses with an ETag or Last-Modified header for CacheTTL, so they
+	// can be fetched with conditional requests. Bodies larger than MaxCacheBodySize
+	// are not cached.
+	Cache            *cachekit.Cache
+	CacheTTL         time.Duration
+	MaxCacheBodySize int64
+
+	// Wait is called before every attempt, e.g. to rate limit requests per host.
+	Wait func(ctx context.Context, u *url.URL) error
+
+	// Throttle is called when a server responds with 429 or sends Retry-After, with the
+	// Retry-After duration or 0 if there was none.
+	Throttle func(u *url.URL, retryAfter time.Duration)
+}
+
+// NewClient returns a client with sensible defaults for crawling.
+func NewClient(userAgent string) *Client {
+	return &Client{
+		UserAgent:        userAgent,
+		Timeout:          30 * time.Second,
+		MaxRetries:       3,
+		Backoff:          time.Second,
+		MaxBackoff:       time.Minute,
+		CacheTTL:         7 * 24 * time.Hour,
+		MaxCacheBodySize: 10 * 1024 * 1024,
+	}
+}
+
+type cachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Get downloads rawUrl.
+func (c *Client) Get(ctx context.Context, rawUrl string) (*http.Response, error) {
+	var cached *cachedResponse
+	if c.Cache != nil {
+		cached = c.cached(ctx, rawUrl)
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		response, err := c.do(ctx, rawUrl, cached)
+
+		delay := backoff
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.MaxRetries || !retryable(err) {
+				return nil, err
+			}
+		} else if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+			retryAfter, found := parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+			if (found || response.StatusCode == http.StatusTooManyRequests) && c.Throttle != nil {
+				c.Throttle(response.Request.URL, retryAfter)
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+			if attempt >= c.MaxRetries || delay > c.MaxBackoff {
+				return response, nil
+			}
+
+			// discard the body, so the connection can be reused
+			_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+			response.Body.Close()
+		} else {
+			return c.cache(ctx, rawUrl, response, cached)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, rawUrl string, cached *cachedResponse) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.UserAgent != "" {
+		request.Header.Set("User-Agent", c.UserAgent)
+	}
+	if cached != nil {
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			request.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	if c.Wait != nil {
+		if err := c.Wait(ctx, request.URL); err != nil {
+			return nil, err
+		}
+	}
+
+	client := http.Client{Transport: c.Transport, Timeout: c.Timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		if response != nil && response.Body != nil {
+			response.Body.Close()
+		}
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (c *Client) cached(ctx context.Context, rawUrl string) *cachedResponse {
+	value := c.Cache.Get(ctx, []byte(rawUrl))
+	if value == nil {
+		return nil
+	}
+	cached := &cachedResponse{}
+	if err := gob.NewDecoder(bytes.NewReader(value)).Decode(cached); err != nil {
+		return nil
+	}
+	return cached
+}
+
+// cache serves 304 responses from the cache, and stores responses that can be revalidated.
+func (c *Client) cache(ctx context.Context, rawUrl string, response *http.Response, cached *cachedResponse) (*http.Response, error) {
+	if c.Cache == nil {
+		return response, nil
+	}
+
+	if response.StatusCode == http.StatusNotModified && cached != nil {
+		response.Body.Close()
+
+		// newer validators from the 304 replace the cached ones
+		for key, values := range response.Header {
+			cached.Header[key] = values
+		}
+		c.store(ctx, rawUrl, cached)
+
+		header := cached.Header.Clone()
+		header.Set(RevalidatedHeader, "1")
+		return &http.Response{
+			Status:        strconv.Itoa(cached.StatusCode) + " " + http.StatusText(cached.StatusCode),
+			StatusCode:    cached.StatusCode,
+			Proto:         response.Proto,
+			ProtoMajor:    response.ProtoMajor,
+			ProtoMinor:    response.ProtoMinor,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+			ContentLength: int64(len(cached.Body)),
+			Request:       response.Request,
+		}, nil
+	}
+
+	if response.StatusCode != http.StatusOK || (response.Header.Get("ETag") == "" && response.Header.Get("Last-Modified") == "") {
+		return response, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, c.MaxCacheBodySize+1))
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > c.MaxCacheBodySize {
+		// too large to cache, return what was read followed by the rest
+		response.Body = readCloser{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return response, nil
+	}
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(body))
+
+	c.store(ctx, rawUrl, &cachedResponse{StatusCode: response.StatusCode, Header: response.Header.Clone(), Body: body})
+	return response, nil
+}
+
+func (c *Client) store(ctx context.Context, rawUrl string, cached *cachedResponse) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cached); err == nil {
+		c.Cache.Set(ctx, []byte(rawUrl), buf.Bytes(), c.CacheTTL)
+	}
+}
+
+// retryable tells timeouts and dropped connections from errors that won't go away by
+// retrying, like bad urls, unknown hosts, certificate errors and missing fixtures.
+func retryable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or a date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			seconds = 0
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,204 @@
+package crawlkit
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/oliverkofoed/gokit/cachekit"
+)
+
+func TestClientConditionalGet(t *testing.T) {
+	var requests, notModified int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, "hello world")
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient("TestBot")
+	client.Cache = cachekit.NewMemoryCache(1024 * 1024).GetCache("crawl")
+
+	for i := 0; i < 3; i++ {
+		response, err := client.Get(ctx, server.URL)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK || string(body) != "hello world" {
+			t.Errorf("expected the cached response, got %v %q", response.StatusCode, body)
+			return
+		}
+		if revalidated := response.Header.Get(RevalidatedHeader) != ""; revalidated != (i > 0) {
+			t.Errorf("request %v: expected revalidated=%v", i, i > 0)
+		}
+	}
+
+	if requests != 3 || notModified != 2 {
+		t.Errorf("expected 3 requests of which 2 not modified, got %v and %v", requests, notModified)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient("TestBot")
+	client.Backoff = time.Millisecond
+
+	response, err := client.Get(ctx, server.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || requests != 3 {
+		t.Errorf("expected success after 3 requests, got %v after %v", response.StatusCode, requests)
+	}
+
+	// give up after MaxRetries
+	atomic.StoreInt64(&requests, -10)
+	client.MaxRetries = 2
+	response, err = client.Get(ctx, server.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable || requests != -7 {
+		t.Errorf("expected to give up after 3 requests, got %v after %v", response.StatusCode, requests+10)
+	}
+
+	// network errors are retried too
+	server.Close()
+	start := time.Now()
+	client.Backoff = 10 * time.Millisecond
+	if _, err := client.Get(ctx, server.URL); err == nil {
+		t.Errorf("expected an error from a closed server")
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("expected backoff between retries, but took %v", elapsed)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &net.DNSError{Err: "timeout", IsTimeout: true}}, true},
+		{&url.Error{Op: "Get", URL: "http://example.com", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, false},
+		{&url.Error{Op: "Get", URL: "ftp://example.com", Err: errors.New("unsupported protocol scheme \"ftp\"")}, false},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}, false},
+		{&MissingFixtureError{URL: "http://example.com"}, false},
+	}
+	for _, test := range tests {
+		if retryable(test.err) != test.retryable {
+			t.Errorf("expected retryable(%v) to be %v", test.err, test.retryable)
+		}
+	}
+
+	// errors that aren't retried return right away
+	client := NewClient("TestBot")
+	client.Backoff = time.Second
+	start := time.Now()
+	if _, err := client.Get(context.Background(), "ftp://example.com/"); err == nil {
+		t.Errorf("expected an error for an unsupported scheme")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected no retries, but took %v", elapsed)
+	}
+}
+
+func TestSiteCrawlerThrottle(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	crawler := NewSiteCrawler("TestBot", 100, 40)
+	crawler.Client().Backoff = time.Millisecond
+
+	// a Retry-After longer than MaxBackoff is returned to the caller
+	crawler.Client().MaxBackoff = 100 * time.Millisecond
+	response, err := crawler.Crawl(ctx, server.URL+"/page")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusTooManyRequests || requests != 1 {
+		t.Errorf("expected a 429 without retrying, got %v after %v", response.StatusCode, requests)
+	}
+
+	cfg := crawler.GetConfig(strings.Split(server.Listener.Addr().String(), ":")[0])
+	cfg.RLock()
+	maxRPS := cfg.MaxRPS
+	cfg.RUnlock()
+	if maxRPS != 20 {
+		t.Errorf("expected MaxRPS to be halved to 20, got %v", maxRPS)
+	}
+
+	// restored after Retry-After
+	time.Sleep(1100 * time.Millisecond)
+	cfg.RLock()
+	maxRPS = cfg.MaxRPS
+	cfg.RUnlock()
+	if maxRPS != 40 {
+		t.Errorf("expected MaxRPS to be restored to 40, got %v", maxRPS)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d, ok := parseRetryAfter("120", now); !ok || d != 2*time.Minute {
+		t.Errorf("expected 2m, got %v %v", d, ok)
+	}
+	if d, ok := parseRetryAfter(now.Add(time.Minute).Format(http.TimeFormat), now); !ok || d != time.Minute {
+		t.Errorf("expected 1m, got %v %v", d, ok)
+	}
+	if _, ok := parseRetryAfter("soon", now); ok {
+		t.Errorf("expected an invalid Retry-After to be ignored")
+	}
+}
@@ -0,0 +1,138 @@
+package crawlkit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// MissingFixtureError is returned by a Replayer for requests it has no fixture for.
+type MissingFixtureError struct {
+	Method string
+	URL    string
+}
+
+func (e *MissingFixtureError) Error() string {
+	return fmt.Sprintf("no fixture for %v %v", e.Method, e.URL)
+}
+
+// Recorder is an http.RoundTripper that saves every response to a fixture directory, so
+// a Replayer can serve it later. Fixtures are plain HTTP: the request followed by the
+// response, one file per method and url, in a directory per host.
+type Recorder struct {
+	dir       string
+	transport http.RoundTripper
+	lock      sync.Mutex
+}
+
+// NewRecorder returns a recorder saving to dir the responses from transport, or from
+// http.DefaultTransport if it is nil.
+func NewRecorder(dir string, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{dir: dir, transport: transport}
+}
+
+func (r *Recorder) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := r.transport.RoundTrip(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// the body is saved as it was read, so it is saved with its length
+	saved := *response
+	saved.Body = io.NopCloser(bytes.NewReader(body))
+	saved.ContentLength = int64(len(body))
+	saved.TransferEncoding = nil
+	if response.Uncompressed {
+		saved.Header = response.Header.Clone()
+		saved.Header.Del("Content-Encoding")
+	}
+
+	var fixture bytes.Buffer
+	savedRequest := request.Clone(request.Context())
+	savedRequest.Body = nil
+	savedRequest.ContentLength = 0
+	if err := savedRequest.Write(&fixture); err != nil {
+		return nil, err
+	}
+	if err := saved.Write(&fixture); err != nil {
+		return nil, err
+	}
+
+	path := fixturePath(r.dir, request)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, fixture.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return response, nil
+}
+
+// Replayer is an http.RoundTripper that serves the fixtures saved by a Recorder. Requests
+// without a fixture fail with a *MissingFixtureError.
+type Replayer struct {
+	dir string
+}
+
+func NewReplayer(dir string) *Replayer {
+	return &Replayer{dir: dir}
+}
+
+func (r *Replayer) RoundTrip(request *http.Request) (*http.Response, error) {
+	fixture, err := os.ReadFile(fixturePath(r.dir, request))
+	if os.IsNotExist(err) {
+		return nil, &MissingFixtureError{Method: request.Method, URL: request.URL.String()}
+	} else if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(fixture))
+	if _, err := http.ReadRequest(reader); err != nil {
+		return nil, fmt.Errorf("invalid fixture for %v: %v", request.URL, err)
+	}
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fixture for %v: %v", request.URL, err)
+	}
+	return response, nil
+}
+
+// fixturePath is where the fixture for a request is saved. The file name starts with the
+// path so fixtures are easy to find, and ends with a hash of the method and url.
+func fixturePath(dir string, request *http.Request) string {
+	hash := sha1.Sum([]byte(request.Method + " " + request.URL.String()))
+
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(request.URL.Path, "/"))
+	if len(name) > 60 {
+		name = name[:60]
+	}
+
+	host := strings.ReplaceAll(request.URL.Host, ":", "_")
+	return filepath.Join(dir, host, fmt.Sprintf("%v-%v.http", name, hex.EncodeToString(hash[:6])))
+}
@@ -0,0 +1,71 @@
+package crawlkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<title>Recorded %v</title>", r.URL.Path)
+	}))
+
+	dir, err := os.MkdirTemp("", "fixtures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	crawl := func(crawler *SiteCrawler, rawUrl string) (string, error) {
+		response, err := crawler.Crawl(ctx, rawUrl)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		return fmt.Sprintf("%v %s", response.StatusCode, body), err
+	}
+
+	// record
+	recording := NewSiteCrawler("TestBot", 1000, 1000)
+	recording.Client().Transport = NewRecorder(dir, nil)
+	recorded, err := crawl(recording, server.URL+"/page?x=1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server.Close()
+
+	// replay without the server
+	replaying := NewSiteCrawler("TestBot", 1000, 1000)
+	replaying.Client().Transport = NewReplayer(dir)
+	replayed, err := crawl(replaying, server.URL+"/page?x=1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if replayed != recorded || replayed != "200 <title>Recorded /page</title>" {
+		t.Errorf("expected the recorded response %q, got %q", recorded, replayed)
+	}
+
+	// missing fixtures fail without retrying
+	start := time.Now()
+	_, err = crawl(replaying, server.URL+"/page?x=2")
+	var missing *MissingFixtureError
+	if !errors.As(err, &missing) || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("expected a MissingFixtureError right away, got %v after %v", err, time.Since(start))
+	}
+}
@@ -0,0 +1,506 @@
+package crawlkit
+
+import (
+	"context"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/oliverkofoed/gokit/logkit"
+	"golang.org/x/net/html"
+)
+
+// FrontierItem is an url waiting to be crawled, and how many links away from a seed it is.
+type FrontierItem struct {
+	URL   string `json:"url"`
+	Depth int    `json:"depth"`
+}
+
+// FrontierResult is a crawled url. Page and Document are only set for HTML responses,
+// and the response body has been read into Body, decompressed, and closed.
+type FrontierResult struct {
+	URL       string
+	Depth     int
+	Response  *http.Response
+	Body      []byte
+	Page      *Page
+	Document  *html.Node
+	Canonical string
+	Links     []string
+	Err       error
+}
+
+// Frontier crawls recursively from seed urls. Links are normalised and each url is only
+// crawled once, hosts take turns so a large site doesn't starve the others, and results
+// are passed to the callback as they are crawled. Set the fields before calling Run.
+type Frontier struct {
+	// MaxDepth is how many links away from the seeds to crawl; 0 crawls without limit.
+	MaxDepth int
+
+	// SameDomain only follows links to the hosts of the seeds and their subdomains.
+	SameDomain bool
+
+	// Include and Exclude are matched against normalised urls. If Include is set, urls
+	// must match one of the patterns, and urls matching any of Exclude are skipped.
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+
+	// Concurrency is the number of urls crawled at the same time, and HostConcurrency
+	// the number of those that can be on the same host.
+	Concurrency     int
+	HostConcurrency int
+
+	// MaxBodySize is the largest response body read.
+	MaxBodySize int64
+
+	crawler  WebCrawler
+	store    FrontierStore
+	callback func(ctx context.Context, result *FrontierResult)
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	domains  map[string]bool
+	hosts    map[string]*frontierHost
+	urls     map[string]bool // the urls in the host queues
+	ring     []string
+	next     int
+	queued   int
+	inFlight int
+}
+
+type frontierHost struct {
+	queue    []FrontierItem
+	inFlight int
+}
+
+// NewFrontier returns a frontier crawling with crawler, usually a SiteCrawler. The store
+// keeps the seen urls and the queue; use a FileFrontierStore to resume after a restart.
+func NewFrontier(crawler WebCrawler, store FrontierStore, callback func(ctx context.Context, result *FrontierResult)) *Frontier {
+	f := &Frontier{
+		Concurrency:     8,
+		HostConcurrency: 2,
+		MaxBodySize:     10 * 1024 * 1024,
+		crawler:         crawler,
+		store:           store,
+		callback:        callback,
+		domains:         make(map[string]bool),
+		hosts:           make(map[string]*frontierHost),
+		urls:            make(map[string]bool),
+	}
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+// Add queues seed urls. Urls that were seen before are not queued again, so after a
+// restart the seeds can be added again to restore SameDomain scoping.
+func (f *Frontier) Add(ctx context.Context, seeds ...string) {
+	for _, seed := range seeds {
+		normalized, ok := NormalizeURL(nil, seed)
+		if !ok {
+			logkit.Warn(ctx, "Skipping invalid seed url", logkit.String("url", seed))
+			continue
+		}
+		if u, err := url.Parse(normalized); err == nil {
+			f.lock.Lock()
+			f.domains[strings.TrimPrefix(u.Hostname(), "www.")] = true
+			f.lock.Unlock()
+		}
+		f.enqueue(ctx, FrontierItem{URL: normalized})
+	}
+}
+
+// Run crawls until there is nothing left in the queue, or ctx is done. Urls that were
+// queued but not crawled before a restart are crawled first.
+func (f *Frontier) Run(ctx context.Context) error {
+	ctx, done := logkit.Operation(ctx, "frontier.run")
+	defer done()
+
+	pending, err := f.store.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	for _, item := range pending {
+		f.push(item)
+	}
+	f.lock.Unlock()
+
+	// wake up waiting workers when cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.lock.Lock()
+			f.cond.Broadcast()
+			f.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < f.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.work(ctx)
+		}()
+	}
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+func (f *Frontier) work(ctx context.Context) {
+	for {
+		f.lock.Lock()
+		var item FrontierItem
+		var host *frontierHost
+		for {
+			if ctx.Err() != nil {
+				f.lock.Unlock()
+				return
+			}
+			var ok bool
+			if item, host, ok = f.pop(); ok {
+				break
+			}
+			if f.queued == 0 && f.inFlight == 0 {
+				// done
+				f.cond.Broadcast()
+				f.lock.Unlock()
+				return
+			}
+			f.cond.Wait()
+		}
+		f.inFlight++
+		host.inFlight++
+		f.lock.Unlock()
+
+		f.crawl(ctx, item)
+
+		f.lock.Lock()
+		f.inFlight--
+		host.inFlight--
+		f.cond.Broadcast()
+		f.lock.Unlock()
+	}
+}
+
+// push adds item to the queue of its host, unless it is already queued, like seeds added
+// before Run that are also pending in the store. Call with the lock held.
+func (f *Frontier) push(item FrontierItem) {
+	if f.urls[item.URL] {
+		return
+	}
+	f.urls[item.URL] = true
+
+	name := ""
+	if u, err := url.Parse(item.URL); err == nil {
+		name = u.Host
+	}
+	host, found := f.hosts[name]
+	if !found {
+		host = &frontierHost{}
+		f.hosts[name] = host
+		f.ring = append(f.ring, name)
+	}
+	host.queue = append(host.queue, item)
+	f.queued++
+	f.cond.Signal()
+}
+
+// pop takes the next url from the next host in turn that isn't busy. Call with the
+// lock held.
+func (f *Frontier) pop() (FrontierItem, *frontierHost, bool) {
+	for i := 0; i < len(f.ring); i++ {
+		index := (f.next + i) % len(f.ring)
+		name := f.ring[index]
+		host := f.hosts[name]
+
+		if len(host.queue) == 0 && host.inFlight == 0 {
+			// forget hosts with nothing left to do
+			delete(f.hosts, name)
+			f.ring = append(f.ring[:index], f.ring[index+1:]...)
+			i--
+			continue
+		}
+
+		if len(host.queue) > 0 && host.inFlight < f.HostConcurrency {
+			item := host.queue[0]
+			host.queue = host.queue[1:]
+			delete(f.urls, item.URL)
+			f.queued--
+			f.next = index + 1
+			return item, host, true
+		}
+	}
+	return FrontierItem{}, nil, false
+}
+
+func (f *Frontier) enqueue(ctx context.Context, item FrontierItem) {
+	added, err := f.store.Add(ctx, item)
+	if err != nil {
+		logkit.Error(ctx, "Error adding url to frontier", logkit.String("url", item.URL), logkit.Err(err))
+		return
+	}
+	if added {
+		f.lock.Lock()
+		f.push(item)
+		f.lock.Unlock()
+	}
+}
+
+// markSeen records an url that was crawled under another url, like a redirect target
+// or a canonical url, so it isn't crawled again.
+func (f *Frontier) markSeen(ctx context.Context, rawUrl string, depth int) {
+	if added, err := f.store.Add(ctx, FrontierItem{URL: rawUrl, Depth: depth}); err == nil && added {
+		_ = f.store.Done(ctx, rawUrl)
+	}
+}
+
+// inScope checks the scoping rules for a normalised url.
+func (f *Frontier) inScope(rawUrl string) bool {
+	if f.SameDomain {
+		u, err := url.Parse(rawUrl)
+		if err != nil {
+			return false
+		}
+		host := strings.TrimPrefix(u.Hostname(), "www.")
+		f.lock.Lock()
+		found := f.domains[host]
+		for domain := range f.domains {
+			if found {
+				break
+			}
+			found = strings.HasSuffix(host, "."+domain)
+		}
+		f.lock.Unlock()
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Include) > 0 {
+		included := false
+		for _, pattern := range f.Include {
+			if pattern.MatchString(rawUrl) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, pattern := range f.Exclude {
+		if pattern.MatchString(rawUrl) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Frontier) crawl(ctx context.Context, item FrontierItem) {
+	ctx, done := logkit.Operation(ctx, "frontier.crawl", logkit.String("url", item.URL), logkit.Int("depth", item.Depth))
+	defer done()
+
+	result := &FrontierResult{URL: item.URL, Depth: item.Depth}
+	defer func() {
+		// urls cut short by shutdown stay pending, so they are crawled after a restart
+		if ctx.Err() == nil {
+			if err := f.store.Done(ctx, item.URL); err != nil {
+				logkit.Error(ctx, "Error marking url as crawled", logkit.Err(err))
+			}
+		}
+		f.callback(ctx, result)
+	}()
+
+	response, err := f.crawler.Crawl(ctx, item.URL)
+	if err != nil {
+		result.Err = err
+		return
+	}
+	defer response.Body.Close()
+	result.Response = response
+
+	result.Body, result.Err = readBody(response, f.MaxBodySize)
+	if result.Err != nil {
+		return
+	}
+
+	// the url we ended up at after redirects
+	base, _ := url.Parse(item.URL)
+	if response.Request != nil && response.Request.URL != nil {
+		base = response.Request.URL
+		if final, ok := NormalizeURL(nil, base.String()); ok && final != item.URL {
+			f.markSeen(ctx, final, item.Depth)
+		}
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return
+	}
+
+	result.Page, result.Err = parsePage(base, response.Header, result.Body)
+	if result.Err != nil {
+		return
+	}
+	result.Document = result.Page.Document
+
+	links, canonical, follow := extractLinks(result.Document, base)
+	result.Links = links
+	if canonical != "" {
+		result.Canonical = canonical
+		if canonical != item.URL {
+			f.markSeen(ctx, canonical, item.Depth)
+		}
+	}
+
+	if !follow || (f.MaxDepth > 0 && item.Depth >= f.MaxDepth) {
+		return
+	}
+	for _, link := range links {
+		if f.inScope(link) {
+			f.enqueue(ctx, FrontierItem{URL: link, Depth: item.Depth + 1})
+		}
+	}
+}
+
+// extractLinks returns the normalised links of a document to follow, its canonical url
+// and whether the page allows following its links at all.
+func extractLinks(doc *html.Node, base *url.URL) (links []string, canonical string, follow bool) {
+	follow = true
+	seen := make(map[string]bool)
+
+	// <base href> changes what links are relative to
+	var walkBase func(n *html.Node) bool
+	walkBase = func(n *html.Node) bool {
+		if n.Type == html.ElementNode && n.Data == "base" {
+			if href, ok := htmlAttr(n, "href"); ok {
+				if u, err := base.Parse(href); err == nil {
+					base = u
+				}
+				return true
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if walkBase(c) {
+				return true
+			}
+		}
+		return false
+	}
+	walkBase(doc)
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "a", "area":
+				href, ok := htmlAttr(n, "href")
+				rel, _ := htmlAttr(n, "rel")
+				if ok && !htmlHasToken(rel, "nofollow") {
+					if link, ok := NormalizeURL(base, href); ok && !seen[link] {
+						seen[link] = true
+						links = append(links, link)
+					}
+				}
+			case "link":
+				rel, _ := htmlAttr(n, "rel")
+				if href, ok := htmlAttr(n, "href"); ok && htmlHasToken(rel, "canonical") && canonical == "" {
+					canonical, _ = NormalizeURL(base, href)
+				}
+			case "meta":
+				name, _ := htmlAttr(n, "name")
+				content, _ := htmlAttr(n, "content")
+				if strings.EqualFold(name, "robots") && (htmlHasToken(content, "nofollow") || htmlHasToken(content, "none")) {
+					follow = false
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return links, canonical, follow
+}
+
+func htmlAttr(n *html.Node, key string) (string, bool) {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return strings.TrimSpace(attr.Val), true
+		}
+	}
+	return "", false
+}
+
+// htmlHasToken checks a space or comma separated attribute like rel for a token.
+func htmlHasToken(value, token string) bool {
+	for _, t := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' || r == '\t' }) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeURL resolves href against base (which may be nil) and returns it in a
+// canonical form, so the same page is recognised under different spellings: the
+// scheme and host are lowercased, default ports, fragments and utm_ tracking parameters
+// are removed, and the remaining query parameters are sorted by name. Only http and https urls
+// are accepted.
+func NormalizeURL(base *url.URL, href string) (string, bool) {
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", false
+	}
+	u := ref
+	if base != nil {
+		u = base.ResolveReference(ref)
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port != "" && !(u.Scheme == "http" && port == "80") && !(u.Scheme == "https" && port == "443") {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		// ipv6
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	u.User = nil
+	u.Fragment = ""
+	u.RawFragment = ""
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			if strings.HasPrefix(strings.ToLower(key), "utm_") {
+				delete(query, key)
+			}
+		}
+		// Encode sorts by key
+		u.RawQuery = query.Encode()
+	}
+	u.ForceQuery = false
+
+	return u.String(), true
+}
@@ -0,0 +1,225 @@
+package crawlkit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	base, _ := url.Parse("http://Example.com:80/dir/page.html?x=1")
+	tests := []struct {
+		href     string
+		expected string
+	}{
+		{"other.html", "http://example.com/dir/other.html"},
+		{"../up#section", "http://example.com/up"},
+		{"/?b=2&a=1&utm_source=mail", "http://example.com/?a=1&b=2"},
+		{"HTTPS://Example.com:443", "https://example.com/"},
+		{"https://example.com:8443/x", "https://example.com:8443/x"},
+		{"//cdn.example.com/file", "http://cdn.example.com/file"},
+		{"mailto:someone@example.com", ""},
+		{"javascript:void(0)", ""},
+	}
+
+	for _, test := range tests {
+		normalized, ok := NormalizeURL(base, test.href)
+		if normalized != test.expected || ok != (test.expected != "") {
+			t.Errorf("%v: expected %q, got %q", test.href, test.expected, normalized)
+		}
+	}
+}
+
+// testSite serves pages that link to each other. /a links to /b and /c, /b links to
+// /d, and /d links back to /a.
+func testSite() *httptest.Server {
+	pages := map[string]string{
+		"/": `<html><head><link rel="canonical" href="/index"></head><body>
+			<a href="/a">a</a> <a href="/a#again">a again</a>
+			<a href="http://external.example/">external</a>
+			<a href="/private" rel="nofollow">private</a></body></html>`,
+		"/a":     `<a href="b">b</a> <a href="/c?utm_source=test">c</a>`,
+		"/b":     `<base href="/sub/"><a href="d">d</a>`,
+		"/c":     `<meta name="robots" content="nofollow"><a href="/never">never</a>`,
+		"/sub/d": `<a href="/a">a</a> <a href="/skip/me">skip</a>`,
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, found := pages[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}))
+}
+
+func crawlTestSite(t *testing.T, server *httptest.Server, store FrontierStore, configure func(f *Frontier)) map[string]int {
+	var lock sync.Mutex
+	crawled := make(map[string]int)
+
+	crawler := NewSiteCrawler("TestBot", 1000, 1000)
+	frontier := NewFrontier(crawler, store, func(ctx context.Context, result *FrontierResult) {
+		if result.Err != nil {
+			t.Errorf("error crawling %v: %v", result.URL, result.Err)
+		}
+		lock.Lock()
+		path := result.URL[len(server.URL):]
+		if _, found := crawled[path]; found {
+			t.Errorf("%v was crawled more than once", path)
+		}
+		crawled[path] = result.Depth
+		lock.Unlock()
+	})
+	frontier.SameDomain = true
+	if configure != nil {
+		configure(frontier)
+	}
+
+	ctx := context.Background()
+	frontier.Add(ctx, server.URL+"/")
+	if err := frontier.Run(ctx); err != nil {
+		t.Error(err)
+	}
+	return crawled
+}
+
+func TestFrontier(t *testing.T) {
+	server := testSite()
+	defer server.Close()
+
+	crawled := crawlTestSite(t, server, NewMemoryFrontierStore(), func(f *Frontier) {
+		f.Exclude = []*regexp.Regexp{regexp.MustCompile("/skip/")}
+	})
+	expected := map[string]int{"/": 0, "/a": 1, "/b": 2, "/c": 2, "/sub/d": 3}
+	if fmt.Sprint(crawled) != fmt.Sprint(expected) {
+		t.Errorf("expected to crawl %v, got %v", expected, crawled)
+	}
+
+	// depth limit
+	crawled = crawlTestSite(t, server, NewMemoryFrontierStore(), func(f *Frontier) {
+		f.MaxDepth = 1
+	})
+	if len(crawled) != 2 {
+		t.Errorf("expected to crawl 2 pages with MaxDepth 1, got %v", crawled)
+	}
+}
+
+func TestFrontierResume(t *testing.T) {
+	server := testSite()
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "frontier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontier.log")
+
+	// urls queued before a restart are crawled after it
+	store, err := OpenFileFrontierStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(context.Background(), FrontierItem{URL: server.URL + "/b", Depth: 2})
+	store.Close()
+
+	store, err = OpenFileFrontierStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crawled := crawlTestSite(t, server, store, nil)
+	store.Close()
+	if _, found := crawled["/b"]; !found || len(crawled) != 6 {
+		t.Errorf("expected the queued url and the whole site to be crawled, got %v", crawled)
+	}
+
+	// and nothing is crawled twice
+	store, err = OpenFileFrontierStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	crawled = crawlTestSite(t, server, store, nil)
+	if len(crawled) != 0 {
+		var urls []string
+		for u := range crawled {
+			urls = append(urls, u)
+		}
+		sort.Strings(urls)
+		t.Errorf("expected nothing to be crawled again, got %v", urls)
+	}
+}
+
+func TestFrontierResumeCancelled(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.URL.Path == "/slow" {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprint(w, `<a href="/slow">slow</a>`)
+	}))
+	defer server.Close()
+
+	dir, err := os.MkdirTemp("", "frontier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frontier.log")
+
+	run := func(ctx context.Context) map[string]error {
+		store, err := OpenFileFrontierStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		var lock sync.Mutex
+		crawled := make(map[string]error)
+		frontier := NewFrontier(NewSiteCrawler("TestBot", 1000, 1000), store, func(ctx context.Context, result *FrontierResult) {
+			lock.Lock()
+			crawled[result.URL[len(server.URL):]] = result.Err
+			lock.Unlock()
+		})
+		frontier.Add(ctx, server.URL+"/")
+		frontier.Run(ctx)
+		return crawled
+	}
+
+	// shut down while /slow is being crawled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	crawled := run(ctx)
+	if err, found := crawled["/slow"]; !found || err == nil {
+		t.Errorf("expected the crawl of /slow to be cut short, got %v", crawled)
+	}
+
+	// it is crawled after a restart
+	close(release)
+	crawled = run(context.Background())
+	if err, found := crawled["/slow"]; !found || err != nil || len(crawled) != 1 {
+		t.Errorf("expected /slow to be crawled after a restart, got %v", crawled)
+	}
+}
@@ -0,0 +1,148 @@
+package crawlkit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FrontierStore keeps the urls a Frontier has seen, and which of them have been crawled.
+type FrontierStore interface {
+	// Add records a discovered url, and returns false if it was added before.
+	Add(ctx context.Context, item FrontierItem) (bool, error)
+
+	// Done records that an url has been crawled.
+	Done(ctx context.Context, url string) error
+
+	// Pending returns the urls that were added but not crawled, in the order they
+	// were added.
+	Pending(ctx context.Context) ([]FrontierItem, error)
+}
+
+// MemoryFrontierStore keeps the frontier in memory, so crawls start over after a restart.
+type MemoryFrontierStore struct {
+	sync.Mutex
+	items []FrontierItem
+	done  map[string]bool
+}
+
+func NewMemoryFrontierStore() *MemoryFrontierStore {
+	return &MemoryFrontierStore{done: make(map[string]bool)}
+}
+
+func (s *MemoryFrontierStore) Add(ctx context.Context, item FrontierItem) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.add(item), nil
+}
+
+func (s *MemoryFrontierStore) add(item FrontierItem) bool {
+	if _, found := s.done[item.URL]; found {
+		return false
+	}
+	s.done[item.URL] = false
+	s.items = append(s.items, item)
+	return true
+}
+
+func (s *MemoryFrontierStore) Done(ctx context.Context, url string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.done[url] = true
+	return nil
+}
+
+func (s *MemoryFrontierStore) Pending(ctx context.Context) ([]FrontierItem, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var pending []FrontierItem
+	items := s.items[:0]
+	for _, item := range s.items {
+		if !s.done[item.URL] {
+			pending = append(pending, item)
+			items = append(items, item)
+		}
+	}
+	// crawled items are only needed in the seen set
+	s.items = items
+	return pending, nil
+}
+
+// FileFrontierStore keeps the frontier in memory and appends every change to a file,
+// which is read back when the store is opened, so a crawl can resume after a restart.
+type FileFrontierStore struct {
+	memory *MemoryFrontierStore
+	file   *os.File
+}
+
+type frontierLogEntry struct {
+	FrontierItem
+	Done bool `json:"done,omitempty"`
+}
+
+// OpenFileFrontierStore opens the store at path, creating it if it doesn't exist.
+func OpenFileFrontierStore(path string) (*FileFrontierStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	memory := NewMemoryFrontierStore()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry frontierLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a partial line from a crash
+			continue
+		}
+		if entry.Done {
+			memory.done[entry.URL] = true
+		} else {
+			memory.add(entry.FrontierItem)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileFrontierStore{memory: memory, file: file}, nil
+}
+
+func (s *FileFrontierStore) Add(ctx context.Context, item FrontierItem) (bool, error) {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+	if !s.memory.add(item) {
+		return false, nil
+	}
+	return true, s.write(frontierLogEntry{FrontierItem: item})
+}
+
+func (s *FileFrontierStore) Done(ctx context.Context, url string) error {
+	s.memory.Lock()
+	defer s.memory.Unlock()
+	s.memory.done[url] = true
+	return s.write(frontierLogEntry{FrontierItem: FrontierItem{URL: url}, Done: true})
+}
+
+func (s *FileFrontierStore) Pending(ctx context.Context) ([]FrontierItem, error) {
+	return s.memory.Pending(ctx)
+}
+
+// write appends an entry to the file. Call with the lock held.
+func (s *FileFrontierStore) write(entry frontierLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileFrontierStore) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,311 @@
+package crawlkit
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// pages larger than this are cut off
+const pageMaxSize = 10 * 1024 * 1024
+
+// Page is the metadata of an HTML page. Urls are absolute.
+type Page struct {
+	// URL is where the page was fetched from, after redirects.
+	URL string
+
+	Title       string
+	Description string
+	Canonical   string
+	Language    string
+
+	OpenGraph OpenGraph
+	Twitter   TwitterCard
+
+	// JSONLD are the JSON-LD blocks of the page that are valid JSON.
+	JSONLD []json.RawMessage
+
+	// Favicon is the icon linked from the page, or /favicon.ico if there is none.
+	Favicon string
+	Feeds   []Feed
+
+	Document *html.Node
+}
+
+// OpenGraph are the og: properties of a page. Properties contains all of them, by name
+// without the og: prefix, including the ones that have fields.
+type OpenGraph struct {
+	Title       string
+	Description string
+	Type        string
+	URL         string
+	Image       string
+	SiteName    string
+	Locale      string
+	Properties  map[string]string
+}
+
+// TwitterCard are the twitter: meta tags of a page. Properties contains all of them, by
+// name without the twitter: prefix, including the ones that have fields.
+type TwitterCard struct {
+	Card        string
+	Site        string
+	Creator     string
+	Title       string
+	Description string
+	Image       string
+	Properties  map[string]string
+}
+
+// Feed is an RSS or Atom feed linked from a page.
+type Feed struct {
+	URL   string
+	Type  string
+	Title string
+}
+
+// ParsePage reads and closes the body of an HTML response and returns its metadata. The
+// body is decompressed if the server compressed it, and decoded to UTF-8 from the charset
+// in the Content-Type header, a BOM or a meta tag.
+func ParsePage(response *http.Response) (*Page, error) {
+	defer response.Body.Close()
+
+	body, err := readBody(response, pageMaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var u *url.URL
+	if response.Request != nil {
+		u = response.Request.URL
+	}
+	return parsePage(u, response.Header, body)
+}
+
+// readBody reads up to maxSize bytes of the body, decompressing it if the transport
+// didn't.
+func readBody(response *http.Response, maxSize int64) ([]byte, error) {
+	var r io.Reader = response.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	case "deflate":
+		// usually zlib, but some servers send raw deflate
+		compressed, err := io.ReadAll(io.LimitReader(r, maxSize))
+		if err != nil {
+			return nil, err
+		}
+		if zr, err := zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			defer zr.Close()
+			r = zr
+		} else {
+			fr := flate.NewReader(bytes.NewReader(compressed))
+			defer fr.Close()
+			r = fr
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %v", encoding)
+	}
+
+	return io.ReadAll(io.LimitReader(r, maxSize))
+}
+
+func parsePage(u *url.URL, header http.Header, body []byte) (*Page, error) {
+	r, err := charset.NewReader(bytes.NewReader(body), header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if u == nil {
+		u = &url.URL{}
+	}
+	page := &Page{
+		URL:      u.String(),
+		Document: doc,
+		OpenGraph: OpenGraph{
+			Properties: make(map[string]string),
+		},
+		Twitter: TwitterCard{
+			Properties: make(map[string]string),
+		},
+	}
+
+	base := u
+	resolve := func(href string) string {
+		if ref, err := base.Parse(strings.TrimSpace(href)); err == nil {
+			return ref.String()
+		}
+		return ""
+	}
+
+	var favicon string
+	var faviconRank int
+	var contentLanguage string
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "html":
+				if lang, ok := htmlAttr(n, "lang"); ok && page.Language == "" {
+					page.Language = lang
+				}
+			case "base":
+				if href, ok := htmlAttr(n, "href"); ok {
+					if ref, err := u.Parse(href); err == nil {
+						base = ref
+					}
+				}
+			case "title":
+				if page.Title == "" {
+					page.Title = htmlText(n)
+				}
+			case "meta":
+				name, _ := htmlAttr(n, "name")
+				property, _ := htmlAttr(n, "property")
+				httpEquiv, _ := htmlAttr(n, "http-equiv")
+				content, _ := htmlAttr(n, "content")
+				name, property = strings.ToLower(name), strings.ToLower(property)
+
+				switch {
+				case name == "description" && page.Description == "":
+					page.Description = content
+				case strings.EqualFold(httpEquiv, "content-language"):
+					contentLanguage = content
+				case strings.HasPrefix(property, "og:"):
+					setFirst(page.OpenGraph.Properties, property[3:], content)
+				case strings.HasPrefix(name, "twitter:"):
+					setFirst(page.Twitter.Properties, name[8:], content)
+				case strings.HasPrefix(property, "twitter:"):
+					// twitter falls back to property for og compatibility
+					setFirst(page.Twitter.Properties, property[8:], content)
+				}
+			case "link":
+				rel, _ := htmlAttr(n, "rel")
+				href, ok := htmlAttr(n, "href")
+				if !ok {
+					break
+				}
+				typ, _ := htmlAttr(n, "type")
+				switch {
+				case htmlHasToken(rel, "canonical") && page.Canonical == "":
+					page.Canonical = resolve(href)
+				case htmlHasToken(rel, "alternate") && (typ == "application/rss+xml" || typ == "application/atom+xml" || typ == "application/feed+json"):
+					title, _ := htmlAttr(n, "title")
+					page.Feeds = append(page.Feeds, Feed{URL: resolve(href), Type: typ, Title: title})
+				case htmlHasToken(rel, "icon") && faviconRank < 3:
+					favicon, faviconRank = resolve(href), 3
+				case htmlHasToken(rel, "apple-touch-icon") && faviconRank < 2:
+					favicon, faviconRank = resolve(href), 2
+				}
+			case "script":
+				if typ, _ := htmlAttr(n, "type"); strings.EqualFold(typ, "application/ld+json") {
+					if block := strings.TrimSpace(htmlRawText(n)); json.Valid([]byte(block)) {
+						page.JSONLD = append(page.JSONLD, json.RawMessage(block))
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if page.Language == "" {
+		page.Language = contentLanguage
+	}
+	if page.Language == "" {
+		page.Language = strings.TrimSpace(strings.Split(header.Get("Content-Language"), ",")[0])
+	}
+	if favicon == "" {
+		favicon = resolve("/favicon.ico")
+	}
+	page.Favicon = favicon
+
+	og := page.OpenGraph.Properties
+	page.OpenGraph.Title = og["title"]
+	page.OpenGraph.Description = og["description"]
+	page.OpenGraph.Type = og["type"]
+	page.OpenGraph.URL = og["url"]
+	page.OpenGraph.Image = og["image"]
+	if page.OpenGraph.Image == "" {
+		page.OpenGraph.Image = og["image:url"]
+	}
+	if page.OpenGraph.Image != "" {
+		page.OpenGraph.Image = resolve(page.OpenGraph.Image)
+	}
+	page.OpenGraph.SiteName = og["site_name"]
+	page.OpenGraph.Locale = og["locale"]
+
+	twitter := page.Twitter.Properties
+	page.Twitter.Card = twitter["card"]
+	page.Twitter.Site = twitter["site"]
+	page.Twitter.Creator = twitter["creator"]
+	page.Twitter.Title = twitter["title"]
+	page.Twitter.Description = twitter["description"]
+	page.Twitter.Image = twitter["image"]
+	if page.Twitter.Image == "" {
+		page.Twitter.Image = twitter["image:src"]
+	}
+	if page.Twitter.Image != "" {
+		page.Twitter.Image = resolve(page.Twitter.Image)
+	}
+
+	return page, nil
+}
+
+// setFirst sets a property unless it is set already, so the first of repeated
+// properties like og:image wins.
+func setFirst(properties map[string]string, key, value string) {
+	if _, found := properties[key]; !found {
+		properties[key] = value
+	}
+}
+
+// htmlText returns the text inside n with whitespace collapsed.
+func htmlText(n *html.Node) string {
+	var text strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// htmlRawText returns the text inside n as is.
+func htmlRawText(n *html.Node) string {
+	var text strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			text.WriteString(c.Data)
+		}
+	}
+	return text.String()
+}
@@ -0,0 +1,91 @@
+package crawlkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPage = `<!DOCTYPE html>
+<html lang="da">
+<head>
+	<meta charset="iso-8859-1">
+	<title>
+		Bl` + "\xe5" + `b` + "\xe6" + `r   og fl` + "\xf8" + `de
+	</title>
+	<meta name="description" content="A page about berries">
+	<link rel="canonical" href="/berries">
+	<link rel="apple-touch-icon" href="/touch.png">
+	<link rel="shortcut icon" href="/static/icon.png">
+	<link rel="alternate" type="application/rss+xml" title="News" href="/feed.rss">
+	<meta property="og:title" content="Berries">
+	<meta property="og:image" content="/images/berries.jpg">
+	<meta property="og:image" content="/images/second.jpg">
+	<meta property="og:site_name" content="Example">
+	<meta name="twitter:card" content="summary_large_image">
+	<meta name="twitter:site" content="@example">
+	<script type="application/ld+json">{"@type": "Article", "name": "Two  spaces"}</script>
+	<script type="application/ld+json">{ not json }</script>
+</head>
+<body><p>Hello</p></body>
+</html>`
+
+func TestParsePage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/gzip" {
+			// sent compressed even though the client didn't ask for it
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			fmt.Fprint(gz, testPage)
+			gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(buf.Bytes())
+			return
+		}
+		fmt.Fprint(w, testPage)
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/plain", "/gzip"} {
+		request, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, server.URL+path, nil)
+		request.Header.Set("Accept-Encoding", "gzip")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		page, err := ParsePage(response)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		expect := func(name, got, expected string) {
+			if got != expected {
+				t.Errorf("%v: expected %v %q, got %q", path, name, expected, got)
+			}
+		}
+		expect("title", page.Title, "Blåbær og fløde")
+		expect("description", page.Description, "A page about berries")
+		expect("canonical", page.Canonical, server.URL+"/berries")
+		expect("language", page.Language, "da")
+		expect("favicon", page.Favicon, server.URL+"/static/icon.png")
+		expect("og:title", page.OpenGraph.Title, "Berries")
+		expect("og:image", page.OpenGraph.Image, server.URL+"/images/berries.jpg")
+		expect("og:site_name", page.OpenGraph.SiteName, "Example")
+		expect("twitter:card", page.Twitter.Card, "summary_large_image")
+		expect("twitter:site", page.Twitter.Properties["site"], "@example")
+
+		if len(page.Feeds) != 1 || page.Feeds[0].URL != server.URL+"/feed.rss" || page.Feeds[0].Title != "News" {
+			t.Errorf("%v: unexpected feeds %+v", path, page.Feeds)
+		}
+		if len(page.JSONLD) != 1 || string(page.JSONLD[0]) != `{"@type": "Article", "name": "Two  spaces"}` {
+			t.Errorf("%v: unexpected JSON-LD %q", path, page.JSONLD)
+		}
+	}
+}
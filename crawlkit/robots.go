@@ -0,0 +1,276 @@
+package crawlkit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// how long robots.txt is cached for a host
+	robotsTTL = 24 * time.Hour
+
+	// how long to wait before fetching robots.txt again after it could not be fetched
+	robotsErrorTTL = 10 * time.Minute
+
+	// robots.txt is cut off after this many bytes, like most crawlers do
+	robotsMaxSize = 500 * 1024
+)
+
+// DisallowedError is returned by SiteCrawler.Crawl for urls that robots.txt doesn't
+// allow the crawler to fetch.
+type DisallowedError struct {
+	URL string
+}
+
+func (e *DisallowedError) Error() string {
+	return fmt.Sprintf("crawling %v is disallowed by robots.txt", e.URL)
+}
+
+// robots are the rules in robots.txt that apply to one user agent.
+type robots struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+
+	// sitemaps apply to all user agents
+	sitemaps []string
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+var (
+	robotsAllowAll    = &robots{}
+	robotsDisallowAll = &robots{rules: []robotsRule{{allow: false, pattern: "/"}}}
+)
+
+// allowed checks path (with the query string, if any) against the rules. The longest
+// matching pattern wins, and allow wins over disallow for patterns of the same length.
+func (r *robots) allowed(path string) bool {
+	if path == "/robots.txt" {
+		return true
+	}
+
+	allowed := true
+	matched := -1
+	for _, rule := range r.rules {
+		if len(rule.pattern) < matched || (len(rule.pattern) == matched && !rule.allow) {
+			continue
+		}
+		if robotsMatch(rule.pattern, path) {
+			allowed = rule.allow
+			matched = len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+// robotsMatch matches a path against a robots.txt pattern, where * matches any sequence
+// and a trailing $ anchors the pattern to the end of the path.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = pattern[:len(pattern)-1]
+	}
+
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(rest, part)
+		}
+		index := strings.Index(rest, part)
+		if index < 0 {
+			return false
+		}
+		rest = rest[index+len(part):]
+	}
+	return !anchored || rest == ""
+}
+
+// parseRobots reads the group of robots.txt that applies to userAgent: the group with
+// the longest user-agent token contained in userAgent, or the * group if there is none,
+// and the sitemaps listed in it.
+func parseRobots(r io.Reader, userAgent string) *robots {
+	userAgent = strings.ToLower(userAgent)
+
+	groups := make(map[string]*robots)
+	var sitemaps []string
+	var current []string
+	inRules := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, robotsMaxSize))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:colon]))
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch key {
+		case "user-agent":
+			// a user-agent after rules starts a new group
+			if inRules {
+				current = nil
+				inRules = false
+			}
+			agent := strings.ToLower(value)
+			current = append(current, agent)
+			if groups[agent] == nil {
+				groups[agent] = &robots{}
+			}
+		case "allow", "disallow":
+			inRules = true
+			if value == "" {
+				// an empty disallow allows everything
+				continue
+			}
+			for _, agent := range current {
+				groups[agent].rules = append(groups[agent].rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "sitemap":
+			if value != "" {
+				sitemaps = append(sitemaps, value)
+			}
+		case "crawl-delay":
+			inRules = true
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds <= 0 {
+				continue
+			}
+			for _, agent := range current {
+				groups[agent].crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	var best *robots
+	bestLength := 0
+	for agent, group := range groups {
+		if agent != "*" && len(agent) > bestLength && strings.Contains(userAgent, agent) {
+			best = group
+			bestLength = len(agent)
+		}
+	}
+	if best == nil {
+		best = groups["*"]
+	}
+	if best == nil {
+		best = robotsAllowAll
+	}
+
+	result := *best
+	result.sitemaps = sitemaps
+	return &result
+}
+
+// robots returns the robots.txt rules for the host of u, fetching them if they are not
+// cached. Fetches count against the host's rate limit. Hosts without a robots.txt allow
+// everything, and hosts where it could not be fetched disallow everything for a while.
+// Fetches cut short by ctx return ctx.Err().
+func (c *SiteCrawler) robots(ctx context.Context, u *url.URL, cfg *HostConfig) (*robots, error) {
+	cfg.robotsLock.Lock()
+	defer cfg.robotsLock.Unlock()
+
+	if cfg.robots != nil && time.Now().Before(cfg.robotsExpires) {
+		return cfg.robots, nil
+	}
+
+	robots, ttl, err := c.fetchRobots(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	cfg.robots = robots
+	cfg.robotsExpires = time.Now().Add(ttl)
+
+	// honour the crawl delay if it is slower than the configured rate
+	cfg.Lock()
+	cfg.CrawlDelay = robots.crawlDelay
+	cfg.applyLimit()
+	cfg.Unlock()
+
+	return robots, nil
+}
+
+// fetchRobots fetches robots.txt for the host of u, and returns the rules with how long
+// to keep them. The error is only for fetches cut short by ctx.
+func (c *SiteCrawler) fetchRobots(ctx context.Context, u *url.URL) (*robots, time.Duration, error) {
+	robotsURL := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/robots.txt"}).String()
+
+	response, err := c.client.Get(ctx, robotsURL)
+	var missing *MissingFixtureError
+	switch {
+	case ctx.Err() != nil:
+		if err == nil {
+			response.Body.Close()
+		}
+		return nil, 0, ctx.Err()
+	case errors.As(err, &missing):
+		// replaying without a recorded robots.txt, like a 404
+		return robotsAllowAll, robotsTTL, nil
+	case err != nil:
+		return robotsDisallowAll, robotsErrorTTL, nil
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return parseRobots(response.Body, c.userAgent), robotsTTL, nil
+	case response.StatusCode == http.StatusTooManyRequests:
+		// rate limited, not missing: like a server error, for as long as the server asks
+		if retryAfter, found := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); found && retryAfter > 0 {
+			return robotsDisallowAll, retryAfter, nil
+		}
+		return robotsDisallowAll, robotsErrorTTL, nil
+	case response.StatusCode >= 400 && response.StatusCode < 500:
+		// no robots.txt
+		return robotsAllowAll, robotsTTL, nil
+	default:
+		return robotsDisallowAll, robotsErrorTTL, nil
+	}
+}
+
+// robotsPath is the part of u that robots.txt rules are matched against.
+func robotsPath(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return path
+}
+
+// Allowed reports whether robots.txt allows the crawler to fetch rawUrl, fetching
+// robots.txt for the host if needed.
+func (c *SiteCrawler) Allowed(ctx context.Context, rawUrl string) (bool, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false, fmt.Errorf("bad url, could not parse. err: %v", err)
+	}
+	cfg := c.GetConfig(u.Hostname())
+	c.initLimiter(cfg)
+	robots, err := c.robots(ctx, u, cfg)
+	if err != nil {
+		return false, err
+	}
+	return robots.allowed(robotsPath(u)), nil
+}
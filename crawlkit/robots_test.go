@@ -0,0 +1,160 @@
+package crawlkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRobots = `
+# comments are ignored
+User-agent: *
+Disallow: /private
+Allow: /private/public
+Disallow: /*.pdf$
+
+User-agent: otherbot
+Disallow: /
+
+User-agent: mybot
+User-agent: thirdbot
+Disallow: /mybot-only
+Allow: /mybot-only/ok
+Crawl-delay: 0.5
+`
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		path      string
+		allowed   bool
+	}{
+		{"Somebot/1.0", "/", true},
+		{"Somebot/1.0", "/private", false},
+		{"Somebot/1.0", "/private/secret", false},
+		{"Somebot/1.0", "/private/public/page", true},
+		{"Somebot/1.0", "/files/report.pdf", false},
+		{"Somebot/1.0", "/files/report.pdf?download=1", true},
+		{"Somebot/1.0", "/robots.txt", true},
+		{"OtherBot/2.0", "/anything", false},
+		{"Mozilla/5.0 (compatible; MyBot/1.0)", "/private", true},
+		{"Mozilla/5.0 (compatible; MyBot/1.0)", "/mybot-only/page", false},
+		{"Mozilla/5.0 (compatible; MyBot/1.0)", "/mybot-only/ok/page", true},
+		{"ThirdBot", "/mybot-only", false},
+	}
+
+	for _, test := range tests {
+		robots := parseRobots(strings.NewReader(testRobots), test.userAgent)
+		if allowed := robots.allowed(test.path); allowed != test.allowed {
+			t.Errorf("%v %v: expected allowed=%v, got %v", test.userAgent, test.path, test.allowed, allowed)
+		}
+	}
+
+	if delay := parseRobots(strings.NewReader(testRobots), "mybot").crawlDelay; delay != 500*time.Millisecond {
+		t.Errorf("expected a crawl delay of 500ms, got %v", delay)
+	}
+	if robots := parseRobots(strings.NewReader(""), "mybot"); !robots.allowed("/private") {
+		t.Errorf("expected an empty robots.txt to allow everything")
+	}
+}
+
+func TestSiteCrawlerRobots(t *testing.T) {
+	var robotsFetches int64
+	var userAgent atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent.Store(r.UserAgent())
+		if r.URL.Path == "/robots.txt" {
+			atomic.AddInt64(&robotsFetches, 1)
+			fmt.Fprint(w, testRobots)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	crawler := NewSiteCrawler("MyBot/1.0", 100, 100)
+
+	response, err := crawler.Crawl(ctx, server.URL+"/page")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if ua := userAgent.Load(); ua != "MyBot/1.0" {
+		t.Errorf("expected the crawler's user agent to be sent, got %v", ua)
+	}
+
+	_, err = crawler.Crawl(ctx, server.URL+"/mybot-only/page")
+	var disallowed *DisallowedError
+	if !errors.As(err, &disallowed) || disallowed.URL != server.URL+"/mybot-only/page" {
+		t.Errorf("expected a DisallowedError, got %v", err)
+	}
+
+	if fetches := atomic.LoadInt64(&robotsFetches); fetches != 1 {
+		t.Errorf("expected robots.txt to be fetched once, got %v", fetches)
+	}
+
+	cfg := crawler.GetConfig(strings.Split(server.Listener.Addr().String(), ":")[0])
+	if cfg.CrawlDelay != 500*time.Millisecond {
+		t.Errorf("expected the crawl delay from robots.txt, got %v", cfg.CrawlDelay)
+	}
+	if limit := cfg.limiter.Limit(); limit != 2 {
+		t.Errorf("expected the crawl delay to limit the host to 2 rps, got %v", limit)
+	}
+}
+
+func TestSiteCrawlerRobotsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testRobots)
+	}))
+	defer server.Close()
+
+	// a cancelled fetch returns the ctx error, and isn't cached
+	crawler := NewSiteCrawler("MyBot/1.0", 100, 100)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if allowed, err := crawler.Allowed(cancelled, server.URL+"/page"); err != context.Canceled || allowed {
+		t.Errorf("expected a cancelled fetch to return context.Canceled, got %v %v", allowed, err)
+	}
+	if _, err := crawler.Crawl(cancelled, server.URL+"/page"); err != context.Canceled {
+		t.Errorf("expected a cancelled crawl to return context.Canceled, got %v", err)
+	}
+	if allowed, err := crawler.Allowed(context.Background(), server.URL+"/page"); err != nil || !allowed {
+		t.Errorf("expected robots.txt to be fetched again, got %v %v", allowed, err)
+	}
+
+	// a 429 disallows everything for as long as Retry-After asks
+	limited := int64(1)
+	limitedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt64(&limited, 1, 0) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, testRobots)
+	}))
+	defer limitedServer.Close()
+	throttled := NewSiteCrawler("MyBot/1.0", 100, 100)
+	throttled.Client().MaxRetries = 0
+	if allowed, err := throttled.Allowed(context.Background(), limitedServer.URL+"/page"); err != nil || allowed {
+		t.Errorf("expected a 429 to disallow, got %v %v", allowed, err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if allowed, err := throttled.Allowed(context.Background(), limitedServer.URL+"/page"); err != nil || !allowed {
+		t.Errorf("expected robots.txt to be fetched again after Retry-After, got %v %v", allowed, err)
+	}
+
+	// a missing fixture is like a missing robots.txt
+	replaying := NewSiteCrawler("MyBot/1.0", 100, 100)
+	replaying.Client().Transport = NewReplayer(t.TempDir())
+	if allowed, err := replaying.Allowed(context.Background(), server.URL+"/mybot-only/page"); err != nil || !allowed {
+		t.Errorf("expected a missing robots.txt fixture to allow everything, got %v %v", allowed, err)
+	}
+}
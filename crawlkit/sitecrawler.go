@@ -7,17 +7,25 @@ import (
 	"net/url"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// how long a host is throttled after a 429 without a Retry-After
+const throttleDuration = time.Minute
+
 func NewSiteCrawler(userAgent string, globalMaxRPS int, siteMaxRPS int) *SiteCrawler {
-	return &SiteCrawler{
+	c := &SiteCrawler{
 		userAgent:     userAgent,
 		globalLimiter: rate.NewLimiter(rate.Limit(globalMaxRPS), globalMaxRPS),
 		siteMaxRPS:    siteMaxRPS,
 		configs:       make(map[string]*HostConfig),
+		client:        NewClient(userAgent),
 	}
+	c.client.Wait = c.waitHost
+	c.client.Throttle = c.throttle
+	return c
 }
 
 type SiteCrawler struct {
@@ -27,13 +35,35 @@ type SiteCrawler struct {
 	configs       map[string]*HostConfig
 	globalLimiter *rate.Limiter
 	siteMaxRPS    int
-	unittests     bool
+	client        *Client
 }
 
 type HostConfig struct {
 	sync.RWMutex
 	MaxRPS  int
 	limiter *rate.Limiter
+
+	// CrawlDelay is the Crawl-delay from the host's robots.txt. It lowers the rate
+	// below MaxRPS when it is slower.
+	CrawlDelay time.Duration
+
+	robotsLock    sync.Mutex
+	robots        *robots
+	robotsExpires time.Time
+
+	// MaxRPS is lowered while the host asks us to back off
+	throttledUntil time.Time
+	unthrottledRPS int
+}
+
+// applyLimit updates the limiter after MaxRPS or CrawlDelay changed. Call with the lock held.
+func (cfg *HostConfig) applyLimit() {
+	limit, burst := rate.Limit(cfg.MaxRPS), cfg.MaxRPS
+	if cfg.CrawlDelay > 0 && rate.Every(cfg.CrawlDelay) < limit {
+		limit, burst = rate.Every(cfg.CrawlDelay), 1
+	}
+	cfg.limiter.SetLimit(limit)
+	cfg.limiter.SetBurst(burst)
 }
 
 func (c *SiteCrawler) GetConfig(hostname string) *HostConfig {
@@ -61,35 +91,89 @@ func (c *SiteCrawler) Crawl(ctx context.Context, rawUrl string) (*http.Response,
 
 	// get the config
 	cfg := c.GetConfig(u.Hostname())
+	c.initLimiter(cfg)
 
-	// pass the limit for global
-	c.globalLimiter.Wait(ctx)
+	// check robots.txt
+	robots, err := c.robots(ctx, u, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !robots.allowed(robotsPath(u)) {
+		return nil, &DisallowedError{URL: rawUrl}
+	}
 
-	// wait for the hostname specific limiter to allow
-	if cfg.limiter == nil {
+	// download url, passing the global and hostname specific limiters
+	return c.client.Get(ctx, rawUrl)
+}
+
+// Client returns the client used to download urls, so it can be configured. Set its
+// Transport to a Recorder or Replayer to test code that crawls without the network.
+func (c *SiteCrawler) Client() *Client {
+	return c.client
+}
+
+func (c *SiteCrawler) initLimiter(cfg *HostConfig) {
+	cfg.RLock()
+	initialized := cfg.limiter != nil
+	cfg.RUnlock()
+	if !initialized {
 		cfg.Lock()
 		if cfg.limiter == nil {
 			cfg.limiter = rate.NewLimiter(rate.Limit(cfg.MaxRPS), cfg.MaxRPS)
 		}
 		cfg.Unlock()
 	}
-	cfg.limiter.Wait(ctx)
+}
+
+func (c *SiteCrawler) wait(ctx context.Context, cfg *HostConfig) error {
+	// pass the limit for global
+	if err := c.globalLimiter.Wait(ctx); err != nil {
+		return err
+	}
+
+	// wait for the hostname specific limiter to allow
+	return cfg.limiter.Wait(ctx)
+}
+
+// waitHost is called by the client before every request, including retries.
+func (c *SiteCrawler) waitHost(ctx context.Context, u *url.URL) error {
+	cfg := c.GetConfig(u.Hostname())
+	c.initLimiter(cfg)
+	return c.wait(ctx, cfg)
+}
 
-	// test exit
-	if c.unittests {
-		return &http.Response{Status: rawUrl}, nil
+// throttle halves the rate for the host of u until it stops asking us to back off.
+func (c *SiteCrawler) throttle(u *url.URL, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = throttleDuration
 	}
 
-	// download url
-	response, err := http.Get(rawUrl)
-	if err != nil {
-		if response != nil && response.Body != nil {
-			response.Body.Close()
-		}
-		return nil, err
+	cfg := c.GetConfig(u.Hostname())
+	c.initLimiter(cfg)
+
+	cfg.Lock()
+	if cfg.throttledUntil.IsZero() {
+		cfg.unthrottledRPS = cfg.MaxRPS
 	}
+	if cfg.MaxRPS > 1 {
+		cfg.MaxRPS /= 2
+	}
+	until := time.Now().Add(retryAfter)
+	if until.After(cfg.throttledUntil) {
+		cfg.throttledUntil = until
+	}
+	cfg.applyLimit()
+	cfg.Unlock()
 
-	return response, nil
+	time.AfterFunc(retryAfter, func() {
+		cfg.Lock()
+		defer cfg.Unlock()
+		if !cfg.throttledUntil.IsZero() && !time.Now().Before(cfg.throttledUntil) {
+			cfg.MaxRPS = cfg.unthrottledRPS
+			cfg.throttledUntil = time.Time{}
+			cfg.applyLimit()
+		}
+	})
 }
 
 func (c *SiteCrawler) QueueSize() int {
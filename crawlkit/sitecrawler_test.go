@@ -3,6 +3,7 @@ package crawlkit
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -13,7 +14,9 @@ import (
 
 func TestSiteCrawler(t *testing.T) {
 	crawler := NewSiteCrawler("My UserAgent", 99, 3993)
-	crawler.unittests = true
+	crawler.Client().Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
 
 	start := time.Now()
 	end := start.Add(time.Second * 5)
@@ -77,3 +80,9 @@ func TestRateLimiter(t *testing.T) {
 	eventsPerSecond := float64(events) / float64(end.Sub(start).Seconds())
 	fmt.Println("events per second: ", eventsPerSecond)
 }
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,223 @@
+package crawlkit
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+const (
+	// sitemaps are at most 50MB uncompressed
+	sitemapMaxSize = 50 * 1024 * 1024
+
+	// sitemap indexes shouldn't nest, but some do
+	sitemapMaxDepth = 3
+)
+
+// SitemapEntry is an url listed in a sitemap. Priority is 0.5 if the sitemap doesn't set it.
+type SitemapEntry struct {
+	Loc        string
+	LastMod    time.Time
+	ChangeFreq string
+	Priority   float64
+
+	// Sitemap is the url of the sitemap the entry was listed in.
+	Sitemap string
+}
+
+// Sitemaps returns the sitemaps listed in robots.txt for the host of siteUrl, or
+// /sitemap.xml if robots.txt doesn't list any.
+func (c *SiteCrawler) Sitemaps(ctx context.Context, siteUrl string) ([]string, error) {
+	u, err := url.Parse(siteUrl)
+	if err != nil {
+		return nil, fmt.Errorf("bad url, could not parse. err: %v", err)
+	}
+	cfg := c.GetConfig(u.Hostname())
+	c.initLimiter(cfg)
+
+	robots, err := c.robots(ctx, u, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(robots.sitemaps) > 0 {
+		return robots.sitemaps, nil
+	}
+	return []string{(&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/sitemap.xml"}).String()}, nil
+}
+
+// WalkSitemaps calls fn for every url in the sitemaps of the host of siteUrl, following
+// sitemap indexes. Sitemaps are fetched with Crawl, so rate limits and robots.txt apply,
+// and may be gzipped. Sitemaps that can't be fetched or parsed are logged and skipped.
+// Walking stops at the first error from fn, which is returned.
+func (c *SiteCrawler) WalkSitemaps(ctx context.Context, siteUrl string, fn func(entry SitemapEntry) error) error {
+	ctx, done := logkit.Operation(ctx, "sitecrawler.walksitemaps", logkit.String("url", siteUrl))
+	defer done()
+
+	sitemaps, err := c.Sitemaps(ctx, siteUrl)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, sitemap := range sitemaps {
+		if err := c.walkSitemap(ctx, sitemap, 0, seen, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *SiteCrawler) walkSitemap(ctx context.Context, sitemap string, depth int, seen map[string]bool, fn func(entry SitemapEntry) error) error {
+	if seen[sitemap] || depth > sitemapMaxDepth {
+		return nil
+	}
+	seen[sitemap] = true
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	response, err := c.Crawl(ctx, sitemap)
+	if err != nil {
+		logkit.Warn(ctx, "Could not fetch sitemap", logkit.String("sitemap", sitemap), logkit.Err(err))
+		return nil
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		if response.StatusCode != http.StatusNotFound {
+			logkit.Warn(ctx, "Could not fetch sitemap", logkit.String("sitemap", sitemap), logkit.Int("status", response.StatusCode))
+		}
+		return nil
+	}
+
+	var children []string
+	err = parseSitemap(response.Body, func(entry SitemapEntry) error {
+		entry.Sitemap = sitemap
+		return fn(entry)
+	}, func(child string) {
+		children = append(children, child)
+	})
+	if err != nil {
+		if callbackErr, ok := err.(sitemapCallbackError); ok {
+			return callbackErr.err
+		}
+		logkit.Warn(ctx, "Could not parse sitemap", logkit.String("sitemap", sitemap), logkit.Err(err))
+	}
+
+	for _, child := range children {
+		if err := c.walkSitemap(ctx, child, depth+1, seen, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sitemapCallbackError wraps errors from the callback, so they can be told apart from
+// parse errors.
+type sitemapCallbackError struct {
+	err error
+}
+
+func (e sitemapCallbackError) Error() string {
+	return e.err.Error()
+}
+
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// parseSitemap reads a urlset or a sitemapindex, gzipped or not, calling entry for each
+// url in a urlset and child for each sitemap in an index.
+func parseSitemap(r io.Reader, entry func(entry SitemapEntry) error, child func(loc string)) error {
+	buffered := bufio.NewReader(r)
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = buffered
+	}
+
+	decoder := xml.NewDecoder(io.LimitReader(r, sitemapMaxSize))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "url":
+			var u sitemapURL
+			if err := decoder.DecodeElement(&u, &start); err != nil {
+				return err
+			}
+			if loc := strings.TrimSpace(u.Loc); loc != "" {
+				e := SitemapEntry{
+					Loc:        loc,
+					LastMod:    parseSitemapTime(u.LastMod),
+					ChangeFreq: strings.ToLower(strings.TrimSpace(u.ChangeFreq)),
+					Priority:   0.5,
+				}
+				if priority, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil {
+					e.Priority = priority
+				}
+				if err := entry(e); err != nil {
+					return sitemapCallbackError{err}
+				}
+			}
+		case "sitemap":
+			var s sitemapURL
+			if err := decoder.DecodeElement(&s, &start); err != nil {
+				return err
+			}
+			if loc := strings.TrimSpace(s.Loc); loc != "" {
+				child(loc)
+			}
+		}
+	}
+}
+
+// sitemap times are W3C datetimes, which can be just a date
+var sitemapTimeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+func parseSitemapTime(value string) time.Time {
+	value = strings.TrimSpace(value)
+	for _, format := range sitemapTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,111 @@
+package crawlkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWalkSitemaps(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	fmt.Fprint(gz, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://example.com/c</loc></url>
+</urlset>`)
+	gz.Close()
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprintf(w, "User-agent: *\nDisallow: /private\nSitemap: %v/index.xml\n", server.URL)
+		case "/index.xml":
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>%[1]v/urls.xml</loc></sitemap>
+	<sitemap><loc>%[1]v/urls.xml.gz</loc></sitemap>
+	<sitemap><loc>%[1]v/index.xml</loc></sitemap>
+</sitemapindex>`, server.URL)
+		case "/urls.xml":
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url>
+		<loc> http://example.com/a </loc>
+		<lastmod>2020-05-01</lastmod>
+		<changefreq>Daily</changefreq>
+		<priority>0.8</priority>
+	</url>
+	<url>
+		<loc>http://example.com/b</loc>
+		<lastmod>2020-05-01T10:30:00+02:00</lastmod>
+	</url>
+</urlset>`)
+		case "/urls.xml.gz":
+			w.Write(gzipped.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	crawler := NewSiteCrawler("TestBot", 1000, 1000)
+
+	var entries []SitemapEntry
+	err := crawler.WalkSitemaps(ctx, server.URL, func(entry SitemapEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("expected 3 entries, got %v", entries)
+		return
+	}
+	a, b, c := entries[0], entries[1], entries[2]
+	if a.Loc != "http://example.com/a" || a.ChangeFreq != "daily" || a.Priority != 0.8 || !a.LastMod.Equal(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected entry %+v", a)
+	}
+	if b.Priority != 0.5 || !b.LastMod.Equal(time.Date(2020, 5, 1, 8, 30, 0, 0, time.UTC)) || b.Sitemap != server.URL+"/urls.xml" {
+		t.Errorf("unexpected entry %+v", b)
+	}
+	if c.Loc != "http://example.com/c" || c.Sitemap != server.URL+"/urls.xml.gz" {
+		t.Errorf("unexpected gzipped entry %+v", c)
+	}
+
+	// errors from the callback stop the walk
+	stop := errors.New("stop")
+	count := 0
+	err = crawler.WalkSitemaps(ctx, server.URL, func(entry SitemapEntry) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("expected the walk to stop after the first entry, got %v after %v", err, count)
+	}
+}
+
+func TestSitemapsFallback(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	crawler := NewSiteCrawler("TestBot", 1000, 1000)
+	sitemaps, err := crawler.Sitemaps(context.Background(), server.URL+"/some/page")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(sitemaps) != 1 || sitemaps[0] != server.URL+"/sitemap.xml" {
+		t.Errorf("expected /sitemap.xml without robots.txt, got %v", sitemaps)
+	}
+}
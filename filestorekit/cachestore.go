@@ -66,6 +66,11 @@ func (s *CacheStore) Remove(ctx context.Context, path string) error {
 	return s.underlying.Remove(ctx, path)
 }
 
+// Public tells if the underlying store is public.
+func (s *CacheStore) Public() bool {
+	return IsPublic(s.underlying)
+}
+
 func (s *CacheStore) GetURL(path string, expire time.Duration) (string, error) {
 	return s.underlying.GetURL(path, expire)
 }
@@ -11,3 +11,9 @@ type Store interface {
 	Remove(ctx context.Context, path string) error
 	GetURL(path string, expire time.Duration) (string, error)
 }
+
+// IsPublic tells if store publishes what is put in it, so anyone who knows a path can read it.
+func IsPublic(store Store) bool {
+	p, ok := store.(interface{ Public() bool })
+	return ok && p.Public()
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -16,6 +17,10 @@ import (
 	"github.com/oliverkofoed/gokit/logkit"
 )
 
+// mediaHeaderSize is the size of the header in front of cached media: a zipped flag
+// followed by the NUL-terminated content type.
+const mediaHeaderSize = 150
+
 type MediaStore struct {
 	underlying Store
 	cache      *cachekit.Cache
@@ -30,11 +35,10 @@ func NewMedia(cache *cachekit.Cache, underlying Store) *MediaStore {
 
 func (s *MediaStore) GetFormattedMedia(ctx context.Context, path string, format string, gzipContent bool) (content []byte, contentType string, zipped bool, err error) {
 	// check cache
-	cacheKey := []byte(fmt.Sprintf("format5:%v/%v/%v", path, format, gzipContent))
-	if cached := s.cache.Get(ctx, cacheKey); cached != nil {
-		zipped := cached[0] == 1
-		contentType = string(cached[1:(bytes.IndexByte(cached[1:], 0) + 1)])
-		content := cached[150:]
+	cacheKey := mediaCacheKey(path, format, gzipContent)
+	if cached := s.cache.Get(ctx, cacheKey); len(cached) >= mediaHeaderSize {
+		zipped, contentType := parseMediaHeader(cached)
+		content := cached[mediaHeaderSize:]
 		return content, contentType, zipped, nil
 	}
 
@@ -92,39 +96,48 @@ func (s *MediaStore) GetFormattedMedia(ctx context.Context, path string, format
 	}
 
 	// save to cache
-	serialized := make([]byte, 150+len(content))
+	serialized := make([]byte, mediaHeaderSize+len(content))
 	if zipped {
 		serialized[0] = 1
 	} else {
 		serialized[0] = 0
 	}
-	copy(serialized[1:], []byte(contentType))
-	copy(serialized[150:], content)
+	copy(serialized[1:mediaHeaderSize-1], []byte(contentType))
+	copy(serialized[mediaHeaderSize:], content)
 	s.cache.Set(ctx, cacheKey, serialized, time.Hour*24*30)
 
 	return content, contentType, zipped, nil
 }
 
+// ServeMedia writes the formatted media to w. Cached media is streamed from the cache
+// without loading it into memory when the cache supports it (DiskCache2), and range
+// requests are supported.
 func (s *MediaStore) ServeMedia(ctx context.Context, path string, format string, w http.ResponseWriter, r *http.Request, allowGzipping bool) {
 	ctx, done := logkit.Operation(ctx, "servemedia", logkit.String("path", path), logkit.String("format", format))
 	defer done()
 
 	var zipped = allowGzipping && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
 
+	// stream from the cache
+	if reader := s.cache.OpenReader(ctx, mediaCacheKey(path, format, zipped)); reader != nil {
+		defer reader.Close()
+
+		header := make([]byte, mediaHeaderSize)
+		if _, err := io.ReadFull(reader, header); err == nil {
+			zipped, contentType := parseMediaHeader(header)
+			content := &offsetReadSeeker{ReadSeeker: reader, offset: mediaHeaderSize}
+			if size, err := content.Seek(0, io.SeekEnd); err == nil && size > 0 {
+				serveMediaContent(w, r, content, contentType, zipped)
+				return
+			}
+		}
+	}
+
 	// get the media
-	var content []byte
-	var contentType string
-	var err error
-	//content, contentType, zipped, err = s.GetWithZip(ctx, path, zipped)
-	//if err != nil {
-	//logkit.Error(ctx, "Error getting formatted media", logkit.Err(err))
-	//}
-	//} else {
-	content, contentType, zipped, err = s.GetFormattedMedia(ctx, path, format, zipped)
+	content, contentType, zipped, err := s.GetFormattedMedia(ctx, path, format, zipped)
 	if err != nil {
 		logkit.Error(ctx, "Error getting formatted media", logkit.Err(err))
 	}
-	//}
 
 	// Not found?
 	if content == nil || len(content) == 0 {
@@ -132,16 +145,19 @@ func (s *MediaStore) ServeMedia(ctx context.Context, path string, format string,
 		return
 	}
 
-	// Write response
+	serveMediaContent(w, r, bytes.NewReader(content), contentType, zipped)
+}
+
+func serveMediaContent(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, contentType string, zipped bool) {
 	if zipped {
 		w.Header().Set("Content-Encoding", "gzip")
 	}
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%v", len(content)))
 	w.Header().Set("Cache-Control", "public, max-age=31556926")
 	w.Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-	w.WriteHeader(200)
-	w.Write(content)
+
+	// ServeContent sets Content-Length and handles range requests
+	http.ServeContent(w, r, "", time.Time{}, content)
 }
 
 func (s *MediaStore) Get(ctx context.Context, path string) (content []byte, contentType string, err error) {
@@ -177,6 +193,35 @@ func (s *MediaStore) Remove(ctx context.Context, path string) error {
 	return s.underlying.Remove(ctx, path)
 }
 
+// Public tells if the underlying store is public.
+func (s *MediaStore) Public() bool {
+	return IsPublic(s.underlying)
+}
+
 func (s *MediaStore) GetURL(path string, expire time.Duration) (string, error) {
 	return s.underlying.GetURL(path, expire)
 }
+
+func mediaCacheKey(path string, format string, gzipContent bool) []byte {
+	return []byte(fmt.Sprintf("format5:%v/%v/%v", path, format, gzipContent))
+}
+
+func parseMediaHeader(header []byte) (zipped bool, contentType string) {
+	zipped = header[0] == 1
+	contentType = string(header[1:(bytes.IndexByte(header[1:], 0) + 1)])
+	return zipped, contentType
+}
+
+// offsetReadSeeker hides the first offset bytes of the underlying reader.
+type offsetReadSeeker struct {
+	io.ReadSeeker
+	offset int64
+}
+
+func (r *offsetReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += r.offset
+	}
+	position, err := r.ReadSeeker.Seek(offset, whence)
+	return position - r.offset, err
+}
@@ -18,10 +18,22 @@ type S3Store struct {
 	s3         *s3.S3
 	s3Bucket   string
 	s3Prefix   string
+	acl        string
 	httpClient *http.Client
 }
 
+// NewS3 returns a store that uploads files with the public-read ACL.
 func NewS3(region string, s3bucket string, s3prefix string, s3accessKey string, s3secretkey string, endpoint *string) *S3Store {
+	return newS3(region, s3bucket, s3prefix, s3accessKey, s3secretkey, endpoint, "public-read")
+}
+
+// NewS3Private returns a store that uploads files with the private ACL. Use GetURL to
+// hand out links to them.
+func NewS3Private(region string, s3bucket string, s3prefix string, s3accessKey string, s3secretkey string, endpoint *string) *S3Store {
+	return newS3(region, s3bucket, s3prefix, s3accessKey, s3secretkey, endpoint, "private")
+}
+
+func newS3(region string, s3bucket string, s3prefix string, s3accessKey string, s3secretkey string, endpoint *string, acl string) *S3Store {
 	awsSession := session.New(&aws.Config{
 		Region:      aws.String(region), //"us-east-2"),
 		Credentials: credentials.NewStaticCredentials(s3accessKey, s3secretkey, ""),
@@ -32,6 +44,7 @@ func NewS3(region string, s3bucket string, s3prefix string, s3accessKey string,
 		s3:         s3.New(awsSession),
 		s3Bucket:   s3bucket,
 		s3Prefix:   s3prefix,
+		acl:        acl,
 		httpClient: &http.Client{Timeout: time.Second * 30},
 	}
 }
@@ -56,13 +69,18 @@ func (s *S3Store) Put(ctx context.Context, path string, contentType string, cont
 	_, err := s.s3.PutObject(&s3.PutObjectInput{
 		Bucket:      aws.String(s.s3Bucket),
 		Key:         aws.String(fmt.Sprintf("%v%v", s.s3Prefix, path)),
-		ACL:         aws.String("public-read"),
+		ACL:         aws.String(s.acl),
 		Body:        bytes.NewReader(content),
 		ContentType: aws.String(contentType),
 	})
 	return err
 }
 
+// Public tells if files are uploaded with the public-read ACL.
+func (s *S3Store) Public() bool {
+	return s.acl == "public-read"
+}
+
 func (s *S3Store) Remove(ctx context.Context, path string) error {
 	_, err := s.s3.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.s3Bucket),
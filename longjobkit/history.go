@@ -0,0 +1,247 @@
+package longjobkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/filestorekit"
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// ErrPublicStore is returned by NewHistory for stores that publish what is saved in them.
+var ErrPublicStore = errors.New("longjobkit: job history can't be saved to a public store")
+
+// Retention is how many runs of a job History keeps. Runs beyond MaxRuns, or older than
+// MaxAge, are removed with their logs. Zero means no limit.
+type Retention struct {
+	MaxRuns int
+	MaxAge  time.Duration
+}
+
+// HistoryEntry is a saved run of a job.
+type HistoryEntry struct {
+	ID       string        `json:"id"`
+	Name     string        `json:"name"`
+	Hostname string        `json:"hostname"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	AnyError bool          `json:"anyError"`
+	HasLog   bool          `json:"hasLog"`
+}
+
+// Failed tells if the run returned an error, panicked or logged errors or warnings.
+func (e *HistoryEntry) Failed() bool {
+	return e.AnyError || e.Error != ""
+}
+
+// History saves the results of Run to a filestorekit.Store. Every job has an index of its
+// runs, newest first, and there is an index of job names. Logs are saved gzipped for runs
+// that asked to save them or had errors.
+//
+// Indexes are updated with a read and a write, so processes sharing a store can lose index
+// entries if they save runs of the same job at the same time.
+type History struct {
+	// DefaultRetention applies to jobs without a retention set with SetRetention.
+	DefaultRetention Retention
+
+	store  filestorekit.Store
+	prefix string
+
+	lock      sync.Mutex
+	retention map[string]Retention
+}
+
+// NewHistory returns a history saved in store under prefix, e.g. "/jobs". It keeps the last
+// 100 runs of each job.
+//
+// Logs can hold anything the jobs logged, so it returns ErrPublicStore for stores that
+// publish what is saved in them, like filestorekit.NewS3. Use filestorekit.NewS3Private.
+func NewHistory(store filestorekit.Store, prefix string) (*History, error) {
+	if filestorekit.IsPublic(store) {
+		return nil, ErrPublicStore
+	}
+	return &History{
+		DefaultRetention: Retention{MaxRuns: 100},
+		store:            store,
+		prefix:           strings.TrimSuffix(prefix, "/"),
+		retention:        make(map[string]Retention),
+	}, nil
+}
+
+// SetRetention sets how many runs of a job are kept.
+func (h *History) SetRetention(name string, retention Retention) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.retention[name] = retention
+}
+
+func (h *History) namesPath() string {
+	return h.prefix + "/index.json"
+}
+
+func (h *History) indexPath(name string) string {
+	return h.prefix + "/" + url.PathEscape(name) + "/index.json"
+}
+
+func (h *History) logPath(name string, id string) string {
+	return h.prefix + "/" + url.PathEscape(name) + "/" + id + ".log.gz"
+}
+
+// Save saves a result and applies the job's retention.
+func (h *History) Save(ctx context.Context, result *Result) (*HistoryEntry, error) {
+	entry := &HistoryEntry{
+		ID:       fmt.Sprintf("%v-%v", result.Start.UTC().Format("20060102T150405.000000000"), sanitizeID(result.Hostname)),
+		Name:     result.Name,
+		Hostname: result.Hostname,
+		Start:    result.Start,
+		Duration: result.Duration,
+		AnyError: result.AnyError,
+		HasLog:   result.Log != nil && result.Log.Len() > 0 && (result.SaveLog || result.AnyError),
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+
+	if entry.HasLog {
+		if err := h.store.Put(ctx, h.logPath(entry.Name, entry.ID), "application/gzip", result.Log.Bytes()); err != nil {
+			return nil, fmt.Errorf("could not save log of %v: %v", entry.Name, err)
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	entries, err := h.Runs(ctx, entry.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		if err := h.addName(ctx, entry.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	entries = append([]*HistoryEntry{entry}, entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Start.After(entries[j].Start) })
+	entries, removed := h.retain(entry.Name, entries, time.Now())
+	if err := h.putJSON(ctx, h.indexPath(entry.Name), entries); err != nil {
+		return nil, err
+	}
+
+	// logs are removed after the index no longer points to them
+	for _, old := range removed {
+		if old.HasLog {
+			if err := h.store.Remove(ctx, h.logPath(old.Name, old.ID)); err != nil {
+				logkit.Warn(ctx, "Could not remove old job log", logkit.String("name", old.Name), logkit.String("id", old.ID), logkit.Err(err))
+			}
+		}
+	}
+
+	return entry, nil
+}
+
+// retain splits entries, newest first, into those kept by the job's retention and those
+// removed.
+func (h *History) retain(name string, entries []*HistoryEntry, now time.Time) (kept []*HistoryEntry, removed []*HistoryEntry) {
+	retention, found := h.retention[name]
+	if !found {
+		retention = h.DefaultRetention
+	}
+
+	for i, entry := range entries {
+		if (retention.MaxRuns > 0 && i >= retention.MaxRuns) || (retention.MaxAge > 0 && now.Sub(entry.Start) > retention.MaxAge) {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	return kept, removed
+}
+
+func (h *History) addName(ctx context.Context, name string) error {
+	names, err := h.Names(ctx)
+	if err != nil {
+		return err
+	}
+	for _, existing := range names {
+		if existing == name {
+			return nil
+		}
+	}
+	names = append(names, name)
+	sort.Strings(names)
+	return h.putJSON(ctx, h.namesPath(), names)
+}
+
+// Names lists the jobs with saved runs.
+func (h *History) Names(ctx context.Context) ([]string, error) {
+	names := []string{}
+	return names, h.getJSON(ctx, h.namesPath(), &names)
+}
+
+// Runs lists the saved runs of a job, newest first.
+func (h *History) Runs(ctx context.Context, name string) ([]*HistoryEntry, error) {
+	entries := []*HistoryEntry{}
+	return entries, h.getJSON(ctx, h.indexPath(name), &entries)
+}
+
+// Log returns the gzipped log of a run.
+func (h *History) Log(ctx context.Context, name string, id string) ([]byte, error) {
+	content, _, err := h.store.Get(ctx, h.logPath(name, id))
+	return content, err
+}
+
+func (h *History) getJSON(ctx context.Context, path string, value interface{}) error {
+	content, _, err := h.store.Get(ctx, path)
+	if isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not load job history %v: %v", path, err)
+	}
+	if err := json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("invalid job history %v: %v", path, err)
+	}
+	return nil
+}
+
+func (h *History) putJSON(ctx context.Context, path string, value interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err := h.store.Put(ctx, path, "application/json", content); err != nil {
+		return fmt.Errorf("could not save job history %v: %v", path, err)
+	}
+	return nil
+}
+
+// isNotFound tells missing files from other errors. filestorekit stores return the errors
+// of what they store in, so this checks for those of the file system and S3.
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	var coded interface{ Code() string }
+	return errors.As(err, &coded) && (coded.Code() == "NoSuchKey" || coded.Code() == "NotFound")
+}
+
+func sanitizeID(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, value)
+}
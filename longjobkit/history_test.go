@@ -0,0 +1,209 @@
+package longjobkit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oliverkofoed/gokit/cachekit"
+	"github.com/oliverkofoed/gokit/filestorekit"
+	"github.com/oliverkofoed/gokit/testkit"
+)
+
+// memoryStore is a filestorekit.Store in memory. Paths are cleaned, like a file system
+// would resolve them.
+type memoryStore struct {
+	lock  sync.Mutex
+	files map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(ctx context.Context, path string) ([]byte, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	content, found := s.files[filepath.Clean(path)]
+	if !found {
+		return nil, "", os.ErrNotExist
+	}
+	return content, "", nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, path string, contentType string, content []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.files[filepath.Clean(path)] = append([]byte(nil), content...)
+	return nil
+}
+
+func (s *memoryStore) Remove(ctx context.Context, path string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.files, filepath.Clean(path))
+	return nil
+}
+
+func (s *memoryStore) GetURL(path string, expire time.Duration) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (s *memoryStore) paths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	paths := []string{}
+	for path := range s.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// publicStore is a memoryStore that publishes what is saved in it.
+type publicStore struct {
+	*memoryStore
+}
+
+func (s publicStore) Public() bool {
+	return true
+}
+
+func testResult(name string, start time.Time, err error, log string) *Result {
+	result := &Result{Name: name, Hostname: "host", Start: start, Duration: time.Second, Err: err, Log: bytes.NewBuffer(nil)}
+	if log != "" {
+		zipper := gzip.NewWriter(result.Log)
+		io.WriteString(zipper, log)
+		zipper.Close()
+		result.SaveLog = true
+		result.AnyError = err != nil
+	}
+	return result
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	history, err := NewHistory(store, "/jobs/")
+	testkit.NoError(t, err)
+	now := time.Now()
+
+	// runs are listed newest first, whatever order they are saved in
+	for _, minutes := range []int{2, 3, 1} {
+		_, err := history.Save(ctx, testResult("import", now.Add(time.Duration(minutes)*time.Minute), nil, "imported\n"))
+		testkit.NoError(t, err)
+	}
+	_, err = history.Save(ctx, testResult("cleanup", now, nil, ""))
+	testkit.NoError(t, err)
+
+	runs, err := history.Runs(ctx, "import")
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(runs), 3)
+	for i, minutes := range []int{3, 2, 1} {
+		testkit.Assert(t, runs[i].Start.Equal(now.Add(time.Duration(minutes)*time.Minute)))
+		testkit.Assert(t, runs[i].HasLog)
+	}
+
+	names, err := history.Names(ctx)
+	testkit.NoError(t, err)
+	testkit.Equal(t, names, []string{"cleanup", "import"})
+
+	// runs beyond MaxRuns are removed with their logs
+	history.SetRetention("import", Retention{MaxRuns: 2})
+	_, err = history.Save(ctx, testResult("import", now.Add(4*time.Minute), nil, "imported\n"))
+	testkit.NoError(t, err)
+	runs, err = history.Runs(ctx, "import")
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(runs), 2)
+	testkit.Assert(t, runs[1].Start.Equal(now.Add(3*time.Minute)))
+	logs := 0
+	for _, path := range store.paths() {
+		if strings.HasSuffix(path, ".log.gz") {
+			logs++
+		}
+	}
+	testkit.Equal(t, logs, 2)
+
+	// runs older than MaxAge are removed
+	history.SetRetention("old", Retention{MaxAge: time.Hour})
+	_, err = history.Save(ctx, testResult("old", now.Add(-2*time.Hour), nil, "old\n"))
+	testkit.NoError(t, err)
+	_, err = history.Save(ctx, testResult("old", now, nil, ""))
+	testkit.NoError(t, err)
+	runs, err = history.Runs(ctx, "old")
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(runs), 1)
+	testkit.Assert(t, runs[0].Start.Equal(now))
+	for _, path := range store.paths() {
+		testkit.Assert(t, !strings.HasPrefix(path, "/jobs/old/") || path == "/jobs/old/index.json")
+	}
+}
+
+func TestHistoryPublicStore(t *testing.T) {
+	// logs aren't saved where anyone can read them
+	_, err := NewHistory(publicStore{newMemoryStore()}, "/jobs")
+	testkit.Equal(t, err, ErrPublicStore)
+	_, err = NewHistory(filestorekit.NewCache(cachekit.NewNoOpCache(), publicStore{newMemoryStore()}), "/jobs")
+	testkit.Equal(t, err, ErrPublicStore)
+}
+
+func TestHistoryHandler(t *testing.T) {
+	ctx := context.Background()
+	history, err := NewHistory(newMemoryStore(), "/jobs")
+	testkit.NoError(t, err)
+	now := time.Now()
+
+	_, err = history.Save(ctx, testResult("import", now, nil, ""))
+	testkit.NoError(t, err)
+	failed, err := history.Save(ctx, testResult("import", now.Add(time.Minute), errors.New("failed"), "\x1b[31mERROR\x1b[0m broken\n"))
+	testkit.NoError(t, err)
+	other, err := history.Save(ctx, testResult("other", now, errors.New("failed"), "other\n"))
+	testkit.NoError(t, err)
+
+	server := httptest.NewServer(history.Handler())
+	defer server.Close()
+	get := func(query string) (int, string) {
+		response, err := http.Get(server.URL + "/?" + query)
+		testkit.NoError(t, err)
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		testkit.NoError(t, err)
+		return response.StatusCode, string(body)
+	}
+
+	// the failed filter
+	status, body := get("name=import&failed=1&format=json")
+	testkit.Equal(t, status, http.StatusOK)
+	runs := []*HistoryEntry{}
+	testkit.NoError(t, json.Unmarshal([]byte(body), &runs))
+	testkit.Equal(t, len(runs), 1)
+	testkit.Equal(t, runs[0].ID, failed.ID)
+
+	status, body = get("name=import&format=json")
+	testkit.Equal(t, status, http.StatusOK)
+	testkit.NoError(t, json.Unmarshal([]byte(body), &runs))
+	testkit.Equal(t, len(runs), 2)
+
+	// logs are streamed without color codes
+	status, body = get("name=import&log=" + failed.ID)
+	testkit.Equal(t, status, http.StatusOK)
+	testkit.Equal(t, body, "ERROR broken\n")
+
+	// only ids in the job's index are read
+	status, _ = get("name=import&log=missing")
+	testkit.Equal(t, status, http.StatusNotFound)
+	status, _ = get("name=import&log=../other/" + other.ID)
+	testkit.Equal(t, status, http.StatusNotFound)
+}
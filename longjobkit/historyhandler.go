@@ -0,0 +1,150 @@
+package longjobkit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// terminalEscapes are the color codes the log writer adds to logs.
+var terminalEscapes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+var historyTemplate = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Job history{{if .Name}}: {{.Name}}{{end}}</title></head>
+<body>
+{{if .Name}}
+	<h1>{{.Name}}</h1>
+	<p><a href="?">All jobs</a> | {{if .Failed}}<a href="?name={{.Name}}">All runs</a>{{else}}<a href="?name={{.Name}}&amp;failed=1">Failed runs</a>{{end}}</p>
+	<table>
+	<tr><th>Start</th><th>Duration</th><th>Host</th><th>Error</th><th></th></tr>
+	{{range .Runs}}
+	<tr>
+		<td>{{.Start.Format "2006-01-02 15:04:05 MST"}}</td>
+		<td>{{.Duration}}</td>
+		<td>{{.Hostname}}</td>
+		<td>{{if .Error}}{{.Error}}{{else if .AnyError}}errors logged{{end}}</td>
+		<td>{{if .HasLog}}<a href="?name={{.Name}}&amp;log={{.ID}}">log</a>{{end}}</td>
+	</tr>
+	{{end}}
+	</table>
+{{else}}
+	<h1>Jobs</h1>
+	<ul>{{range .Names}}<li><a href="?name={{.}}">{{.}}</a></li>{{end}}</ul>
+{{end}}
+</body>
+</html>`))
+
+// Handler returns a handler for browsing the history, which can be added to a sitekit site
+// with web.Route{Path: ..., Handler: history.Handler()}. Without parameters it lists the
+// jobs, name=<job> lists the runs of a job, adding failed=1 lists only failed runs, and
+// log=<id> streams the log of a run as text. Add format=json for JSON lists.
+//
+// The handler does no authentication, so mount it behind one.
+func (h *History) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, done := logkit.Operation(r.Context(), "longjobkit.history", logkit.String("name", r.FormValue("name")))
+		defer done()
+
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.FormValue("name")
+		if id := r.FormValue("log"); id != "" && name != "" {
+			// only ids from the index are read, so the id can't point elsewhere in the store
+			runs, err := h.Runs(ctx, name)
+			if err != nil {
+				logkit.Error(ctx, "Could not load job history", logkit.Err(err))
+				http.Error(w, "could not load job history", http.StatusInternalServerError)
+				return
+			}
+			found := false
+			for _, entry := range runs {
+				found = found || (entry.ID == id && entry.HasLog)
+			}
+			if !found {
+				http.Error(w, "log not found", http.StatusNotFound)
+				return
+			}
+
+			content, err := h.Log(ctx, name, id)
+			if isNotFound(err) {
+				http.Error(w, "log not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				logkit.Error(ctx, "Could not load job log", logkit.Err(err))
+				http.Error(w, "could not load log", http.StatusInternalServerError)
+				return
+			}
+			reader, err := gzip.NewReader(bytes.NewReader(content))
+			if err != nil {
+				http.Error(w, "invalid log", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			lines := bufio.NewScanner(reader)
+			lines.Buffer(nil, 1024*1024)
+			for lines.Scan() {
+				w.Write(terminalEscapes.ReplaceAll(lines.Bytes(), nil))
+				io.WriteString(w, "\n")
+			}
+			if err := lines.Err(); err != nil {
+				logkit.Warn(ctx, "Error reading job log", logkit.Err(err))
+			}
+			return
+		}
+
+		data := struct {
+			Name   string
+			Failed bool
+			Names  []string
+			Runs   []*HistoryEntry
+		}{Name: name, Failed: r.FormValue("failed") == "1"}
+
+		var err error
+		var list interface{}
+		if name == "" {
+			data.Names, err = h.Names(ctx)
+			list = data.Names
+		} else {
+			data.Runs, err = h.Runs(ctx, name)
+			if data.Failed {
+				failed := []*HistoryEntry{}
+				for _, entry := range data.Runs {
+					if entry.Failed() {
+						failed = append(failed, entry)
+					}
+				}
+				data.Runs = failed
+			}
+			list = data.Runs
+		}
+		if err != nil {
+			logkit.Error(ctx, "Could not load job history", logkit.Err(err))
+			http.Error(w, "could not load job history", http.StatusInternalServerError)
+			return
+		}
+
+		if r.FormValue("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			err = json.NewEncoder(w).Encode(list)
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err = historyTemplate.Execute(w, data)
+		}
+		if err != nil {
+			logkit.Warn(ctx, "Error writing job history", logkit.Err(err))
+		}
+	})
+}
@@ -32,16 +32,20 @@ func (w *threadSafeWriter) Close() error {
 }
 
 type Result struct {
+	Name     string
 	Hostname string
+	Start    time.Time
+	Duration time.Duration
 	SaveLog  bool
 	AnyError bool
 	Err      error
-	Log      *bytes.Buffer
+	Log      *bytes.Buffer // gzipped
 }
 
 func Run(ctx context.Context, name string, repanic bool, action func(ctx context.Context) (bool, error)) *Result {
 	result := &Result{
-		Log: bytes.NewBuffer(nil),
+		Name: name,
+		Log:  bytes.NewBuffer(nil),
 	}
 	if hostname, err := os.Hostname(); err == nil {
 		result.Hostname = hostname
@@ -55,6 +59,7 @@ func Run(ctx context.Context, name string, repanic bool, action func(ctx context
 	scheduleCtx, done := logkit.OperationWithOutput(ctx, name, logkit.NewSplitterOutput(errMarker, logkit.DefaultOutput, logkit.NewWriterOutput(zipper, true, time.Millisecond*20)))
 
 	start := time.Now()
+	result.Start = start
 	logkit.Info(scheduleCtx, "starting "+name)
 	func() {
 		defer func() {
@@ -87,7 +92,8 @@ func Run(ctx context.Context, name string, repanic bool, action func(ctx context
 		}
 	}()
 
-	logkit.Info(scheduleCtx, "done", logkit.Duration("duration", time.Since(start)))
+	result.Duration = time.Since(start)
+	logkit.Info(scheduleCtx, "done", logkit.Duration("duration", result.Duration))
 
 	done()
 
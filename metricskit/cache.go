@@ -0,0 +1,85 @@
+package metricskit
+
+import (
+	"github.com/oliverkofoed/gokit/cachekit"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheLabels       = []string{"store", "prefix"}
+	cacheHits         = prometheus.NewDesc("cache_hits_total", "Number of cache hits.", cacheLabels, nil)
+	cacheMisses       = prometheus.NewDesc("cache_misses_total", "Number of cache misses.", cacheLabels, nil)
+	cacheSets         = prometheus.NewDesc("cache_sets_total", "Number of cache sets.", cacheLabels, nil)
+	cacheRemoves      = prometheus.NewDesc("cache_removes_total", "Number of cache removes.", cacheLabels, nil)
+	cacheReadBytes    = prometheus.NewDesc("cache_read_bytes_total", "Bytes read from the cache.", cacheLabels, nil)
+	cacheWrittenBytes = prometheus.NewDesc("cache_written_bytes_total", "Bytes written to the cache.", cacheLabels, nil)
+	cachePrefixSize   = prometheus.NewDesc("cache_prefix_estimated_bytes", "Estimated size of the entries in a cache prefix.", cacheLabels, nil)
+	cacheGetDuration  = prometheus.NewDesc("cache_get_duration_seconds", "Duration of cache gets.", cacheLabels, nil)
+	cacheSetDuration  = prometheus.NewDesc("cache_set_duration_seconds", "Duration of cache sets.", cacheLabels, nil)
+	cacheSize         = prometheus.NewDesc("cache_estimated_bytes", "Estimated size of the cache.", []string{"store"}, nil)
+	cacheLogicalSize  = prometheus.NewDesc("cache_estimated_logical_bytes", "Estimated size of the cache before compression.", []string{"store"}, nil)
+	cacheCount        = prometheus.NewDesc("cache_estimated_entries", "Estimated number of entries in the cache.", []string{"store"}, nil)
+	cacheEvictions    = prometheus.NewDesc("cache_evictions_total", "Number of entries evicted from the cache.", []string{"store"}, nil)
+)
+
+// CacheCollector exports the stats of cachekit stores to Prometheus.
+type CacheCollector struct {
+	stores map[string]cachekit.Store
+}
+
+// NewCacheCollector returns a collector for the given stores, by name.
+func NewCacheCollector(stores map[string]cachekit.Store) *CacheCollector {
+	return &CacheCollector{stores: stores}
+}
+
+// RegisterCaches registers a collector for the given stores with the default registry,
+// so they are included by Handler.
+func RegisterCaches(stores map[string]cachekit.Store) error {
+	return prometheus.Register(NewCacheCollector(stores))
+}
+
+func (c *CacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHits
+	ch <- cacheMisses
+	ch <- cacheSets
+	ch <- cacheRemoves
+	ch <- cacheReadBytes
+	ch <- cacheWrittenBytes
+	ch <- cachePrefixSize
+	ch <- cacheGetDuration
+	ch <- cacheSetDuration
+	ch <- cacheSize
+	ch <- cacheLogicalSize
+	ch <- cacheCount
+	ch <- cacheEvictions
+}
+
+func (c *CacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, store := range c.stores {
+		stats := store.CacheStats()
+		ch <- prometheus.MustNewConstMetric(cacheSize, prometheus.GaugeValue, float64(stats.EstimatedSize), name)
+		ch <- prometheus.MustNewConstMetric(cacheLogicalSize, prometheus.GaugeValue, float64(stats.EstimatedLogicalSize), name)
+		ch <- prometheus.MustNewConstMetric(cacheCount, prometheus.GaugeValue, float64(stats.EstimatedCount), name)
+		ch <- prometheus.MustNewConstMetric(cacheEvictions, prometheus.CounterValue, float64(stats.Evictions), name)
+
+		for _, prefix := range stats.Prefixes {
+			ch <- prometheus.MustNewConstMetric(cacheHits, prometheus.CounterValue, float64(prefix.Hits), name, prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(cacheMisses, prometheus.CounterValue, float64(prefix.Misses), name, prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(cacheSets, prometheus.CounterValue, float64(prefix.Sets), name, prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(cacheRemoves, prometheus.CounterValue, float64(prefix.Removes), name, prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(cacheReadBytes, prometheus.CounterValue, float64(prefix.ReadBytes), name, prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(cacheWrittenBytes, prometheus.CounterValue, float64(prefix.WrittenBytes), name, prefix.Prefix)
+			ch <- prometheus.MustNewConstMetric(cachePrefixSize, prometheus.GaugeValue, float64(prefix.EstimatedSize), name, prefix.Prefix)
+			ch <- cacheHistogram(cacheGetDuration, prefix.GetLatency, name, prefix.Prefix)
+			ch <- cacheHistogram(cacheSetDuration, prefix.SetLatency, name, prefix.Prefix)
+		}
+	}
+}
+
+func cacheHistogram(desc *prometheus.Desc, h cachekit.LatencyHistogram, labelValues ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(h.Buckets))
+	for i, bucket := range h.Buckets {
+		buckets[bucket.Seconds()] = uint64(h.Counts[i])
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(h.Count), h.Sum.Seconds(), buckets, labelValues...)
+}
@@ -0,0 +1,69 @@
+package metricskit
+
+import (
+	"github.com/oliverkofoed/gokit/workqueuekit"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	workQueueLabels    = []string{"queue"}
+	workQueueWorkers   = prometheus.NewDesc("workqueue_workers", "Number of workers in the pool.", workQueueLabels, nil)
+	workQueueInFlight  = prometheus.NewDesc("workqueue_in_flight_jobs", "Number of jobs running.", workQueueLabels, nil)
+	workQueueDepth     = prometheus.NewDesc("workqueue_depth", "Number of jobs waiting in a lane.", []string{"queue", "lane"}, nil)
+	workQueueDelayed   = prometheus.NewDesc("workqueue_delayed_jobs", "Number of delayed jobs that aren't due yet.", workQueueLabels, nil)
+	workQueueStarted   = prometheus.NewDesc("workqueue_jobs_started_total", "Number of jobs started.", workQueueLabels, nil)
+	workQueueCompleted = prometheus.NewDesc("workqueue_jobs_completed_total", "Number of jobs that succeeded.", workQueueLabels, nil)
+	workQueueFailed    = prometheus.NewDesc("workqueue_jobs_failed_total", "Number of jobs that returned an error or panicked.", workQueueLabels, nil)
+	workQueueWait      = prometheus.NewDesc("workqueue_wait_seconds_total", "Time started jobs waited in the queue.", workQueueLabels, nil)
+	workQueueDuration  = prometheus.NewDesc("workqueue_job_duration_seconds", "Duration of jobs.", workQueueLabels, nil)
+)
+
+// WorkQueueCollector exports the stats of work queues to Prometheus.
+type WorkQueueCollector struct {
+	queues map[string]*workqueuekit.WorkQueue
+}
+
+// NewWorkQueueCollector returns a collector for the given queues, by name.
+func NewWorkQueueCollector(queues map[string]*workqueuekit.WorkQueue) *WorkQueueCollector {
+	return &WorkQueueCollector{queues: queues}
+}
+
+// RegisterWorkQueues registers a collector for the given queues with the default registry,
+// so they are included by Handler.
+func RegisterWorkQueues(queues map[string]*workqueuekit.WorkQueue) error {
+	return prometheus.Register(NewWorkQueueCollector(queues))
+}
+
+func (c *WorkQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workQueueWorkers
+	ch <- workQueueInFlight
+	ch <- workQueueDepth
+	ch <- workQueueDelayed
+	ch <- workQueueStarted
+	ch <- workQueueCompleted
+	ch <- workQueueFailed
+	ch <- workQueueWait
+	ch <- workQueueDuration
+}
+
+func (c *WorkQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, queue := range c.queues {
+		stats := queue.Stats()
+		ch <- prometheus.MustNewConstMetric(workQueueWorkers, prometheus.GaugeValue, float64(stats.Workers), name)
+		ch <- prometheus.MustNewConstMetric(workQueueInFlight, prometheus.GaugeValue, float64(stats.InFlight), name)
+		ch <- prometheus.MustNewConstMetric(workQueueDelayed, prometheus.GaugeValue, float64(stats.Delayed), name)
+		ch <- prometheus.MustNewConstMetric(workQueueStarted, prometheus.CounterValue, float64(stats.Started), name)
+		ch <- prometheus.MustNewConstMetric(workQueueCompleted, prometheus.CounterValue, float64(stats.Completed), name)
+		ch <- prometheus.MustNewConstMetric(workQueueFailed, prometheus.CounterValue, float64(stats.Failed), name)
+		ch <- prometheus.MustNewConstMetric(workQueueWait, prometheus.CounterValue, stats.WaitTime.Seconds(), name)
+		for lane, queued := range stats.Queued {
+			ch <- prometheus.MustNewConstMetric(workQueueDepth, prometheus.GaugeValue, float64(queued), name, lane)
+		}
+
+		buckets := make(map[float64]uint64, len(stats.Duration.Buckets))
+		for i, bucket := range stats.Duration.Buckets {
+			buckets[bucket.Seconds()] = uint64(stats.Duration.Counts[i])
+		}
+		ch <- prometheus.MustNewConstHistogram(workQueueDuration, uint64(stats.Duration.Count), stats.Duration.Sum.Seconds(), buckets, name)
+	}
+}
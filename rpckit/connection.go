@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync/atomic"
+	"time"
 )
 
 type ConnectionHandler func(c *Connection)
@@ -127,6 +128,11 @@ func (c *Connection) Send(msg *Message) error {
 	return nil
 }
 
+// SetWriteDeadline sets the deadline for Send and Write, see net.Conn.
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
 // Close closes the connection
 func (c *Connection) Close() error {
 	c.end(nil)
@@ -29,7 +29,7 @@ func MessageFromBytes(msg []byte) (*Message, int) {
 		if len(msg) >= length {
 			m := &Message{
 				buf: msg,
-				len: len(msg),
+				len: length,
 				pos: 4,
 			}
 			return m, length
@@ -103,6 +103,27 @@ func (m *Message) ReadString() (string, error) {
 	return string(str), nil
 }
 
+func (m *Message) ReadBytes() ([]byte, error) {
+	v, err := m.ReadInt()
+	if err != nil {
+		m.LastError = err
+		return nil, err
+	}
+	length := int(v)
+
+	if m.pos+length > m.len {
+		m.LastError = io.EOF
+		return nil, io.EOF
+	}
+
+	// copy, since the underlying buffer is reused by the connection
+	b := make([]byte, length)
+	copy(b, m.buf[m.pos:m.pos+length])
+	m.pos += length
+
+	return b, nil
+}
+
 var ErrOverflow = errors.New("Overflow in varint")
 
 func (m *Message) ReadInt() (uint64, error) {
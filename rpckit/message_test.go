@@ -11,6 +11,26 @@ func TestMessage(t *testing.T) {
 	x.WriteInt(1)
 	x.WriteInt(512)
 	x.WriteString("Hello World")
+	x.WriteBytes([]byte{1, 2, 3})
+
+	// read back
+	m, length := MessageFromBytes(append(x.Bytes(), 0, 0, 0, 0))
+	testkit.Equal(t, length, len(x.Bytes()))
+	v, err := m.ReadInt()
+	testkit.NoError(t, err)
+	testkit.Equal(t, v, uint64(1))
+	v, err = m.ReadInt()
+	testkit.NoError(t, err)
+	testkit.Equal(t, v, uint64(512))
+	str, err := m.ReadString()
+	testkit.NoError(t, err)
+	testkit.Equal(t, str, "Hello World")
+	b, err := m.ReadBytes()
+	testkit.NoError(t, err)
+	testkit.Equal(t, b, []byte{1, 2, 3})
+	_, err = m.ReadInt()
+	testkit.Error(t, err)
+
 	queue := &testMessageQueue{}
 	for i := 0; i != 200; i++ {
 		m := queue.makeMessage()
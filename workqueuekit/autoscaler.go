@@ -0,0 +1,86 @@
+package workqueuekit
+
+import (
+	"context"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// Autoscaler grows a queue's pool when jobs pile up or wait too long, and shrinks it when
+// workers are idle, within MinWorkers and MaxWorkers. Set the fields before calling Run.
+type Autoscaler struct {
+	MinWorkers int
+	MaxWorkers int
+
+	// Interval is how often the pool is resized.
+	Interval time.Duration
+
+	// TargetWait is how long jobs may wait in the queue on average before the pool grows.
+	TargetWait time.Duration
+
+	queue *WorkQueue
+}
+
+// NewAutoscaler returns an autoscaler for queue.
+func NewAutoscaler(queue *WorkQueue, minWorkers int, maxWorkers int) *Autoscaler {
+	return &Autoscaler{
+		MinWorkers: minWorkers,
+		MaxWorkers: maxWorkers,
+		Interval:   5 * time.Second,
+		TargetWait: time.Second,
+		queue:      queue,
+	}
+}
+
+// Run resizes the pool every Interval until ctx is done.
+func (a *Autoscaler) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	previous := a.queue.Stats()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := a.queue.Stats()
+		if workers := a.workers(previous, current); workers != current.Workers {
+			logkit.Info(ctx, "Resizing work queue", logkit.Int("from", current.Workers), logkit.Int("to", workers), logkit.Int("queued", current.QueueDepth()))
+			a.queue.SetWorkers(workers)
+		}
+		previous = current
+	}
+}
+
+// workers is the pool size for the stats at the end of an interval, given the stats at
+// its start.
+func (a *Autoscaler) workers(previous, current Stats) int {
+	workers := current.Workers
+	// jobs blocked behind their key can't use more workers
+	depth := current.QueueDepth() - current.Blocked
+
+	averageWait := time.Duration(0)
+	if started := current.Started - previous.Started; started > 0 {
+		averageWait = (current.WaitTime - previous.WaitTime) / time.Duration(started)
+	}
+
+	switch {
+	case depth > workers || averageWait > a.TargetWait:
+		// grow by half, so large backlogs are caught up quickly
+		workers += (workers + 1) / 2
+	case depth == 0 && current.InFlight < workers/2:
+		// shrink slowly, so short lulls don't throw away the pool
+		workers--
+	}
+
+	if workers > a.MaxWorkers {
+		workers = a.MaxWorkers
+	}
+	if workers < a.MinWorkers {
+		workers = a.MinWorkers
+	}
+	return workers
+}
@@ -0,0 +1,37 @@
+package workqueuekit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oliverkofoed/gokit/testkit"
+)
+
+func TestAutoscaler(t *testing.T) {
+	a := NewAutoscaler(New(1, 1), 2, 10)
+	previous := Stats{Started: 100, WaitTime: 10 * time.Second}
+	tests := []struct {
+		current  Stats
+		expected int
+	}{
+		// backlog grows the pool by half
+		{Stats{Workers: 4, InFlight: 4, Queued: map[string]int{"": 10}, Started: 100, WaitTime: 10 * time.Second}, 6},
+		{Stats{Workers: 8, InFlight: 8, Queued: map[string]int{"": 5, "bulk": 5}, Started: 100, WaitTime: 10 * time.Second}, 10},
+
+		// so does waiting too long
+		{Stats{Workers: 4, InFlight: 4, Queued: map[string]int{"": 2}, Started: 110, WaitTime: 40 * time.Second}, 6},
+
+		// busy without backlog stays
+		{Stats{Workers: 4, InFlight: 3, Queued: map[string]int{"": 2}, Started: 110, WaitTime: 15 * time.Second}, 4},
+
+		// jobs blocked behind their key aren't backlog
+		{Stats{Workers: 4, InFlight: 4, Queued: map[string]int{"": 10}, Blocked: 9, Started: 100, WaitTime: 10 * time.Second}, 4},
+
+		// idle shrinks by one, down to the minimum
+		{Stats{Workers: 4, InFlight: 1, Queued: map[string]int{}, Started: 110, WaitTime: 10 * time.Second}, 3},
+		{Stats{Workers: 2, InFlight: 0, Queued: map[string]int{}, Started: 100, WaitTime: 10 * time.Second}, 2},
+	}
+	for _, test := range tests {
+		testkit.Equal(t, a.workers(previous, test.current), test.expected)
+	}
+}
@@ -0,0 +1,249 @@
+package workqueuekit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+	"github.com/oliverkofoed/gokit/longjobkit"
+)
+
+// maxMissedRuns limits how many missed runs are counted after downtime.
+const maxMissedRuns = 1000
+
+// CronStore saves when each schedule last ran, so runs missed while the process was down
+// can be reported when it starts again.
+type CronStore interface {
+	LastRun(ctx context.Context, name string) (time.Time, error)
+	SetLastRun(ctx context.Context, name string, t time.Time) error
+}
+
+// Cron runs actions on cron schedules through longjobkit.Run. A schedule never overlaps
+// itself: a run that is due while the previous one is still running is skipped and reported
+// as missed. Set the fields before calling Run.
+type Cron struct {
+	// Location is the time zone of schedules added without CRON_TZ; time.Local if nil.
+	Location *time.Location
+
+	// Store saves the last run of each schedule. Without it, runs missed while the process
+	// was down are not reported.
+	Store CronStore
+
+	// OnResult is called with the result of every run, e.g. to save it with
+	// longjobkit.History.
+	OnResult func(name string, result *longjobkit.Result)
+
+	// OnMissed is called with the times of runs that were skipped because the previous
+	// run was still running, or because the process was down. Missed runs are logged as
+	// warnings either way.
+	OnMissed func(name string, missed []time.Time)
+
+	lock    sync.Mutex
+	entries []*cronEntry
+}
+
+type cronEntry struct {
+	name     string
+	schedule *CronSchedule
+	action   func(ctx context.Context) (bool, error)
+
+	lock    sync.Mutex
+	running bool
+}
+
+func NewCron() *Cron {
+	return &Cron{}
+}
+
+// Add adds an action to run on a cron schedule, see ParseCron. The action's arguments and
+// results are those of longjobkit.Run.
+func (c *Cron) Add(name string, expr string, action func(ctx context.Context) (bool, error)) error {
+	schedule, err := ParseCron(expr, c.Location)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, entry := range c.entries {
+		if entry.name == name {
+			return fmt.Errorf("workqueuekit: cron schedule %q already exists", name)
+		}
+	}
+	c.entries = append(c.entries, &cronEntry{name: name, schedule: schedule, action: action})
+	return nil
+}
+
+// Run runs the schedules until ctx is done, and waits for runs in progress to finish.
+func (c *Cron) Run(ctx context.Context) error {
+	c.lock.Lock()
+	entries := append([]*cronEntry(nil), c.entries...)
+	c.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		c.reportDowntime(ctx, entry, time.Now())
+
+		wg.Add(1)
+		go func(entry *cronEntry) {
+			defer wg.Done()
+			c.schedule(ctx, entry, &wg)
+		}(entry)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (c *Cron) schedule(ctx context.Context, entry *cronEntry, wg *sync.WaitGroup) {
+	for {
+		next := entry.schedule.Next(time.Now())
+		if next.IsZero() {
+			logkit.Warn(ctx, "Cron schedule never runs", logkit.String("name", entry.name))
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.fire(ctx, entry, next)
+		}()
+	}
+}
+
+// fire runs a scheduled run, unless the previous run is still running.
+func (c *Cron) fire(ctx context.Context, entry *cronEntry, scheduled time.Time) {
+	entry.lock.Lock()
+	if entry.running {
+		entry.lock.Unlock()
+		c.missed(ctx, entry, []time.Time{scheduled}, "previous run is still running")
+		return
+	}
+	entry.running = true
+	entry.lock.Unlock()
+
+	defer func() {
+		entry.lock.Lock()
+		entry.running = false
+		entry.lock.Unlock()
+	}()
+
+	if c.Store != nil {
+		if err := c.Store.SetLastRun(ctx, entry.name, scheduled); err != nil {
+			logkit.Error(ctx, "Could not save last cron run", logkit.String("name", entry.name), logkit.Err(err))
+		}
+	}
+
+	result := longjobkit.Run(ctx, entry.name, false, entry.action)
+	if c.OnResult != nil {
+		c.OnResult(entry.name, result)
+	}
+}
+
+// reportDowntime reports the runs between the last saved run and now.
+func (c *Cron) reportDowntime(ctx context.Context, entry *cronEntry, now time.Time) {
+	if c.Store == nil {
+		return
+	}
+
+	last, err := c.Store.LastRun(ctx, entry.name)
+	if err != nil {
+		logkit.Error(ctx, "Could not load last cron run", logkit.String("name", entry.name), logkit.Err(err))
+		return
+	}
+	if last.IsZero() {
+		return
+	}
+
+	missed := []time.Time{}
+	for t := entry.schedule.Next(last); !t.IsZero() && !t.After(now) && len(missed) < maxMissedRuns; t = entry.schedule.Next(t) {
+		missed = append(missed, t)
+	}
+	if len(missed) > 0 {
+		c.missed(ctx, entry, missed, "process was down")
+	}
+}
+
+func (c *Cron) missed(ctx context.Context, entry *cronEntry, missed []time.Time, reason string) {
+	logkit.Warn(ctx, "Missed cron runs", logkit.String("name", entry.name), logkit.String("reason", reason), logkit.Int("count", len(missed)), logkit.Time("first", missed[0]))
+	if c.OnMissed != nil {
+		c.OnMissed(entry.name, missed)
+	}
+}
+
+// FileCronStore is a CronStore in a JSON file.
+type FileCronStore struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFileCronStore(path string) *FileCronStore {
+	return &FileCronStore{path: path}
+}
+
+func (s *FileCronStore) load() (map[string]time.Time, error) {
+	runs := make(map[string]time.Time)
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return runs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &runs); err != nil {
+		return nil, fmt.Errorf("invalid cron store %v: %v", s.path, err)
+	}
+	return runs, nil
+}
+
+func (s *FileCronStore) LastRun(ctx context.Context, name string) (time.Time, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	runs, err := s.load()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return runs[name], nil
+}
+
+func (s *FileCronStore) SetLastRun(ctx context.Context, name string, t time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	runs, err := s.load()
+	if err != nil {
+		return err
+	}
+	runs[name] = t
+
+	data, err := json.Marshal(runs)
+	if err != nil {
+		return err
+	}
+
+	// write and rename, so a crash doesn't leave a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
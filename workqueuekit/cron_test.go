@@ -0,0 +1,92 @@
+package workqueuekit
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oliverkofoed/gokit/testkit"
+)
+
+func TestParseCron(t *testing.T) {
+	copenhagen, err := time.LoadLocation("Europe/Copenhagen")
+	testkit.NoError(t, err)
+
+	from := time.Date(2024, 3, 15, 10, 7, 30, 0, time.UTC) // a friday
+	tests := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 15, 10, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 3, 15, 10, 25, 0, 0, time.UTC)},
+		{"0 9-17 * * mon-fri", time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 2 * * 7", time.Date(2024, 3, 17, 2, 30, 0, 0, time.UTC)},
+		{"0 0 1 jan,jul *", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * fri", time.Date(2024, 3, 22, 0, 0, 0, 0, time.UTC)}, // the 13th or a friday
+		{"0 0 30 2 *", time.Time{}},
+		{"CRON_TZ=Europe/Copenhagen 0 12 * * *", time.Date(2024, 3, 15, 12, 0, 0, 0, copenhagen)},
+
+		// 02:30 doesn't exist when clocks go forward in Copenhagen
+		{"CRON_TZ=Europe/Copenhagen 30 2,3 31 3 *", time.Date(2024, 3, 31, 3, 30, 0, 0, copenhagen)},
+	}
+	for _, test := range tests {
+		schedule, err := ParseCron(test.expr, time.UTC)
+		testkit.NoError(t, err)
+		if next := schedule.Next(from); !next.Equal(test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.expr, test.expected, next)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * * foo *", "5-1 * * * *", "*/0 * * * *", "TZ=Nowhere/Special * * * * *"} {
+		_, err := ParseCron(expr, time.UTC)
+		testkit.Error(t, err)
+	}
+}
+
+func TestCron(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileCronStore(filepath.Join(t.TempDir(), "cron.json"))
+	cron := NewCron()
+	cron.Location = time.UTC
+	cron.Store = store
+
+	missed := map[string]int{}
+	cron.OnMissed = func(name string, times []time.Time) {
+		missed[name] += len(times)
+	}
+	release := make(chan struct{})
+	runs := int64(0)
+	testkit.NoError(t, cron.Add("hourly", "0 * * * *", func(ctx context.Context) (bool, error) {
+		atomic.AddInt64(&runs, 1)
+		<-release
+		return false, nil
+	}))
+	testkit.Error(t, cron.Add("hourly", "* * * * *", nil))
+
+	// a run that is due while the previous one runs is skipped
+	scheduled := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+	finished := make(chan struct{})
+	go func() {
+		cron.fire(ctx, cron.entries[0], scheduled)
+		close(finished)
+	}()
+	for atomic.LoadInt64(&runs) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cron.fire(ctx, cron.entries[0], scheduled.Add(time.Hour))
+	testkit.Equal(t, missed["hourly"], 1)
+	close(release)
+	<-finished
+	testkit.Equal(t, atomic.LoadInt64(&runs), int64(1))
+
+	// runs since the last saved run are reported as missed
+	last, err := store.LastRun(ctx, "hourly")
+	testkit.NoError(t, err)
+	testkit.Assert(t, last.Equal(scheduled))
+	cron.reportDowntime(ctx, cron.entries[0], scheduled.Add(5*time.Hour+30*time.Minute))
+	testkit.Equal(t, missed["hourly"], 6)
+}
@@ -0,0 +1,241 @@
+package workqueuekit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
+)
+
+// ErrClaimExpired is returned by a JobStore when a job is completed, retried or failed
+// after its visibility timeout ran out and it was claimed again, or after it was removed.
+var ErrClaimExpired = errors.New("workqueuekit: job claim expired")
+
+// DurableJob is a job saved in a JobStore.
+type DurableJob struct {
+	ID        string
+	Type      string
+	Payload   []byte
+	Attempts  int       // incremented every time the job is claimed
+	LastError string    // the error of the last failed attempt
+	RunAt     time.Time // when the job can be claimed
+	Created   time.Time
+}
+
+// JobStore saves the jobs of a DurableQueue. Jobs are claimed by one worker at a time: a
+// claimed job is invisible to other workers until its visibility timeout runs out, and
+// Complete, Retry, Release and Fail only apply to the job as it was claimed, by matching ID and
+// Attempts, and return ErrClaimExpired otherwise.
+type JobStore interface {
+	// Enqueue saves a new job and sets its ID.
+	Enqueue(ctx context.Context, job *DurableJob) error
+
+	// Claim returns the job with the earliest RunAt at or before now, after incrementing
+	// its Attempts and hiding it until now+visibilityTimeout, or nil if there is none.
+	Claim(ctx context.Context, now time.Time, visibilityTimeout time.Duration) (*DurableJob, error)
+
+	// Complete removes a claimed job.
+	Complete(ctx context.Context, job *DurableJob) error
+
+	// Retry makes a claimed job visible again at runAt.
+	Retry(ctx context.Context, job *DurableJob, runAt time.Time, lastError string) error
+
+	// Release makes a claimed job visible again at runAt, without counting the claim as
+	// an attempt, for jobs that didn't get to run.
+	Release(ctx context.Context, job *DurableJob, runAt time.Time) error
+
+	// Fail moves a claimed job to the dead-letter list.
+	Fail(ctx context.Context, job *DurableJob, lastError string) error
+
+	// DeadLetters lists the jobs in the dead-letter list.
+	DeadLetters(ctx context.Context) ([]*DurableJob, error)
+
+	// Requeue moves a job from the dead-letter list back to the queue, to run at now with
+	// its attempts reset.
+	Requeue(ctx context.Context, id string, now time.Time) error
+}
+
+// Handler runs durable jobs of one type.
+type Handler func(ctx context.Context, payload []byte) error
+
+// DurableQueue runs jobs saved in a JobStore, so queued work survives restarts. Failed
+// jobs are retried with exponential backoff, and moved to the dead-letter list after
+// MaxAttempts. Set the fields before calling Run.
+type DurableQueue struct {
+	// Workers is how many jobs run at the same time.
+	Workers int
+
+	// PollInterval is how long an idle worker waits before looking for jobs again.
+	PollInterval time.Duration
+
+	// VisibilityTimeout is how long a job may run. After it, the job's context is
+	// cancelled and another worker may claim the job.
+	VisibilityTimeout time.Duration
+
+	// MaxAttempts is how many times a job runs before it is dead-lettered. Jobs that were
+	// claimed more often, because they crashed the process or outlived the visibility
+	// timeout, are dead-lettered without running again.
+	MaxAttempts int
+
+	// The first retry waits Backoff, and every retry after that waits twice as long, up
+	// to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	store        JobStore
+	handlersLock sync.RWMutex
+	handlers     map[string]Handler
+}
+
+// NewDurableQueue returns a queue for the jobs in store.
+func NewDurableQueue(store JobStore) *DurableQueue {
+	return &DurableQueue{
+		Workers:           4,
+		PollInterval:      time.Second,
+		VisibilityTimeout: 5 * time.Minute,
+		MaxAttempts:       5,
+		Backoff:           10 * time.Second,
+		MaxBackoff:        time.Hour,
+		store:             store,
+		handlers:          make(map[string]Handler),
+	}
+}
+
+// Handle sets the handler for jobs of a type.
+func (q *DurableQueue) Handle(jobType string, handler Handler) {
+	q.handlersLock.Lock()
+	defer q.handlersLock.Unlock()
+	q.handlers[jobType] = handler
+}
+
+// Enqueue saves a job to run as soon as a worker is free, and returns its id.
+func (q *DurableQueue) Enqueue(ctx context.Context, jobType string, payload []byte) (string, error) {
+	now := time.Now()
+	job := &DurableJob{Type: jobType, Payload: payload, RunAt: now, Created: now}
+	if err := q.store.Enqueue(ctx, job); err != nil {
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// DeadLetters lists the jobs that failed MaxAttempts times.
+func (q *DurableQueue) DeadLetters(ctx context.Context) ([]*DurableJob, error) {
+	return q.store.DeadLetters(ctx)
+}
+
+// Requeue moves a dead-lettered job back to the queue, with its attempts reset.
+func (q *DurableQueue) Requeue(ctx context.Context, id string) error {
+	return q.store.Requeue(ctx, id, time.Now())
+}
+
+// Run runs jobs until ctx is done. Jobs running when ctx is done have their context
+// cancelled, and are released to run again without counting the attempt, unless they
+// finish anyway.
+func (q *DurableQueue) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i := 0; i < q.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (q *DurableQueue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		found, err := q.RunOne(ctx)
+		if err != nil {
+			logkit.Error(ctx, "Could not run durable job", logkit.Err(err))
+		}
+		if found && err == nil {
+			continue
+		}
+
+		timer := time.NewTimer(q.PollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// RunOne claims and runs a single job, and returns whether there was one. Jobs that fail
+// are retried or dead-lettered; the error is only for problems with the store.
+func (q *DurableQueue) RunOne(ctx context.Context) (bool, error) {
+	job, err := q.store.Claim(ctx, time.Now(), q.VisibilityTimeout)
+	if err != nil || job == nil {
+		return false, err
+	}
+
+	jobCtx, done := logkit.Operation(ctx, "workqueue.job", logkit.String("type", job.Type), logkit.String("id", job.ID), logkit.Int("attempt", job.Attempts))
+	defer done()
+
+	// store updates shouldn't be cancelled with the job
+	if job.Attempts > q.MaxAttempts {
+		jobCtx.Error("Durable job exceeded its attempts without finishing, moving it to the dead-letter list")
+		return true, q.store.Fail(context.Background(), job, fmt.Sprintf("exceeded %v attempts without finishing", q.MaxAttempts))
+	}
+
+	q.handlersLock.RLock()
+	handler, found := q.handlers[job.Type]
+	q.handlersLock.RUnlock()
+	if !found {
+		// another process may handle it, so it isn't a failed attempt. It is released after
+		// PollInterval, so this worker doesn't claim it again right away.
+		jobCtx.Warn("No handler for durable job type, releasing it")
+		return true, q.store.Release(context.Background(), job, time.Now().Add(q.PollInterval))
+	}
+
+	jobErr := q.run(jobCtx, handler, job)
+	if jobErr != nil && ctx.Err() != nil {
+		// cancelled by Run's ctx, not failed
+		jobCtx.Warn("Durable job cancelled, releasing it", logkit.Err(jobErr))
+		return true, q.store.Release(context.Background(), job, time.Now())
+	}
+	err = q.finish(context.Background(), jobCtx, job, jobErr)
+	return true, err
+}
+
+func (q *DurableQueue) run(ctx context.Context, handler Handler, job *DurableJob) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, q.VisibilityTimeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			panicked := &PanicError{Value: r, Stack: debug.Stack()}
+			logkit.Error(ctx, "Durable job panicked", logkit.String("panic", fmt.Sprint(r)), logkit.String("stack", string(panicked.Stack)))
+			err = panicked
+		}
+	}()
+
+	return handler(ctx, job.Payload)
+}
+
+func (q *DurableQueue) finish(ctx context.Context, log *logkit.Context, job *DurableJob, jobErr error) error {
+	if jobErr == nil {
+		return q.store.Complete(ctx, job)
+	}
+
+	if job.Attempts >= q.MaxAttempts {
+		log.Error("Durable job failed, moving it to the dead-letter list", logkit.Err(jobErr))
+		return q.store.Fail(ctx, job, jobErr.Error())
+	}
+
+	backoff := q.Backoff
+	for i := 1; i < job.Attempts && backoff < q.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.MaxBackoff {
+		backoff = q.MaxBackoff
+	}
+	log.Warn("Durable job failed, retrying", logkit.Err(jobErr), logkit.Duration("backoff", backoff))
+	return q.store.Retry(ctx, job, time.Now().Add(backoff), jobErr.Error())
+}
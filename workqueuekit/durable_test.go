@@ -0,0 +1,255 @@
+package workqueuekit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oliverkofoed/gokit/testkit"
+)
+
+func TestBoltJobStore(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobs.bolt")
+	store, err := OpenBoltJobStore(filename)
+	testkit.NoError(t, err)
+	testJobStore(t, store)
+
+	// jobs survive reopening the store
+	ctx := context.Background()
+	now := time.Now()
+	testkit.NoError(t, store.Enqueue(ctx, &DurableJob{Type: "durable", Payload: []byte("x"), RunAt: now, Created: now}))
+	testkit.NoError(t, store.Close())
+	store, err = OpenBoltJobStore(filename)
+	testkit.NoError(t, err)
+	defer store.Close()
+	job, err := store.Claim(ctx, now, time.Minute)
+	testkit.NoError(t, err)
+	testkit.Assert(t, job != nil)
+	testkit.Equal(t, job.Type, "durable")
+}
+
+func TestPostgresJobStore(t *testing.T) {
+	// e.g. WORKQUEUEKIT_POSTGRES="postgres://root@127.0.0.1:26257/defaultdb?sslmode=disable"
+	url := os.Getenv("WORKQUEUEKIT_POSTGRES")
+	if url == "" {
+		t.Skip("set WORKQUEUEKIT_POSTGRES to test against postgres")
+	}
+
+	ctx := context.Background()
+	db, err := sql.Open("postgres", url)
+	testkit.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("DROP TABLE IF EXISTS workqueuekit_tests")
+	testkit.NoError(t, err)
+	store, err := NewPostgresJobStore(ctx, db, "workqueuekit_tests")
+	testkit.NoError(t, err)
+	testJobStore(t, store)
+}
+
+func testJobStore(t *testing.T, store JobStore) {
+	ctx := context.Background()
+	now := time.Now()
+
+	job, err := store.Claim(ctx, now, time.Minute)
+	testkit.NoError(t, err)
+	testkit.Assert(t, job == nil)
+
+	first := &DurableJob{Type: "first", Payload: []byte("1"), RunAt: now, Created: now}
+	later := &DurableJob{Type: "later", Payload: []byte("2"), RunAt: now.Add(time.Hour), Created: now}
+	testkit.NoError(t, store.Enqueue(ctx, later))
+	testkit.NoError(t, store.Enqueue(ctx, first))
+	testkit.Assert(t, first.ID != "" && first.ID != later.ID)
+
+	// only jobs that are due can be claimed, and claimed jobs are hidden
+	job, err = store.Claim(ctx, now, time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, first.ID)
+	testkit.Equal(t, string(job.Payload), "1")
+	testkit.Equal(t, job.Attempts, 1)
+	none, err := store.Claim(ctx, now, time.Minute)
+	testkit.NoError(t, err)
+	testkit.Assert(t, none == nil)
+
+	// after the visibility timeout the job can be claimed again, and the old claim expires
+	again, err := store.Claim(ctx, now.Add(2*time.Minute), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, again.ID, first.ID)
+	testkit.Equal(t, again.Attempts, 2)
+	testkit.Equal(t, store.Complete(ctx, job), ErrClaimExpired)
+
+	// retry makes it visible at the new time
+	testkit.NoError(t, store.Retry(ctx, again, now.Add(10*time.Minute), "failed"))
+	none, err = store.Claim(ctx, now.Add(5*time.Minute), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Assert(t, none == nil)
+	job, err = store.Claim(ctx, now.Add(10*time.Minute), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, first.ID)
+	testkit.Equal(t, job.LastError, "failed")
+	testkit.Equal(t, job.Attempts, 3)
+
+	// release makes it visible again without counting the claim
+	testkit.NoError(t, store.Release(ctx, job, now.Add(11*time.Minute)))
+	testkit.Equal(t, store.Release(ctx, job, now.Add(11*time.Minute)), ErrClaimExpired)
+	job, err = store.Claim(ctx, now.Add(11*time.Minute), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, first.ID)
+	testkit.Equal(t, job.Attempts, 3)
+
+	// dead-letter and requeue
+	testkit.NoError(t, store.Fail(ctx, job, "gave up"))
+	dead, err := store.DeadLetters(ctx)
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(dead), 1)
+	testkit.Equal(t, dead[0].ID, first.ID)
+	testkit.Equal(t, dead[0].LastError, "gave up")
+	testkit.Error(t, store.Requeue(ctx, later.ID, now))
+
+	testkit.NoError(t, store.Requeue(ctx, first.ID, now.Add(20*time.Minute)))
+	dead, err = store.DeadLetters(ctx)
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(dead), 0)
+	job, err = store.Claim(ctx, now.Add(20*time.Minute), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, first.ID)
+	testkit.Equal(t, job.Attempts, 1)
+	testkit.NoError(t, store.Complete(ctx, job))
+
+	// the later job is left
+	job, err = store.Claim(ctx, now.Add(2*time.Hour), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, later.ID)
+	testkit.NoError(t, store.Complete(ctx, job))
+	none, err = store.Claim(ctx, now.Add(3*time.Hour), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Assert(t, none == nil)
+}
+
+func TestDurableQueue(t *testing.T) {
+	ctx := context.Background()
+	store, err := OpenBoltJobStore(filepath.Join(t.TempDir(), "jobs.bolt"))
+	testkit.NoError(t, err)
+	defer store.Close()
+
+	queue := NewDurableQueue(store)
+	queue.MaxAttempts = 3
+	queue.Backoff = 0
+
+	ran := int64(0)
+	queue.Handle("ok", func(ctx context.Context, payload []byte) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	})
+	flaky := int64(0)
+	queue.Handle("flaky", func(ctx context.Context, payload []byte) error {
+		if atomic.AddInt64(&flaky, 1) < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	queue.Handle("panics", func(ctx context.Context, payload []byte) error {
+		panic("boom")
+	})
+
+	_, err = queue.Enqueue(ctx, "ok", nil)
+	testkit.NoError(t, err)
+	_, err = queue.Enqueue(ctx, "flaky", nil)
+	testkit.NoError(t, err)
+	panics, err := queue.Enqueue(ctx, "panics", []byte("payload"))
+	testkit.NoError(t, err)
+
+	for {
+		found, err := queue.RunOne(ctx)
+		testkit.NoError(t, err)
+		if !found {
+			break
+		}
+	}
+	testkit.Equal(t, atomic.LoadInt64(&ran), int64(1))
+	testkit.Equal(t, atomic.LoadInt64(&flaky), int64(3))
+
+	dead, err := queue.DeadLetters(ctx)
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(dead), 1)
+	testkit.Equal(t, dead[0].ID, panics)
+	testkit.Equal(t, dead[0].Attempts, 3)
+	testkit.Equal(t, dead[0].LastError, "job panicked: boom")
+
+	// jobs claimed too often without finishing, e.g. because they crash the process, are
+	// dead-lettered without running
+	crashes, err := queue.Enqueue(ctx, "ok", nil)
+	testkit.NoError(t, err)
+	for i := 0; i < queue.MaxAttempts; i++ {
+		job, err := store.Claim(ctx, time.Now(), time.Millisecond)
+		testkit.NoError(t, err)
+		testkit.Equal(t, job.ID, crashes)
+		time.Sleep(5 * time.Millisecond)
+	}
+	found, err := queue.RunOne(ctx)
+	testkit.NoError(t, err)
+	testkit.Assert(t, found)
+	testkit.Equal(t, atomic.LoadInt64(&ran), int64(1))
+	dead, err = queue.DeadLetters(ctx)
+	testkit.NoError(t, err)
+	testkit.Equal(t, len(dead), 2)
+	for _, job := range dead {
+		if job.ID == crashes {
+			testkit.Equal(t, job.Attempts, queue.MaxAttempts+1)
+		}
+	}
+
+	// jobs without a handler are released without counting the attempt
+	unhandled, err := queue.Enqueue(ctx, "unhandled", nil)
+	testkit.NoError(t, err)
+	found, err = queue.RunOne(ctx)
+	testkit.NoError(t, err)
+	testkit.Assert(t, found)
+	job, err := store.Claim(ctx, time.Now().Add(queue.PollInterval), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, unhandled)
+	testkit.Equal(t, job.Attempts, 1)
+	testkit.NoError(t, store.Complete(ctx, job))
+
+	// jobs cancelled by Run's ctx are released without counting the attempt
+	cancelled, err := queue.Enqueue(ctx, "cancelled", nil)
+	testkit.NoError(t, err)
+	cancelCtx, cancelJob := context.WithCancel(ctx)
+	queue.Handle("cancelled", func(ctx context.Context, payload []byte) error {
+		cancelJob()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	found, err = queue.RunOne(cancelCtx)
+	testkit.NoError(t, err)
+	testkit.Assert(t, found)
+	job, err = store.Claim(ctx, time.Now(), time.Minute)
+	testkit.NoError(t, err)
+	testkit.Equal(t, job.ID, cancelled)
+	testkit.Equal(t, job.Attempts, 1)
+	testkit.Equal(t, job.LastError, "")
+	testkit.NoError(t, store.Complete(ctx, job))
+
+	// requeued jobs run again when Run picks them up
+	queue.Handle("panics", func(ctx context.Context, payload []byte) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	})
+	testkit.NoError(t, queue.Requeue(ctx, panics))
+	queue.PollInterval = 10 * time.Millisecond
+	runCtx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	go func() {
+		testkit.NoError(t, queue.Run(runCtx))
+		close(finished)
+	}()
+	for atomic.LoadInt64(&ran) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-finished
+}
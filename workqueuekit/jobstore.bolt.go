@@ -0,0 +1,210 @@
+package workqueuekit
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var boltJobsBucket = []byte("jobs")
+var boltReadyBucket = []byte("ready")
+var boltDeadBucket = []byte("dead")
+
+// BoltJobStore is a JobStore in a local bolt file, for queues used by a single process.
+type BoltJobStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltJobStore opens or creates the job store in filename.
+func OpenBoltJobStore(filename string) (*BoltJobStore, error) {
+	db, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltJobsBucket, boltReadyBucket, boltDeadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltJobStore{db: db}, nil
+}
+
+func (s *BoltJobStore) Close() error {
+	return s.db.Close()
+}
+
+// ready index keys are the time the job can be claimed followed by its id, so a cursor
+// finds the next job first
+func boltReadyKey(job *DurableJob) []byte {
+	key := make([]byte, 8, 8+len(job.ID))
+	binary.BigEndian.PutUint64(key, uint64(job.RunAt.UnixNano()))
+	return append(key, job.ID...)
+}
+
+func (s *BoltJobStore) Enqueue(ctx context.Context, job *DurableJob) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(boltJobsBucket)
+		id, err := jobs.NextSequence()
+		if err != nil {
+			return err
+		}
+		job.ID = fmt.Sprintf("%016x", id)
+		return s.put(tx, job)
+	})
+}
+
+func (s *BoltJobStore) put(tx *bolt.Tx, job *DurableJob) error {
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltJobsBucket).Put([]byte(job.ID), value); err != nil {
+		return err
+	}
+	return tx.Bucket(boltReadyBucket).Put(boltReadyKey(job), nil)
+}
+
+func (s *BoltJobStore) get(bucket *bolt.Bucket, id string) (*DurableJob, error) {
+	value := bucket.Get([]byte(id))
+	if value == nil {
+		return nil, nil
+	}
+	job := &DurableJob{}
+	if err := json.Unmarshal(value, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *BoltJobStore) Claim(ctx context.Context, now time.Time, visibilityTimeout time.Duration) (*DurableJob, error) {
+	var claimed *DurableJob
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		key, _ := tx.Bucket(boltReadyBucket).Cursor().First()
+		if key == nil || int64(binary.BigEndian.Uint64(key)) > now.UnixNano() {
+			return nil
+		}
+
+		job, err := s.get(tx.Bucket(boltJobsBucket), string(key[8:]))
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltReadyBucket).Delete(key); err != nil {
+			return err
+		}
+		if job == nil {
+			return nil
+		}
+
+		job.Attempts++
+		job.RunAt = now.Add(visibilityTimeout)
+		claimed = job
+		return s.put(tx, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+// claimed runs fn with the stored job if it is still claimed as job, after removing it
+// from the queue.
+func (s *BoltJobStore) claimed(job *DurableJob, fn func(tx *bolt.Tx, stored *DurableJob) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		stored, err := s.get(tx.Bucket(boltJobsBucket), job.ID)
+		if err != nil {
+			return err
+		}
+		if stored == nil || stored.Attempts != job.Attempts {
+			return ErrClaimExpired
+		}
+
+		if err := tx.Bucket(boltReadyBucket).Delete(boltReadyKey(stored)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltJobsBucket).Delete([]byte(stored.ID)); err != nil {
+			return err
+		}
+		return fn(tx, stored)
+	})
+}
+
+func (s *BoltJobStore) Complete(ctx context.Context, job *DurableJob) error {
+	return s.claimed(job, func(tx *bolt.Tx, stored *DurableJob) error {
+		return nil
+	})
+}
+
+func (s *BoltJobStore) Retry(ctx context.Context, job *DurableJob, runAt time.Time, lastError string) error {
+	return s.claimed(job, func(tx *bolt.Tx, stored *DurableJob) error {
+		stored.RunAt = runAt
+		stored.LastError = lastError
+		return s.put(tx, stored)
+	})
+}
+
+func (s *BoltJobStore) Release(ctx context.Context, job *DurableJob, runAt time.Time) error {
+	return s.claimed(job, func(tx *bolt.Tx, stored *DurableJob) error {
+		stored.Attempts--
+		stored.RunAt = runAt
+		return s.put(tx, stored)
+	})
+}
+
+func (s *BoltJobStore) Fail(ctx context.Context, job *DurableJob, lastError string) error {
+	return s.claimed(job, func(tx *bolt.Tx, stored *DurableJob) error {
+		stored.LastError = lastError
+		value, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltDeadBucket).Put([]byte(stored.ID), value)
+	})
+}
+
+func (s *BoltJobStore) DeadLetters(ctx context.Context) ([]*DurableJob, error) {
+	jobs := []*DurableJob{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDeadBucket).ForEach(func(key, value []byte) error {
+			job := &DurableJob{}
+			if err := json.Unmarshal(value, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+func (s *BoltJobStore) Requeue(ctx context.Context, id string, now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		dead := tx.Bucket(boltDeadBucket)
+		job, err := s.get(dead, id)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return fmt.Errorf("workqueuekit: no dead-lettered job %q", id)
+		}
+		if err := dead.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		job.Attempts = 0
+		job.RunAt = now
+		return s.put(tx, job)
+	})
+}
@@ -0,0 +1,146 @@
+package workqueuekit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresJobStore is a JobStore in a Postgres table, for queues shared by many processes.
+// Workers claim jobs with SELECT ... FOR UPDATE SKIP LOCKED, so they don't wait for each
+// other. Dead-lettered jobs stay in the table, marked as dead.
+type PostgresJobStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewPostgresJobStore returns a store using table, and creates the table if it doesn't exist.
+func NewPostgresJobStore(ctx context.Context, db *sql.DB, table string) (*PostgresJobStore, error) {
+	s := &PostgresJobStore{db: db, table: pq.QuoteIdentifier(table)}
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+s.table+` (
+		id BIGSERIAL PRIMARY KEY,
+		type TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		run_at TIMESTAMPTZ NOT NULL,
+		created TIMESTAMPTZ NOT NULL,
+		dead BOOLEAN NOT NULL DEFAULT false
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("could not create job table %v: %v", table, err)
+	}
+	_, err = db.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS `+pq.QuoteIdentifier(table+"_ready")+` ON `+s.table+` (run_at) WHERE NOT dead`)
+	if err != nil {
+		return nil, fmt.Errorf("could not create index on job table %v: %v", table, err)
+	}
+
+	return s, nil
+}
+
+const postgresJobColumns = "id, type, payload, attempts, last_error, run_at, created"
+
+func scanPostgresJob(row interface{ Scan(...interface{}) error }) (*DurableJob, error) {
+	job := &DurableJob{}
+	var id int64
+	if err := row.Scan(&id, &job.Type, &job.Payload, &job.Attempts, &job.LastError, &job.RunAt, &job.Created); err != nil {
+		return nil, err
+	}
+	job.ID = strconv.FormatInt(id, 10)
+	return job, nil
+}
+
+func (s *PostgresJobStore) Enqueue(ctx context.Context, job *DurableJob) error {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `INSERT INTO `+s.table+` (type, payload, attempts, last_error, run_at, created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		job.Type, job.Payload, job.Attempts, job.LastError, job.RunAt, job.Created).Scan(&id)
+	if err != nil {
+		return err
+	}
+	job.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (s *PostgresJobStore) Claim(ctx context.Context, now time.Time, visibilityTimeout time.Duration) (*DurableJob, error) {
+	row := s.db.QueryRowContext(ctx, `UPDATE `+s.table+` SET attempts = attempts + 1, run_at = $2 WHERE id = (
+		SELECT id FROM `+s.table+` WHERE NOT dead AND run_at <= $1 ORDER BY run_at LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING `+postgresJobColumns, now, now.Add(visibilityTimeout))
+
+	job, err := scanPostgresJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// claimed runs a statement on the job if it is still claimed as job. The statement gets the
+// id and attempts as $1 and $2, followed by args.
+func (s *PostgresJobStore) claimed(ctx context.Context, job *DurableJob, statement string, args ...interface{}) error {
+	id, err := strconv.ParseInt(job.ID, 10, 64)
+	if err != nil {
+		return ErrClaimExpired
+	}
+
+	result, err := s.db.ExecContext(ctx, statement+` WHERE id = $1 AND attempts = $2 AND NOT dead`, append([]interface{}{id, job.Attempts}, args...)...)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrClaimExpired
+	}
+	return nil
+}
+
+func (s *PostgresJobStore) Complete(ctx context.Context, job *DurableJob) error {
+	return s.claimed(ctx, job, `DELETE FROM `+s.table)
+}
+
+func (s *PostgresJobStore) Retry(ctx context.Context, job *DurableJob, runAt time.Time, lastError string) error {
+	return s.claimed(ctx, job, `UPDATE `+s.table+` SET run_at = $3, last_error = $4`, runAt, lastError)
+}
+
+func (s *PostgresJobStore) Release(ctx context.Context, job *DurableJob, runAt time.Time) error {
+	return s.claimed(ctx, job, `UPDATE `+s.table+` SET run_at = $3, attempts = attempts - 1`, runAt)
+}
+
+func (s *PostgresJobStore) Fail(ctx context.Context, job *DurableJob, lastError string) error {
+	return s.claimed(ctx, job, `UPDATE `+s.table+` SET dead = true, last_error = $3`, lastError)
+}
+
+func (s *PostgresJobStore) DeadLetters(ctx context.Context) ([]*DurableJob, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+postgresJobColumns+` FROM `+s.table+` WHERE dead ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*DurableJob{}
+	for rows.Next() {
+		job, err := scanPostgresJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *PostgresJobStore) Requeue(ctx context.Context, id string, now time.Time) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE `+s.table+` SET dead = false, attempts = 0, run_at = $2 WHERE id = $1 AND dead`, id, now)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return fmt.Errorf("workqueuekit: no dead-lettered job %q", id)
+	}
+	return nil
+}
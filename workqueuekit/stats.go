@@ -0,0 +1,129 @@
+package workqueuekit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds of the buckets in DurationHistogram.
+var durationBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// Stats are the statistics of a WorkQueue.
+type Stats struct {
+	Workers  int
+	InFlight int
+
+	// Queued is the number of jobs waiting in each lane, and Delayed the number of jobs
+	// queued with QueueAt that aren't due yet. Blocked is the number of queued jobs that
+	// wait for an earlier job with the same key, so more workers won't run them sooner.
+	Queued  map[string]int
+	Delayed int
+	Blocked int
+
+	// Started, Completed and Failed count jobs since the queue was created. WaitTime is the
+	// total time started jobs waited in the queue.
+	Started   int64
+	Completed int64
+	Failed    int64
+	WaitTime  time.Duration
+
+	// Duration is how long finished jobs ran.
+	Duration DurationHistogram
+}
+
+// QueueDepth is the number of jobs waiting in all lanes.
+func (s Stats) QueueDepth() int {
+	depth := 0
+	for _, queued := range s.Queued {
+		depth += queued
+	}
+	return depth
+}
+
+// DurationHistogram counts jobs by duration. Counts[i] is the number of jobs that took at
+// most Buckets[i].
+type DurationHistogram struct {
+	Buckets []time.Duration
+	Counts  []int64
+	Count   int64
+	Sum     time.Duration
+}
+
+// queueStats keeps the counters of a queue.
+type queueStats struct {
+	started   int64
+	completed int64
+	failed    int64
+	waitTime  int64
+	buckets   [len(durationBuckets)]int64
+	sum       int64
+}
+
+func (s *queueStats) startedJob(wait time.Duration) {
+	atomic.AddInt64(&s.started, 1)
+	atomic.AddInt64(&s.waitTime, int64(wait))
+}
+
+func (s *queueStats) finishedJob(d time.Duration, failed bool) {
+	for i, bucket := range durationBuckets {
+		if d <= bucket {
+			atomic.AddInt64(&s.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddInt64(&s.sum, int64(d))
+	if failed {
+		atomic.AddInt64(&s.failed, 1)
+	} else {
+		atomic.AddInt64(&s.completed, 1)
+	}
+}
+
+// Stats returns the current statistics of the queue.
+func (w *WorkQueue) Stats() Stats {
+	stats := Stats{
+		Queued:    make(map[string]int),
+		Started:   atomic.LoadInt64(&w.stats.started),
+		Completed: atomic.LoadInt64(&w.stats.completed),
+		Failed:    atomic.LoadInt64(&w.stats.failed),
+		WaitTime:  time.Duration(atomic.LoadInt64(&w.stats.waitTime)),
+		Duration: DurationHistogram{
+			Buckets: durationBuckets[:],
+			Counts:  make([]int64, len(durationBuckets)),
+			Sum:     time.Duration(atomic.LoadInt64(&w.stats.sum)),
+		},
+	}
+	stats.Duration.Count = stats.Completed + stats.Failed
+
+	var cumulative int64
+	for i := range durationBuckets {
+		cumulative += atomic.LoadInt64(&w.stats.buckets[i])
+		stats.Duration.Counts[i] = cumulative
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	stats.Workers = w.workers
+	stats.InFlight = w.inFlight
+	stats.Delayed = len(w.delayed)
+	for _, l := range w.lanes {
+		stats.Queued[l.name] = l.queued
+	}
+	for _, k := range w.keys {
+		stats.Blocked += len(k.pending)
+	}
+	return stats
+}
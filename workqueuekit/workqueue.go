@@ -1,37 +1,520 @@
 package workqueuekit
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/oliverkofoed/gokit/logkit"
 )
 
+// ErrClosed is returned when work is queued after Wait or Shutdown.
+var ErrClosed = errors.New("workqueuekit: queue is closed")
+
+var errFull = errors.New("workqueuekit: queue is full")
+
+// Job is a unit of work. The context is cancelled by Shutdown.
+type Job func(ctx context.Context) error
+
+// PanicError is the error of a job that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("job panicked: %v", e.Value)
+}
+
+// maxErrors is the number of job errors a WorkQueue keeps for Wait. Later errors are
+// counted, so a long running queue with failing jobs doesn't grow without bound.
+const maxErrors = 100
+
+// Errors are the errors returned by jobs, in the order the jobs finished. errors.Is and
+// errors.As match any of them.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("jobs failed: %v", strings.Join(messages, "; "))
+}
+
+// Is reports whether any of the errors matches target.
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, like errors.As.
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultLane is the lane used by QueueWork, QueueJob, TryQueueJob and QueueKeyed. It has weight 1.
+const DefaultLane = ""
+
+// WorkQueue runs jobs on a pool of workers, see SetWorkers. Jobs are queued in lanes, and workers
+// pick from the lanes with waiting jobs in proportion to the lanes' weights, so a flood of
+// jobs in one lane can't starve the others.
 type WorkQueue struct {
-	queue chan func()
-	wg    sync.WaitGroup
+	maxQueueSize int
+	wg           sync.WaitGroup
+
+	// the context of jobs, cancelled by Shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	ready     *sync.Cond // signalled when a job is ready or the queue closes
+	lanes     []*lane
+	lanesByID map[string]*lane
+	keys      map[string]*keyedJobs
+	closed    bool
+
+	// workers is the size of the pool, and running is the number of worker goroutines,
+	// which is higher while workers are stopping after SetWorkers
+	workers  int
+	running  int
+	inFlight int
+
+	// jobs queued with QueueAt that aren't due yet
+	delayed map[*time.Timer]struct{}
+
+	// room is closed and replaced when a job leaves a lane while QueueJob is waiting,
+	// and closing is closed when the queue closes
+	room        chan struct{}
+	roomWaiters int
+	closing     chan struct{}
+
+	errorsLock    sync.Mutex
+	errors        Errors
+	droppedErrors int
+
+	stats queueStats
 }
 
+type lane struct {
+	name   string
+	weight int
+	jobs   []queuedJob
+
+	// queued counts jobs in jobs and keyed jobs waiting for their key
+	queued int
+
+	// current is the lane's credit in the smooth weighted round robin
+	current int
+}
+
+type queuedJob struct {
+	job    Job
+	key    string
+	keyed  bool
+	queued time.Time
+}
+
+// keyedJobs are the jobs waiting behind the queued or running job for a key.
+type keyedJobs struct {
+	lane    *lane
+	pending []queuedJob
+}
+
+// New returns a work queue with workerCount workers, that holds up to maxQueueSize jobs
+// in each lane.
 func New(workerCount int, maxQueueSize int) *WorkQueue {
+	if maxQueueSize < 1 {
+		maxQueueSize = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	w := &WorkQueue{
-		queue: make(chan func(), maxQueueSize),
+		maxQueueSize: maxQueueSize,
+		ctx:          ctx,
+		cancel:       cancel,
+		lanesByID:    make(map[string]*lane),
+		keys:         make(map[string]*keyedJobs),
+		delayed:      make(map[*time.Timer]struct{}),
+		room:         make(chan struct{}),
+		closing:      make(chan struct{}),
+	}
+	w.ready = sync.NewCond(&w.lock)
+	w.SetLane(DefaultLane, 1)
+	w.SetWorkers(workerCount)
+	return w
+}
+
+// SetWorkers grows or shrinks the pool to n workers, at least 1. When shrinking, workers
+// finish the job they are running before they stop.
+func (w *WorkQueue) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
 	}
 
-	for i := 0; i < workerCount; i++ {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		// Wait may already be waiting for the workers to stop
+		return
+	}
+	w.workers = n
+	for ; w.running < n; w.running++ {
 		w.wg.Add(1)
 		go func() {
 			defer w.wg.Done()
-			for work := range w.queue {
-				work()
-			}
+			w.work()
 		}()
 	}
 
-	return w
+	// idle workers above n stop when they wake up
+	w.ready.Broadcast()
 }
 
+// Workers returns the size of the pool.
+func (w *WorkQueue) Workers() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.workers
+}
+
+// SetLane adds a lane, or changes the weight of an existing one. A lane with weight 3 gets
+// three times as many workers as a lane with weight 1 when both have jobs waiting.
+func (w *WorkQueue) SetLane(name string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if l, found := w.lanesByID[name]; found {
+		l.weight = weight
+		return
+	}
+	l := &lane{name: name, weight: weight}
+	w.lanes = append(w.lanes, l)
+	w.lanesByID[name] = l
+}
+
+func (w *WorkQueue) work() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for {
+		next, ok := w.next()
+		if !ok {
+			w.running--
+			return
+		}
+
+		w.inFlight++
+		w.lock.Unlock()
+		start := time.Now()
+		w.stats.startedJob(start.Sub(next.queued))
+		failed := w.run(next.job)
+		w.stats.finishedJob(time.Since(start), failed)
+		w.lock.Lock()
+		w.inFlight--
+
+		if next.keyed {
+			w.finishKey(next.key)
+		}
+	}
+}
+
+// next waits for a job and takes it from its lane. It returns false when the queue is
+// closed and empty, or shut down, or when the worker should stop because the pool shrank.
+func (w *WorkQueue) next() (queuedJob, bool) {
+	for {
+		if w.ctx.Err() != nil {
+			// shut down, skip the rest of the queue
+			return queuedJob{}, false
+		}
+		if w.running > w.workers {
+			return queuedJob{}, false
+		}
+
+		// smooth weighted round robin: every lane with jobs earns its weight, and the lane
+		// with the most credit pays for the job with the total weight
+		var picked *lane
+		total := 0
+		for _, l := range w.lanes {
+			if len(l.jobs) == 0 {
+				continue
+			}
+			l.current += l.weight
+			total += l.weight
+			if picked == nil || l.current > picked.current {
+				picked = l
+			}
+		}
+
+		if picked != nil {
+			picked.current -= total
+			next := picked.jobs[0]
+			picked.jobs[0] = queuedJob{}
+			picked.jobs = picked.jobs[1:]
+			picked.queued--
+			if w.roomWaiters > 0 {
+				close(w.room)
+				w.room = make(chan struct{})
+			}
+			return next, true
+		}
+
+		if w.closed && len(w.keys) == 0 && len(w.delayed) == 0 {
+			return queuedJob{}, false
+		}
+		w.ready.Wait()
+	}
+}
+
+// finishKey queues the next job for a key, or forgets the key if there are none.
+func (w *WorkQueue) finishKey(key string) {
+	k := w.keys[key]
+	if len(k.pending) == 0 {
+		delete(w.keys, key)
+		if w.closed {
+			// workers waiting for the last keyed jobs can stop
+			w.ready.Broadcast()
+		}
+		return
+	}
+
+	next := k.pending[0]
+	k.pending[0] = queuedJob{}
+	k.pending = k.pending[1:]
+	k.lane.jobs = append(k.lane.jobs, next)
+	w.ready.Signal()
+}
+
+// run runs a job and returns whether it failed.
+func (w *WorkQueue) run(job Job) (failed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := &PanicError{Value: r, Stack: debug.Stack()}
+			logkit.Error(w.ctx, "Work queue job panicked", logkit.String("panic", fmt.Sprint(r)), logkit.String("stack", string(err.Stack)))
+			w.addError(err)
+			failed = true
+		}
+	}()
+
+	if err := job(w.ctx); err != nil {
+		w.addError(err)
+		return true
+	}
+	return false
+}
+
+func (w *WorkQueue) addError(err error) {
+	w.errorsLock.Lock()
+	if len(w.errors) < maxErrors {
+		w.errors = append(w.errors, err)
+	} else {
+		w.droppedErrors++
+	}
+	w.errorsLock.Unlock()
+}
+
+// QueueWork queues work in the default lane, waiting for room in the lane. It panics
+// after Done, Wait or Shutdown. Use QueueJob for work that can fail or be cancelled.
 func (w *WorkQueue) QueueWork(work func()) {
-	w.queue <- work
+	err := w.QueueJob(context.Background(), func(ctx context.Context) error {
+		work()
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
 }
 
+// Done stops accepting work and waits for all queued work to finish, like Wait without
+// the errors.
 func (w *WorkQueue) Done() {
-	close(w.queue)
+	_ = w.Wait()
+}
+
+// QueueJob queues a job in the default lane, waiting for room in the lane until ctx is
+// done. It returns ctx.Err() if the job couldn't be queued in time, and ErrClosed after
+// Wait or Shutdown.
+func (w *WorkQueue) QueueJob(ctx context.Context, job Job) error {
+	return w.queue(ctx, DefaultLane, "", false, job)
+}
+
+// QueueLane queues a job in a lane added with SetLane, waiting for room like QueueJob.
+func (w *WorkQueue) QueueLane(ctx context.Context, lane string, job Job) error {
+	return w.queue(ctx, lane, "", false, job)
+}
+
+// QueueKeyed queues a job in the default lane like QueueJob, but runs it only after all
+// jobs queued before it with the same key have finished. Jobs with different keys still
+// run in parallel.
+func (w *WorkQueue) QueueKeyed(ctx context.Context, key string, job Job) error {
+	return w.queue(ctx, DefaultLane, key, true, job)
+}
+
+// TryQueueJob queues a job in the default lane if there is room, and returns whether it did.
+func (w *WorkQueue) TryQueueJob(job Job) bool {
+	return w.queue(nil, DefaultLane, "", false, job) == nil
+}
+
+// queue adds a job to a lane. A nil ctx means don't wait for room.
+func (w *WorkQueue) queue(ctx context.Context, laneName string, key string, keyed bool, job Job) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	l, found := w.lanesByID[laneName]
+	if !found {
+		return fmt.Errorf("workqueuekit: unknown lane %q", laneName)
+	}
+
+	for {
+		if w.closed {
+			return ErrClosed
+		}
+		if l.queued < w.maxQueueSize {
+			break
+		}
+		if ctx == nil {
+			return errFull
+		}
+
+		room := w.room
+		w.roomWaiters++
+		w.lock.Unlock()
+		select {
+		case <-room:
+		case <-w.closing:
+		case <-ctx.Done():
+		}
+		w.lock.Lock()
+		w.roomWaiters--
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	l.queued++
+	queued := queuedJob{job: job, key: key, keyed: keyed, queued: time.Now()}
+	if keyed {
+		if k, found := w.keys[key]; found {
+			// wait for the jobs before it with the same key
+			k.pending = append(k.pending, queued)
+			return nil
+		}
+		w.keys[key] = &keyedJobs{lane: l}
+	}
+	l.jobs = append(l.jobs, queued)
+	w.ready.Signal()
+	return nil
+}
+
+// QueueAt queues a job in the default lane at t. The job is added when it is due even if
+// the lane is full. Wait waits for delayed jobs, and Shutdown drops them.
+func (w *WorkQueue) QueueAt(t time.Time, job Job) error {
+	return w.QueueAfter(time.Until(t), job)
+}
+
+// QueueAfter queues a job in the default lane after d, like QueueAt.
+func (w *WorkQueue) QueueAfter(d time.Duration, job Job) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		if _, found := w.delayed[timer]; !found {
+			// dropped by Shutdown
+			return
+		}
+		delete(w.delayed, timer)
+
+		l := w.lanesByID[DefaultLane]
+		l.queued++
+		l.jobs = append(l.jobs, queuedJob{job: job, queued: time.Now()})
+		w.ready.Signal()
+		if w.closed && len(w.delayed) == 0 {
+			// workers waiting for the last delayed job can stop
+			w.ready.Broadcast()
+		}
+	})
+	w.delayed[timer] = struct{}{}
+	return nil
+}
+
+// close stops new work from being queued, and lets the workers finish the queue.
+func (w *WorkQueue) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.closing)
+		w.ready.Broadcast()
+	}
+}
+
+// Wait stops accepting work, waits for all queued jobs to finish, and returns their
+// errors as Errors, or nil if all of them succeeded. Only the first 100 errors are kept,
+// the last error then says how many more jobs failed.
+func (w *WorkQueue) Wait() error {
+	w.close()
 	w.wg.Wait()
+	return w.result()
+}
+
+// Shutdown stops accepting work, cancels the context of the jobs that are running and
+// skips the ones that haven't started. It waits for running jobs to return until ctx is
+// done, and returns ctx.Err() if they didn't, or the errors of the jobs like Wait.
+func (w *WorkQueue) Shutdown(ctx context.Context) error {
+	w.cancel()
+	w.close()
+
+	w.lock.Lock()
+	for timer := range w.delayed {
+		timer.Stop()
+		delete(w.delayed, timer)
+	}
+	w.lock.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return w.result()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *WorkQueue) result() error {
+	w.errorsLock.Lock()
+	defer w.errorsLock.Unlock()
+	if len(w.errors) == 0 {
+		return nil
+	}
+	errs := append(Errors(nil), w.errors...)
+	if w.droppedErrors > 0 {
+		errs = append(errs, fmt.Errorf("%v more jobs failed", w.droppedErrors))
+	}
+	return errs
 }
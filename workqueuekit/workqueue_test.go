@@ -1,8 +1,12 @@
 package workqueuekit
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/oliverkofoed/gokit/testkit"
 )
@@ -18,3 +22,300 @@ func TestWorkQueue(t *testing.T) {
 	work.Done()
 	testkit.Equal(t, ctr, int64(100))
 }
+
+func TestWorkQueueJobs(t *testing.T) {
+	ctx := context.Background()
+	ctr := int64(0)
+	work := New(10, 100)
+	for i := 0; i != 100; i++ {
+		testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error {
+			atomic.AddInt64(&ctr, 1)
+			return nil
+		}))
+	}
+	testkit.NoError(t, work.Wait())
+	testkit.Equal(t, ctr, int64(100))
+
+	// no more work after Wait
+	testkit.Equal(t, work.QueueJob(ctx, func(ctx context.Context) error { return nil }), ErrClosed)
+	testkit.Equal(t, work.TryQueueJob(func(ctx context.Context) error { return nil }), false)
+}
+
+func TestWorkQueueErrors(t *testing.T) {
+	ctx := context.Background()
+	failed := errors.New("failed")
+	work := New(2, 10)
+	testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error { return failed }))
+	testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error { return nil }))
+	testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error { panic("boom") }))
+
+	err := work.Wait()
+	var errs Errors
+	testkit.Assert(t, errors.As(err, &errs))
+	testkit.Equal(t, len(errs), 2)
+	testkit.Assert(t, errors.Is(err, failed))
+
+	var panicked *PanicError
+	testkit.Assert(t, errors.As(err, &panicked))
+	testkit.Equal(t, panicked.Value, "boom")
+	testkit.Assert(t, len(panicked.Stack) > 0)
+}
+
+func TestWorkQueueErrorsCapped(t *testing.T) {
+	ctx := context.Background()
+	work := New(4, 10)
+	for i := 0; i != maxErrors+5; i++ {
+		testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error { return errors.New("failed") }))
+	}
+
+	var errs Errors
+	testkit.Assert(t, errors.As(work.Wait(), &errs))
+	testkit.Equal(t, len(errs), maxErrors+1)
+	testkit.Equal(t, errs[maxErrors].Error(), "5 more jobs failed")
+}
+
+func TestWorkQueueFull(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	blocked := func(ctx context.Context) error {
+		<-release
+		return nil
+	}
+
+	// one running and one queued fills the queue
+	work := New(1, 1)
+	testkit.NoError(t, work.QueueJob(ctx, blocked))
+	for !work.TryQueueJob(blocked) {
+		time.Sleep(time.Millisecond)
+	}
+	testkit.Equal(t, work.TryQueueJob(blocked), false)
+
+	deadline, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	testkit.Equal(t, work.QueueJob(deadline, blocked), context.DeadlineExceeded)
+
+	close(release)
+	testkit.NoError(t, work.Wait())
+}
+
+func TestWorkQueueShutdown(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	ran := int64(0)
+
+	work := New(1, 10)
+	testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	for i := 0; i < 5; i++ {
+		testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error {
+			atomic.AddInt64(&ran, 1)
+			return nil
+		}))
+	}
+	<-started
+
+	timeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err := work.Shutdown(timeout)
+	testkit.Assert(t, errors.Is(err, context.Canceled))
+	testkit.Equal(t, atomic.LoadInt64(&ran), int64(0))
+
+	// jobs that ignore cancellation make Shutdown give up at the deadline
+	work = New(1, 10)
+	testkit.NoError(t, work.QueueJob(ctx, func(ctx context.Context) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}))
+	time.Sleep(10 * time.Millisecond)
+	timeout, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	testkit.Equal(t, work.Shutdown(timeout), context.DeadlineExceeded)
+}
+
+func TestWorkQueueLanes(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	work := New(1, 100)
+	work.SetLane("bulk", 1)
+	work.SetLane("user", 3)
+	testkit.Equal(t, work.QueueLane(ctx, "missing", func(ctx context.Context) error { return nil }) != nil, true)
+
+	// hold the worker until both lanes are full of jobs
+	started := make(chan struct{})
+	testkit.NoError(t, work.QueueLane(ctx, "bulk", func(ctx context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}))
+	<-started
+
+	var lock sync.Mutex
+	order := []string{}
+	for i := 0; i < 20; i++ {
+		for _, lane := range []string{"bulk", "user"} {
+			lane := lane
+			testkit.NoError(t, work.QueueLane(ctx, lane, func(ctx context.Context) error {
+				lock.Lock()
+				order = append(order, lane)
+				lock.Unlock()
+				return nil
+			}))
+		}
+	}
+	close(release)
+	testkit.NoError(t, work.Wait())
+
+	// while both lanes have jobs, user jobs get three of every four turns
+	user := 0
+	for _, lane := range order[:20] {
+		if lane == "user" {
+			user++
+		}
+	}
+	testkit.Equal(t, user, 15)
+	testkit.Equal(t, len(order), 40)
+}
+
+func TestWorkQueueKeyed(t *testing.T) {
+	ctx := context.Background()
+	work := New(8, 1000)
+
+	var lock sync.Mutex
+	running := map[string]int{}
+	seen := map[string][]int{}
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			key, i := key, i
+			testkit.NoError(t, work.QueueKeyed(ctx, key, func(ctx context.Context) error {
+				lock.Lock()
+				running[key]++
+				if running[key] > 1 {
+					t.Errorf("jobs for %v ran concurrently", key)
+				}
+				lock.Unlock()
+
+				time.Sleep(100 * time.Microsecond)
+
+				lock.Lock()
+				running[key]--
+				seen[key] = append(seen[key], i)
+				lock.Unlock()
+				return nil
+			}))
+		}
+	}
+	testkit.NoError(t, work.Wait())
+
+	for _, key := range []string{"a", "b", "c"} {
+		testkit.Equal(t, len(seen[key]), 100)
+		for i, got := range seen[key] {
+			if got != i {
+				t.Errorf("jobs for %v ran out of order: %v", key, seen[key])
+				break
+			}
+		}
+	}
+
+	// different keys run in parallel
+	work = New(2, 10)
+	started := make(chan struct{}, 2)
+	both := make(chan struct{})
+	for _, key := range []string{"x", "y"} {
+		testkit.NoError(t, work.QueueKeyed(ctx, key, func(ctx context.Context) error {
+			started <- struct{}{}
+			<-both
+			return nil
+		}))
+	}
+	<-started
+	<-started
+	testkit.NoError(t, work.QueueKeyed(ctx, "x", func(ctx context.Context) error { return nil }))
+	stats := work.Stats()
+	testkit.Equal(t, stats.QueueDepth(), 1)
+	testkit.Equal(t, stats.Blocked, 1)
+	close(both)
+	testkit.NoError(t, work.Wait())
+}
+
+func TestWorkQueueDelayed(t *testing.T) {
+	ran := int64(0)
+	work := New(2, 10)
+	start := time.Now()
+	testkit.NoError(t, work.QueueAfter(50*time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	}))
+	testkit.NoError(t, work.QueueAt(start.Add(20*time.Millisecond), func(ctx context.Context) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	}))
+
+	// Wait waits for delayed jobs
+	testkit.NoError(t, work.Wait())
+	testkit.Equal(t, atomic.LoadInt64(&ran), int64(2))
+	testkit.Assert(t, time.Since(start) >= 50*time.Millisecond)
+	testkit.Equal(t, work.QueueAfter(time.Millisecond, func(ctx context.Context) error { return nil }), ErrClosed)
+
+	// Shutdown drops them
+	work = New(2, 10)
+	testkit.NoError(t, work.QueueAfter(20*time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt64(&ran, 1)
+		return nil
+	}))
+	testkit.NoError(t, work.Shutdown(context.Background()))
+	time.Sleep(40 * time.Millisecond)
+	testkit.Equal(t, atomic.LoadInt64(&ran), int64(2))
+}
+
+func TestWorkQueueSetWorkers(t *testing.T) {
+	ctx := context.Background()
+	work := New(1, 100)
+
+	var running, maxRunning int64
+	release := make(chan struct{})
+	job := func(ctx context.Context) error {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			max := atomic.LoadInt64(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt64(&maxRunning, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt64(&running, -1)
+		return nil
+	}
+	for i := 0; i < 10; i++ {
+		testkit.NoError(t, work.QueueJob(ctx, job))
+	}
+
+	// grow
+	work.SetWorkers(4)
+	testkit.Equal(t, work.Workers(), 4)
+	for atomic.LoadInt64(&running) != 4 {
+		time.Sleep(time.Millisecond)
+	}
+	stats := work.Stats()
+	testkit.Equal(t, stats.InFlight, 4)
+	testkit.Equal(t, stats.QueueDepth(), 6)
+
+	// shrink, running jobs finish first
+	work.SetWorkers(2)
+	close(release)
+	testkit.NoError(t, work.Wait())
+	testkit.Equal(t, atomic.LoadInt64(&maxRunning), int64(4))
+
+	stats = work.Stats()
+	testkit.Equal(t, stats.Workers, 2)
+	testkit.Equal(t, stats.Started, int64(10))
+	testkit.Equal(t, stats.Completed, int64(10))
+	testkit.Equal(t, stats.Duration.Count, int64(10))
+	testkit.Equal(t, stats.QueueDepth(), 0)
+
+	// the pool doesn't change once the queue is closed
+	work.SetWorkers(8)
+	testkit.Equal(t, work.Workers(), 2)
+}